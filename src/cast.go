@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	wruntime "github.com/ciderapp/wails/v2/pkg/runtime"
+)
+
+// castDiscoveryTimeout is how long `CastSources` listens for devices
+const castDiscoveryTimeout = 3 * time.Second
+
+// castPreviewLength is the length in seconds of the song previews Apple Music serves, full songs are DRM protected and can't be cast
+const castPreviewLength = 30.0
+
+// CastDevice is a device media can be cast to, Kind selects the protocol used to talk to it
+type CastDevice struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Model   string `json:"model"`
+	Kind    string `json:"kind"`
+	Address string `json:"address"`
+}
+
+// CastMediaInfo is the media loaded on a device, Duration is in seconds
+type CastMediaInfo struct {
+	Url         string  `json:"url"`
+	ContentType string  `json:"contentType"`
+	Title       string  `json:"title"`
+	Artist      string  `json:"artist"`
+	Album       string  `json:"album"`
+	Artwork     string  `json:"artwork"`
+	Duration    float64 `json:"duration"`
+	// Preview is set for song previews, which can't follow the position of the full song playing locally
+	Preview bool `json:"preview"`
+}
+
+// clamp returns the position in seconds the media can start or seek to, previews always start from the beginning
+func (m CastMediaInfo) clamp(position float64) float64 {
+	if m.Preview || position < 0 {
+		return 0
+	}
+	if m.Duration > 0 && position > m.Duration {
+		return m.Duration
+	}
+	return position
+}
+
+// CastStatus reports the device being cast to, it is emitted to the frontend as `fujisan:castStatus` on every change
+type CastStatus struct {
+	Connected bool          `json:"connected"`
+	Device    CastDevice    `json:"device"`
+	State     string        `json:"state"`
+	Position  float64       `json:"position"`
+	Volume    float64       `json:"volume"`
+	Media     CastMediaInfo `json:"media"`
+	LastError string        `json:"lastError"`
+}
+
+// castRenderer is a connected device, implemented for every kind of device
+type castRenderer interface {
+	Load(media CastMediaInfo, position float64) error
+	Play() error
+	Pause() error
+	Seek(seconds float64) error
+	SetVolume(volume float64) error
+	Close() error
+}
+
+// castKind discovers and connects to one kind of device. The connection reports status changes and
+// its own disconnects through the callbacks
+type castKind struct {
+	discover func(timeout time.Duration) ([]CastDevice, error)
+	connect  func(device CastDevice, update func(func(*CastStatus)), closed func(error)) (castRenderer, error)
+}
+
+// castKinds holds every kind of device Cider can cast to, keyed by `CastDevice.Kind`
+var castKinds = map[string]castKind{
+	"chromecast": {discover: discoverChromecasts, connect: connectChromecast},
+	"dlna":       {discover: discoverDlnaRenderers, connect: connectDlnaRenderer},
+}
+
+// CastManager keeps the discovered devices and the current cast session, mirroring local play, pause and seek onto it
+type CastManager struct {
+	devices     map[string]CastDevice
+	renderer    castRenderer
+	status      CastStatus
+	session     int
+	unsubscribe func()
+	mutex       sync.Mutex
+}
+
+// NewCastManager returns a `*CastManager` without a session
+func NewCastManager() *CastManager {
+	return &CastManager{devices: make(map[string]CastDevice)}
+}
+
+// emit sends the status to the frontend, the lock must be held
+func (m *CastManager) emit() {
+	if FujisanObject.ctx != nil {
+		wruntime.EventsEmit(FujisanObject.ctx, "fujisan:castStatus", m.status)
+	}
+}
+
+// Discover searches every kind of device in parallel and returns them sorted by name
+func (m *CastManager) Discover(timeout time.Duration) []CastDevice {
+	var found []CastDevice
+	var foundMutex sync.Mutex
+	var wait sync.WaitGroup
+	for name, kind := range castKinds {
+		wait.Add(1)
+		go func(name string, kind castKind) {
+			defer wait.Done()
+			devices, err := kind.discover(timeout)
+			if err != nil {
+				log.Println("Failed to discover", name, "devices:", err)
+			}
+			foundMutex.Lock()
+			found = append(found, devices...)
+			foundMutex.Unlock()
+		}(name, kind)
+	}
+	wait.Wait()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.devices = make(map[string]CastDevice)
+	for _, device := range found {
+		m.devices[device.ID] = device
+	}
+	return found
+}
+
+// Connect starts a session with a discovered device, closing the current one
+func (m *CastManager) Connect(id string) error {
+	m.Disconnect()
+
+	m.mutex.Lock()
+	device, ok := m.devices[id]
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown cast device %q, search for devices first", id)
+	}
+	kind, ok := castKinds[device.Kind]
+	if !ok {
+		return fmt.Errorf("unsupported cast device kind %q", device.Kind)
+	}
+
+	m.mutex.Lock()
+	m.session++
+	session := m.session
+	m.status = CastStatus{Device: device, State: "connecting"}
+	m.emit()
+	m.mutex.Unlock()
+
+	update := func(change func(*CastStatus)) {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if m.session == session {
+			change(&m.status)
+			m.emit()
+		}
+	}
+	closed := func(err error) {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if m.session != session {
+			return
+		}
+		log.Println("Cast session with", device.Name, "ended:", err)
+		m.endSession(err)
+	}
+
+	renderer, err := kind.connect(device, update, closed)
+	m.mutex.Lock()
+	// The session was disconnected, replaced or lost while connecting
+	if m.session != session {
+		m.mutex.Unlock()
+		if err == nil {
+			renderer.Close()
+		}
+		return fmt.Errorf("the cast session with %s ended while connecting", device.Name)
+	}
+	defer m.mutex.Unlock()
+	if err != nil {
+		m.status.State = "disconnected"
+		m.status.LastError = err.Error()
+		m.emit()
+		return err
+	}
+
+	m.renderer = renderer
+	m.status.Connected = true
+	if m.status.State == "connecting" {
+		m.status.State = "idle"
+	}
+	m.unsubscribe = FujisanPlaybackObject.Subscribe(m.mirror)
+	m.emit()
+	log.Println("Casting to", device.Name)
+	return nil
+}
+
+// endSession forgets the session, the lock must be held
+func (m *CastManager) endSession(err error) {
+	if m.unsubscribe != nil {
+		m.unsubscribe()
+		m.unsubscribe = nil
+	}
+	m.renderer = nil
+	m.session++
+	m.status.Connected = false
+	m.status.State = "disconnected"
+	if err != nil {
+		m.status.LastError = err.Error()
+	}
+	m.emit()
+}
+
+// Disconnect closes the current session, a session still connecting is abandoned
+func (m *CastManager) Disconnect() {
+	m.mutex.Lock()
+	renderer := m.renderer
+	if renderer != nil || m.status.State == "connecting" {
+		m.endSession(nil)
+	}
+	m.mutex.Unlock()
+	if renderer != nil {
+		if err := renderer.Close(); err != nil {
+			log.Println("Failed to close cast session:", err)
+		}
+	}
+}
+
+// current returns the renderer of the session
+func (m *CastManager) current() (castRenderer, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.renderer == nil {
+		return nil, errors.New("not casting to a device")
+	}
+	return m.renderer, nil
+}
+
+// Load plays media on the device from position in seconds, clamped to the media
+func (m *CastManager) Load(media CastMediaInfo, position float64) error {
+	renderer, err := m.current()
+	if err != nil {
+		return err
+	}
+	if err := renderer.Load(media, media.clamp(position)); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.status.Media = media
+	m.emit()
+	m.mutex.Unlock()
+	return nil
+}
+
+// SetVolume sets the device volume between 0 and 1
+func (m *CastManager) SetVolume(volume float64) error {
+	if volume < 0 || volume > 1 {
+		return errors.New("volume must be between 0 and 1")
+	}
+	renderer, err := m.current()
+	if err != nil {
+		return err
+	}
+	return renderer.SetVolume(volume)
+}
+
+// Status returns the state of the cast session
+func (m *CastManager) Status() CastStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status
+}
+
+// mirror applies local playback changes to the device
+func (m *CastManager) mirror(event PlaybackEvent) {
+	renderer, err := m.current()
+	if err != nil {
+		return
+	}
+	switch event.Kind {
+	case PlaybackPlay:
+		err = renderer.Play()
+	case PlaybackPause:
+		err = renderer.Pause()
+	case PlaybackSeek:
+		// A local seek is a position in the full song, which means nothing in a preview
+		if media := m.Status().Media; !media.Preview {
+			err = renderer.Seek(media.clamp(event.State.Position))
+		}
+	case PlaybackTrackChange:
+		if media, ok := castMediaFromAttributes(event.Attributes); ok {
+			err = m.Load(media, 0)
+		}
+	}
+	if err != nil {
+		log.Println("Failed to mirror", event.Kind, "to cast device:", err)
+	}
+}
+
+// castMediaFromAttributes describes the preview of a song for a cast device, only songs with a preview can be played by URL
+func castMediaFromAttributes(attributes Attributes) (CastMediaInfo, bool) {
+	if len(attributes.Previews) == 0 || len(attributes.Previews[0].URL) == 0 {
+		return CastMediaInfo{}, false
+	}
+	duration := castPreviewLength
+	if song := float64(attributes.DurationInMillis) / 1000; song > 0 && song < duration {
+		duration = song
+	}
+	attributes = FujisanObject.normalizeAttributes(attributes)
+	return CastMediaInfo{
+		Url:         attributes.Previews[0].URL,
+		ContentType: "audio/mp4",
+		Title:       attributes.Name,
+		Artist:      attributes.ArtistName,
+		Album:       attributes.AlbumName,
+		Artwork:     FujisanObject.SetImageResolution(600, 600, attributes.Artwork.URL),
+		Duration:    duration,
+		Preview:     true,
+	}, true
+}
+
+// CastSources searches the network for devices to cast to
+func (c *Cider) CastSources() []CastDevice {
+	return FujisanCastObject.Discover(castDiscoveryTimeout)
+}
+
+// InitCast starts casting to a device returned by `CastSources`
+func (c *Cider) InitCast(id string) error {
+	return FujisanCastObject.Connect(id)
+}
+
+// CastMedia loads media on the device, the preview of the current song is loaded when no URL is given
+func (c *Cider) CastMedia(media CastMediaInfo) error {
+	if len(media.Url) == 0 {
+		current, ok := castMediaFromAttributes(FujisanPlaybackObject.State().Attributes)
+		if !ok {
+			return errors.New("nothing to cast, pass in a url")
+		}
+		media = current
+	}
+	if len(media.ContentType) == 0 {
+		media.ContentType = "audio/mp4"
+	}
+	return FujisanCastObject.Load(media, 0)
+}
+
+// CastSetVolume sets the volume of the device between 0 and 1
+func (c *Cider) CastSetVolume(volume float64) error {
+	return FujisanCastObject.SetVolume(volume)
+}
+
+// StopCast ends the cast session
+func (c *Cider) StopCast() {
+	FujisanCastObject.Disconnect()
+}
+
+// GetCastStatus returns the state of the cast session
+func (c *Cider) GetCastStatus() CastStatus {
+	return FujisanCastObject.Status()
+}
+
+type CastArgs struct {
+	ID     string        `json:"id"`
+	Media  CastMediaInfo `json:"media"`
+	Volume float64       `json:"volume"`
+}
+
+type CastSourcesType struct {
+	Devices []CastDevice `json:"devices"`
+}
+
+func (f *FujisanRpc) CastSources(r *http.Request, args *interface{}, result *CastSourcesType) error {
+	*result = CastSourcesType{FujisanObject.CastSources()}
+	return nil
+}
+
+func (f *FujisanRpc) InitCast(r *http.Request, args *CastArgs, result *SuccessType) error {
+	if args == nil || len(args.ID) == 0 {
+		return errors.New("must pass in id")
+	}
+	if err := FujisanObject.InitCast(args.ID); err != nil {
+		return err
+	}
+	*result = SuccessType{true}
+	return nil
+}
+
+func (f *FujisanRpc) CastMedia(r *http.Request, args *CastArgs, result *SuccessType) error {
+	if args == nil {
+		args = new(CastArgs)
+	}
+	if err := FujisanObject.CastMedia(args.Media); err != nil {
+		return err
+	}
+	*result = SuccessType{true}
+	return nil
+}
+
+func (f *FujisanRpc) CastSetVolume(r *http.Request, args *CastArgs, result *SuccessType) error {
+	if args == nil {
+		return errors.New("must pass in volume")
+	}
+	if err := FujisanObject.CastSetVolume(args.Volume); err != nil {
+		return err
+	}
+	*result = SuccessType{true}
+	return nil
+}
+
+func (f *FujisanRpc) StopCast(r *http.Request, args *interface{}, result *SuccessType) error {
+	FujisanObject.StopCast()
+	*result = SuccessType{true}
+	return nil
+}
+
+func (f *FujisanRpc) GetCastStatus(r *http.Request, args *interface{}, result *CastStatus) error {
+	*result = FujisanObject.GetCastStatus()
+	return nil
+}
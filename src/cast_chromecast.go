@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// Cast V2 namespaces
+const (
+	castNamespaceConnection = "urn:x-cast:com.google.cast.tp.connection"
+	castNamespaceHeartbeat  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	castNamespaceReceiver   = "urn:x-cast:com.google.cast.receiver"
+	castNamespaceMedia      = "urn:x-cast:com.google.cast.media"
+)
+
+const (
+	castSender   = "sender-0"
+	castReceiver = "receiver-0"
+	// castMediaReceiver is the app id of the default media receiver
+	castMediaReceiver = "CC1AD845"
+	castTimeout       = 10 * time.Second
+	castMaxMessage    = 64 * 1024
+)
+
+// The heartbeat of new sessions, variables so tests don't wait on a silent device for long
+var (
+	castHeartbeat = 5 * time.Second
+	// castHeartbeatLoss is how long the device may stay silent before the session is considered lost
+	castHeartbeatLoss = 3 * castHeartbeat
+)
+
+// discoverChromecasts browses mDNS for `_googlecast._tcp` devices
+func discoverChromecasts(timeout time.Duration) ([]CastDevice, error) {
+	entries := make(chan *mdns.ServiceEntry, 16)
+	var devices []CastDevice
+	seen := make(map[string]bool)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for entry := range entries {
+			if entry.AddrV4 == nil || !strings.Contains(entry.Name, "_googlecast._tcp") {
+				continue
+			}
+			device := CastDevice{
+				Kind:    "chromecast",
+				Name:    entry.Host,
+				Address: net.JoinHostPort(entry.AddrV4.String(), strconv.Itoa(entry.Port)),
+			}
+			id := entry.Name
+			for _, field := range entry.InfoFields {
+				key, value, _ := strings.Cut(field, "=")
+				switch key {
+				case "id":
+					id = value
+				case "fn":
+					device.Name = value
+				case "md":
+					device.Model = value
+				}
+			}
+			device.ID = "chromecast:" + id
+			if !seen[device.ID] {
+				seen[device.ID] = true
+				devices = append(devices, device)
+			}
+		}
+	}()
+
+	params := mdns.DefaultParams("_googlecast._tcp")
+	params.Entries = entries
+	params.Timeout = timeout
+	params.DisableIPv6 = true
+	err := mdns.Query(params)
+	close(entries)
+	<-collected
+	return devices, err
+}
+
+// castMessage is the CastMessage protobuf exchanged with Cast devices, payloads are always JSON strings
+type castMessage struct {
+	Source      string
+	Destination string
+	Namespace   string
+	Payload     string
+}
+
+// marshal encodes the protobuf, the protocol version and payload type are both 0 for CASTV2_1_0 and STRING
+func (m castMessage) marshal() []byte {
+	appendString := func(b []byte, field uint64, value string) []byte {
+		b = binary.AppendUvarint(b, field<<3|2)
+		b = binary.AppendUvarint(b, uint64(len(value)))
+		return append(b, value...)
+	}
+	b := binary.AppendUvarint(nil, 1<<3)
+	b = binary.AppendUvarint(b, 0)
+	b = appendString(b, 2, m.Source)
+	b = appendString(b, 3, m.Destination)
+	b = appendString(b, 4, m.Namespace)
+	b = binary.AppendUvarint(b, 5<<3)
+	b = binary.AppendUvarint(b, 0)
+	return appendString(b, 6, m.Payload)
+}
+
+// unmarshalCastMessage decodes the protobuf fields Cider uses and skips the rest
+func unmarshalCastMessage(b []byte) (castMessage, error) {
+	var message castMessage
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return message, errors.New("invalid cast message tag")
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return message, errors.New("invalid cast message varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return message, io.ErrUnexpectedEOF
+			}
+			b = b[8:]
+		case 5:
+			if len(b) < 4 {
+				return message, io.ErrUnexpectedEOF
+			}
+			b = b[4:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return message, io.ErrUnexpectedEOF
+			}
+			value := string(b[n : n+int(length)])
+			b = b[n+int(length):]
+			switch tag >> 3 {
+			case 2:
+				message.Source = value
+			case 3:
+				message.Destination = value
+			case 4:
+				message.Namespace = value
+			case 6:
+				message.Payload = value
+			}
+		default:
+			return message, fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+	}
+	return message, nil
+}
+
+// castReply is the part of a Cast JSON payload Cider reads, Status is an object for the receiver and an array for media
+type castReply struct {
+	Type      string          `json:"type"`
+	RequestId int             `json:"requestId"`
+	Reason    string          `json:"reason"`
+	Status    json.RawMessage `json:"status"`
+}
+
+type castVolume struct {
+	Level float64 `json:"level"`
+	Muted bool    `json:"muted"`
+}
+
+type castReceiverStatus struct {
+	Applications []struct {
+		AppId       string `json:"appId"`
+		SessionId   string `json:"sessionId"`
+		TransportId string `json:"transportId"`
+	} `json:"applications"`
+	Volume castVolume `json:"volume"`
+}
+
+type castMediaStatus struct {
+	MediaSessionId int        `json:"mediaSessionId"`
+	PlayerState    string     `json:"playerState"`
+	CurrentTime    float64    `json:"currentTime"`
+	Volume         castVolume `json:"volume"`
+}
+
+// chromecast is a session with the default media receiver of a Cast device
+type chromecast struct {
+	conn           net.Conn
+	requestId      atomic.Int64
+	lastSeen       atomic.Int64
+	transportId    string
+	sessionId      string
+	mediaSessionId int
+	heartbeatEvery time.Duration
+	heartbeatLoss  time.Duration
+	pending        map[int]chan castReply
+	update         func(func(*CastStatus))
+	closed         func(error)
+	done           chan struct{}
+	closing        sync.Once
+	writeMutex     sync.Mutex
+	mutex          sync.Mutex
+}
+
+// connectChromecast connects to the device, launches the default media receiver and joins its session
+func connectChromecast(device CastDevice, update func(func(*CastStatus)), closed func(error)) (castRenderer, error) {
+	dialer := &net.Dialer{Timeout: castTimeout}
+	// Cast devices present certificates signed by Google's device CA, which isn't in the system roots
+	conn, err := tls.DialWithDialer(dialer, "tcp", device.Address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+
+	cast := &chromecast{
+		conn:           conn,
+		heartbeatEvery: castHeartbeat,
+		heartbeatLoss:  castHeartbeatLoss,
+		pending:        make(map[int]chan castReply),
+		update:         update,
+		closed:         closed,
+		done:           make(chan struct{}),
+	}
+	cast.lastSeen.Store(time.Now().UnixNano())
+	go cast.readLoop()
+	go cast.heartbeat()
+
+	if err := cast.send(castReceiver, castNamespaceConnection, map[string]interface{}{"type": "CONNECT"}); err != nil {
+		cast.shutdown(err, false)
+		return nil, err
+	}
+	reply, err := cast.request(castReceiver, castNamespaceReceiver, map[string]interface{}{"type": "LAUNCH", "appId": castMediaReceiver})
+	if err != nil {
+		cast.shutdown(err, false)
+		return nil, err
+	}
+	var status castReceiverStatus
+	if err := json.Unmarshal(reply.Status, &status); err != nil {
+		cast.shutdown(err, false)
+		return nil, err
+	}
+	for _, application := range status.Applications {
+		if application.AppId == castMediaReceiver {
+			cast.mutex.Lock()
+			cast.transportId, cast.sessionId = application.TransportId, application.SessionId
+			cast.mutex.Unlock()
+		}
+	}
+	if len(cast.transportId) == 0 {
+		err := errors.New("the device did not start the media receiver")
+		cast.shutdown(err, false)
+		return nil, err
+	}
+	if err := cast.send(cast.transportId, castNamespaceConnection, map[string]interface{}{"type": "CONNECT"}); err != nil {
+		cast.shutdown(err, false)
+		return nil, err
+	}
+	update(func(s *CastStatus) { s.Volume = status.Volume.Level })
+	return cast, nil
+}
+
+// send writes a message with a length prefix
+func (c *chromecast) send(destination string, namespace string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	message := castMessage{Source: castSender, Destination: destination, Namespace: namespace, Payload: string(b)}.marshal()
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(message)))
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(castTimeout))
+	_, err = c.conn.Write(append(frame, message...))
+	return err
+}
+
+// request sends a payload with a request id and waits for the reply with the same id
+func (c *chromecast) request(destination string, namespace string, payload map[string]interface{}) (castReply, error) {
+	id := int(c.requestId.Add(1))
+	payload["requestId"] = id
+	replies := make(chan castReply, 1)
+	c.mutex.Lock()
+	c.pending[id] = replies
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.send(destination, namespace, payload); err != nil {
+		return castReply{}, err
+	}
+	select {
+	case reply := <-replies:
+		switch reply.Type {
+		case "LOAD_FAILED", "LOAD_CANCELLED", "INVALID_REQUEST", "INVALID_PLAYER_STATE", "LAUNCH_ERROR":
+			return reply, fmt.Errorf("cast device replied %s %s", reply.Type, reply.Reason)
+		}
+		return reply, nil
+	case <-c.done:
+		return castReply{}, errors.New("cast session closed")
+	case <-time.After(castTimeout):
+		return castReply{}, errors.New("cast device did not reply")
+	}
+}
+
+// readLoop reads messages until the connection fails, answering pings and tracking receiver and media status
+func (c *chromecast) readLoop() {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			c.shutdown(err, true)
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > castMaxMessage {
+			c.shutdown(fmt.Errorf("cast message of %d bytes is too large", length), true)
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, body); err != nil {
+			c.shutdown(err, true)
+			return
+		}
+		c.lastSeen.Store(time.Now().UnixNano())
+
+		message, err := unmarshalCastMessage(body)
+		if err != nil {
+			continue
+		}
+		var reply castReply
+		if err := json.Unmarshal([]byte(message.Payload), &reply); err != nil {
+			continue
+		}
+		c.handle(message, reply)
+	}
+}
+
+// handle processes one message from the device
+func (c *chromecast) handle(message castMessage, reply castReply) {
+	switch {
+	case message.Namespace == castNamespaceHeartbeat && reply.Type == "PING":
+		go c.send(message.Source, castNamespaceHeartbeat, map[string]interface{}{"type": "PONG"})
+		return
+	case message.Namespace == castNamespaceConnection && reply.Type == "CLOSE":
+		c.shutdown(errors.New("the device closed the session"), true)
+		return
+	case reply.Type == "RECEIVER_STATUS":
+		var status castReceiverStatus
+		if json.Unmarshal(reply.Status, &status) == nil {
+			c.update(func(s *CastStatus) { s.Volume = status.Volume.Level })
+			c.mutex.Lock()
+			sessionId := c.sessionId
+			c.mutex.Unlock()
+			running := len(sessionId) == 0
+			for _, application := range status.Applications {
+				running = running || application.SessionId == sessionId
+			}
+			if !running {
+				c.shutdown(errors.New("the media receiver was stopped on the device"), true)
+				return
+			}
+		}
+	case reply.Type == "MEDIA_STATUS":
+		var statuses []castMediaStatus
+		if json.Unmarshal(reply.Status, &statuses) == nil && len(statuses) != 0 {
+			status := statuses[0]
+			c.mutex.Lock()
+			c.mediaSessionId = status.MediaSessionId
+			c.mutex.Unlock()
+			c.update(func(s *CastStatus) {
+				s.State = strings.ToLower(status.PlayerState)
+				s.Position = status.CurrentTime
+			})
+		}
+	}
+
+	if reply.RequestId != 0 {
+		c.mutex.Lock()
+		replies, ok := c.pending[reply.RequestId]
+		c.mutex.Unlock()
+		if ok {
+			select {
+			case replies <- reply:
+			default:
+			}
+		}
+	}
+}
+
+// heartbeat pings the device and ends the session when it stops answering
+func (c *chromecast) heartbeat() {
+	ticker := time.NewTicker(c.heartbeatEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, c.lastSeen.Load())) > c.heartbeatLoss {
+				c.shutdown(errors.New("the device stopped responding"), true)
+				return
+			}
+			if err := c.send(castReceiver, castNamespaceHeartbeat, map[string]interface{}{"type": "PING"}); err != nil {
+				c.shutdown(err, true)
+				return
+			}
+		}
+	}
+}
+
+// shutdown closes the connection once, notify reports unexpected disconnects to the cast manager
+func (c *chromecast) shutdown(err error, notify bool) {
+	c.closing.Do(func() {
+		close(c.done)
+		c.conn.Close()
+		if notify {
+			c.closed(err)
+		}
+	})
+}
+
+// media sends a command for the loaded media
+func (c *chromecast) media(payload map[string]interface{}) error {
+	c.mutex.Lock()
+	mediaSessionId, transportId := c.mediaSessionId, c.transportId
+	c.mutex.Unlock()
+	if mediaSessionId == 0 {
+		return errors.New("no media loaded on the cast device")
+	}
+	payload["mediaSessionId"] = mediaSessionId
+	_, err := c.request(transportId, castNamespaceMedia, payload)
+	return err
+}
+
+func (c *chromecast) Load(media CastMediaInfo, position float64) error {
+	metadata := map[string]interface{}{
+		// 3 is MusicTrackMediaMetadata
+		"metadataType": 3,
+		"title":        media.Title,
+		"artist":       media.Artist,
+		"albumName":    media.Album,
+	}
+	if len(media.Artwork) != 0 {
+		metadata["images"] = []map[string]string{{"url": media.Artwork}}
+	}
+	content := map[string]interface{}{
+		"contentId":   media.Url,
+		"contentType": media.ContentType,
+		"streamType":  "BUFFERED",
+		"metadata":    metadata,
+	}
+	if media.Duration > 0 {
+		content["duration"] = media.Duration
+	}
+
+	c.mutex.Lock()
+	transportId := c.transportId
+	c.mutex.Unlock()
+	reply, err := c.request(transportId, castNamespaceMedia, map[string]interface{}{
+		"type":        "LOAD",
+		"media":       content,
+		"autoplay":    true,
+		"currentTime": position,
+	})
+	if err != nil {
+		return err
+	}
+	if reply.Type != "MEDIA_STATUS" {
+		return fmt.Errorf("unexpected reply %s to load", reply.Type)
+	}
+	return nil
+}
+
+func (c *chromecast) Play() error {
+	return c.media(map[string]interface{}{"type": "PLAY"})
+}
+
+func (c *chromecast) Pause() error {
+	return c.media(map[string]interface{}{"type": "PAUSE"})
+}
+
+func (c *chromecast) Seek(seconds float64) error {
+	return c.media(map[string]interface{}{"type": "SEEK", "currentTime": seconds})
+}
+
+func (c *chromecast) SetVolume(volume float64) error {
+	_, err := c.request(castReceiver, castNamespaceReceiver, map[string]interface{}{
+		"type":   "SET_VOLUME",
+		"volume": map[string]interface{}{"level": volume},
+	})
+	return err
+}
+
+// Close stops the media receiver and disconnects
+func (c *chromecast) Close() error {
+	c.mutex.Lock()
+	sessionId, transportId := c.sessionId, c.transportId
+	c.mutex.Unlock()
+	if len(sessionId) != 0 {
+		_, _ = c.request(castReceiver, castNamespaceReceiver, map[string]interface{}{"type": "STOP", "sessionId": sessionId})
+		_ = c.send(transportId, castNamespaceConnection, map[string]interface{}{"type": "CLOSE"})
+	}
+	_ = c.send(castReceiver, castNamespaceConnection, map[string]interface{}{"type": "CLOSE"})
+	c.shutdown(nil, false)
+	return nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	ssdpAddress          = "239.255.255.250:1900"
+	dlnaMediaRenderer    = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	dlnaAVTransport      = "urn:schemas-upnp-org:service:AVTransport:1"
+	dlnaRenderingControl = "urn:schemas-upnp-org:service:RenderingControl:1"
+	// dlnaCallbackPort is the RPC port, event callbacks from renderers are served by its router
+	dlnaCallbackPort = 10782
+	// dlnaSubscription is the event subscription length requested from renderers, it is renewed halfway
+	dlnaSubscription = 300 * time.Second
+	dlnaTimeout      = 10 * time.Second
+)
+
+// dlnaHttp is used for every request to renderers
+var dlnaHttp = &http.Client{Timeout: dlnaTimeout}
+
+// dlnaRenewal is how often new sessions renew their subscriptions, a variable so tests don't wait for half of `dlnaSubscription`
+var dlnaRenewal = dlnaSubscription / 2
+
+// dlnaDescription is the part of a UPnP device description Cider reads
+type dlnaDescription struct {
+	URLBase string `xml:"URLBase"`
+	Device  struct {
+		FriendlyName string `xml:"friendlyName"`
+		ModelName    string `xml:"modelName"`
+		UDN          string `xml:"UDN"`
+		Services     []struct {
+			ServiceType string `xml:"serviceType"`
+			ControlURL  string `xml:"controlURL"`
+			EventSubURL string `xml:"eventSubURL"`
+		} `xml:"serviceList>service"`
+	} `xml:"device"`
+}
+
+// fetchDlnaDescription downloads the description at location
+func fetchDlnaDescription(location string) (*dlnaDescription, error) {
+	response, err := dlnaHttp.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device description returned %s", response.Status)
+	}
+	description := new(dlnaDescription)
+	if err := xml.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(description); err != nil {
+		return nil, err
+	}
+	return description, nil
+}
+
+// service returns the absolute control and event URLs of a service
+func (d *dlnaDescription) service(location string, serviceType string) (string, string, bool) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", false
+	}
+	if len(d.URLBase) != 0 {
+		if parsed, err := url.Parse(d.URLBase); err == nil {
+			base = parsed
+		}
+	}
+	resolve := func(reference string) string {
+		if len(reference) == 0 {
+			return ""
+		}
+		parsed, err := url.Parse(reference)
+		if err != nil {
+			return ""
+		}
+		return base.ResolveReference(parsed).String()
+	}
+	for _, service := range d.Device.Services {
+		if strings.HasPrefix(service.ServiceType, strings.TrimSuffix(serviceType, "1")) {
+			return resolve(service.ControlURL), resolve(service.EventSubURL), true
+		}
+	}
+	return "", "", false
+}
+
+// discoverDlnaRenderers sends an SSDP search for media renderers and reads their descriptions
+func discoverDlnaRenderers(timeout time.Duration) ([]CastDevice, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	address, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + dlnaMediaRenderer + "\r\n\r\n"
+	// SSDP runs over UDP, so the search is repeated in case a packet is lost
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteTo([]byte(search), address); err != nil {
+			return nil, err
+		}
+	}
+
+	locations := make(map[string]bool)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		for _, line := range strings.Split(string(buffer[:n]), "\r\n") {
+			key, value, ok := strings.Cut(line, ":")
+			if ok && strings.EqualFold(strings.TrimSpace(key), "location") {
+				locations[strings.TrimSpace(value)] = true
+			}
+		}
+	}
+
+	var devices []CastDevice
+	seen := make(map[string]bool)
+	for location := range locations {
+		description, err := fetchDlnaDescription(location)
+		if err != nil {
+			continue
+		}
+		if _, _, ok := description.service(location, dlnaAVTransport); !ok || seen[description.Device.UDN] {
+			continue
+		}
+		seen[description.Device.UDN] = true
+		devices = append(devices, CastDevice{
+			ID:      "dlna:" + description.Device.UDN,
+			Name:    description.Device.FriendlyName,
+			Model:   description.Device.ModelName,
+			Kind:    "dlna",
+			Address: location,
+		})
+	}
+	return devices, nil
+}
+
+// dlnaEvents routes event notifications to renderers by the token in their callback URL
+var dlnaEvents = struct {
+	renderers map[string]*dlnaRenderer
+	mutex     sync.Mutex
+}{renderers: make(map[string]*dlnaRenderer)}
+
+// dlnaSubscriptionState is an event subscription with a renderer service, sid is guarded by the mutex of the renderer
+type dlnaSubscriptionState struct {
+	eventUrl string
+	sid      string
+}
+
+// dlnaRenderer controls a UPnP media renderer over AVTransport and RenderingControl
+type dlnaRenderer struct {
+	transportUrl  string
+	renderingUrl  string
+	token         string
+	callback      string
+	subscriptions []*dlnaSubscriptionState
+	renewEvery    time.Duration
+	// media is the loaded media, seeks are limited to it
+	media   CastMediaInfo
+	update  func(func(*CastStatus))
+	closed  func(error)
+	done    chan struct{}
+	closing sync.Once
+	mutex   sync.Mutex
+}
+
+// connectDlnaRenderer reads the renderer description and subscribes to its events
+func connectDlnaRenderer(device CastDevice, update func(func(*CastStatus)), closed func(error)) (castRenderer, error) {
+	description, err := fetchDlnaDescription(device.Address)
+	if err != nil {
+		return nil, err
+	}
+	transportUrl, transportEvents, ok := description.service(device.Address, dlnaAVTransport)
+	if !ok {
+		return nil, errors.New("the renderer has no AVTransport service")
+	}
+	renderingUrl, renderingEvents, _ := description.service(device.Address, dlnaRenderingControl)
+
+	location, err := url.Parse(device.Address)
+	if err != nil {
+		return nil, err
+	}
+	// The address the renderer reaches Cider on is the local end of a route to it
+	probe, err := net.DialTimeout("udp", location.Host, dlnaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	localIp := probe.LocalAddr().(*net.UDPAddr).IP
+	probe.Close()
+
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	renderer := &dlnaRenderer{
+		transportUrl: transportUrl,
+		renderingUrl: renderingUrl,
+		token:        hex.EncodeToString(token),
+		renewEvery:   dlnaRenewal,
+		update:       update,
+		closed:       closed,
+		done:         make(chan struct{}),
+	}
+	renderer.callback = fmt.Sprintf("http://%s/cast/dlna/events/%s",
+		net.JoinHostPort(localIp.String(), strconv.Itoa(dlnaCallbackPort)), renderer.token)
+
+	dlnaEvents.mutex.Lock()
+	dlnaEvents.renderers[renderer.token] = renderer
+	dlnaEvents.mutex.Unlock()
+
+	for _, eventUrl := range []string{transportEvents, renderingEvents} {
+		if len(eventUrl) == 0 {
+			continue
+		}
+		subscription := &dlnaSubscriptionState{eventUrl: eventUrl}
+		if err := renderer.subscribe(subscription); err != nil {
+			// Renderers without working events can still be controlled, the UI just isn't told about changes
+			continue
+		}
+		renderer.subscriptions = append(renderer.subscriptions, subscription)
+	}
+	go renderer.renew()
+	return renderer, nil
+}
+
+// subscribe starts or renews an event subscription
+func (d *dlnaRenderer) subscribe(subscription *dlnaSubscriptionState) error {
+	request, err := http.NewRequest("SUBSCRIBE", subscription.eventUrl, nil)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	sid := subscription.sid
+	d.mutex.Unlock()
+	if len(sid) == 0 {
+		request.Header.Set("CALLBACK", "<"+d.callback+">")
+		request.Header.Set("NT", "upnp:event")
+	} else {
+		request.Header.Set("SID", sid)
+	}
+	request.Header.Set("TIMEOUT", fmt.Sprintf("Second-%d", int(dlnaSubscription.Seconds())))
+
+	response, err := dlnaHttp.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscription returned %s", response.Status)
+	}
+	d.mutex.Lock()
+	subscription.sid = response.Header.Get("SID")
+	d.mutex.Unlock()
+	return nil
+}
+
+// renew keeps the subscriptions alive, a renderer that refuses renewal is considered gone
+func (d *dlnaRenderer) renew() {
+	ticker := time.NewTicker(d.renewEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			for _, subscription := range d.subscriptions {
+				if err := d.subscribe(subscription); err != nil {
+					d.shutdown(fmt.Errorf("renderer stopped responding: %w", err), true)
+					return
+				}
+			}
+		}
+	}
+}
+
+// shutdown stops receiving events once, notify reports unexpected disconnects to the cast manager
+func (d *dlnaRenderer) shutdown(err error, notify bool) {
+	d.closing.Do(func() {
+		close(d.done)
+		dlnaEvents.mutex.Lock()
+		delete(dlnaEvents.renderers, d.token)
+		dlnaEvents.mutex.Unlock()
+		if notify {
+			d.closed(err)
+		}
+	})
+}
+
+// dlnaLastChange is the `LastChange` event of AVTransport and RenderingControl
+type dlnaLastChange struct {
+	InstanceID struct {
+		TransportState struct {
+			Val string `xml:"val,attr"`
+		} `xml:"TransportState"`
+		Volume []struct {
+			Channel string `xml:"channel,attr"`
+			Val     string `xml:"val,attr"`
+		} `xml:"Volume"`
+	} `xml:"InstanceID"`
+}
+
+// dlnaTransportStates maps UPnP transport states to `CastStatus.State`
+var dlnaTransportStates = map[string]string{
+	"PLAYING":          "playing",
+	"PAUSED_PLAYBACK":  "paused",
+	"STOPPED":          "idle",
+	"NO_MEDIA_PRESENT": "idle",
+	"TRANSITIONING":    "buffering",
+}
+
+// handleEvent applies a GENA notification to the cast status
+func (d *dlnaRenderer) handleEvent(body []byte) {
+	var propertySet struct {
+		Properties []struct {
+			LastChange string `xml:"LastChange"`
+		} `xml:"property"`
+	}
+	if err := xml.Unmarshal(body, &propertySet); err != nil {
+		return
+	}
+	for _, property := range propertySet.Properties {
+		if len(property.LastChange) == 0 {
+			continue
+		}
+		var change dlnaLastChange
+		if err := xml.Unmarshal([]byte(property.LastChange), &change); err != nil {
+			continue
+		}
+		if state, ok := dlnaTransportStates[change.InstanceID.TransportState.Val]; ok {
+			d.update(func(s *CastStatus) { s.State = state })
+		}
+		for _, volume := range change.InstanceID.Volume {
+			if level, err := strconv.Atoi(volume.Val); err == nil && (volume.Channel == "" || volume.Channel == "Master") {
+				d.update(func(s *CastStatus) { s.Volume = float64(level) / 100 })
+			}
+		}
+	}
+}
+
+// dlnaEventHandler receives GENA notifications from renderers on the RPC router
+func dlnaEventHandler(writer http.ResponseWriter, request *http.Request) {
+	dlnaEvents.mutex.Lock()
+	renderer, ok := dlnaEvents.renderers[mux.Vars(request)["token"]]
+	dlnaEvents.mutex.Unlock()
+	if !ok {
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(request.Body, 1<<20))
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	renderer.handleEvent(body)
+	writer.WriteHeader(http.StatusOK)
+}
+
+// xmlEscape escapes text for an XML document
+func xmlEscape(value string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+// soap calls an action, arguments are name and value pairs in the order the action defines them
+func (d *dlnaRenderer) soap(controlUrl string, service string, action string, arguments ...string) error {
+	if len(controlUrl) == 0 {
+		return fmt.Errorf("the renderer does not support %s", action)
+	}
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	body.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, service)
+	for i := 0; i+1 < len(arguments); i += 2 {
+		fmt.Fprintf(&body, "<%s>%s</%s>", arguments[i], xmlEscape(arguments[i+1]), arguments[i])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	request, err := http.NewRequest(http.MethodPost, controlUrl, strings.NewReader(body.String()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, service, action))
+	response, err := dlnaHttp.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var fault struct {
+			Code        string `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		_ = xml.NewDecoder(io.LimitReader(response.Body, 1<<16)).Decode(&fault)
+		return fmt.Errorf("%s failed with %s: UPnP error %s %s", action, response.Status, fault.Code, fault.Description)
+	}
+	return nil
+}
+
+// dlnaDuration formats seconds as the H:MM:SS UPnP expects
+func dlnaDuration(seconds float64) string {
+	total := int(seconds)
+	return fmt.Sprintf("%d:%02d:%02d", total/3600, total/60%60, total%60)
+}
+
+// didlLite describes the media for `SetAVTransportURI`
+func didlLite(media CastMediaInfo) string {
+	var item strings.Builder
+	item.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`)
+	item.WriteString(`<item id="0" parentID="-1" restricted="1">`)
+	fmt.Fprintf(&item, "<dc:title>%s</dc:title>", xmlEscape(media.Title))
+	if len(media.Artist) != 0 {
+		fmt.Fprintf(&item, "<dc:creator>%s</dc:creator><upnp:artist>%s</upnp:artist>", xmlEscape(media.Artist), xmlEscape(media.Artist))
+	}
+	if len(media.Album) != 0 {
+		fmt.Fprintf(&item, "<upnp:album>%s</upnp:album>", xmlEscape(media.Album))
+	}
+	if len(media.Artwork) != 0 {
+		fmt.Fprintf(&item, "<upnp:albumArtURI>%s</upnp:albumArtURI>", xmlEscape(media.Artwork))
+	}
+	item.WriteString("<upnp:class>object.item.audioItem.musicTrack</upnp:class>")
+	duration := ""
+	if media.Duration > 0 {
+		duration = fmt.Sprintf(` duration="%s.000"`, dlnaDuration(media.Duration))
+	}
+	fmt.Fprintf(&item, `<res protocolInfo="http-get:*:%s:*"%s>%s</res>`, xmlEscape(media.ContentType), duration, xmlEscape(media.Url))
+	item.WriteString("</item></DIDL-Lite>")
+	return item.String()
+}
+
+func (d *dlnaRenderer) Load(media CastMediaInfo, position float64) error {
+	if err := d.soap(d.transportUrl, dlnaAVTransport, "SetAVTransportURI",
+		"InstanceID", "0", "CurrentURI", media.Url, "CurrentURIMetaData", didlLite(media)); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.media = media
+	d.mutex.Unlock()
+	if err := d.Play(); err != nil {
+		return err
+	}
+	if position = media.clamp(position); position >= 1 {
+		// Not every renderer can seek before it starts playing, so the position is best effort
+		_ = d.Seek(position)
+	}
+	return nil
+}
+
+func (d *dlnaRenderer) Play() error {
+	return d.soap(d.transportUrl, dlnaAVTransport, "Play", "InstanceID", "0", "Speed", "1")
+}
+
+func (d *dlnaRenderer) Pause() error {
+	return d.soap(d.transportUrl, dlnaAVTransport, "Pause", "InstanceID", "0")
+}
+
+// Seek moves within the loaded media, previews don't follow the position of the full song and ignore seeks
+func (d *dlnaRenderer) Seek(seconds float64) error {
+	d.mutex.Lock()
+	media := d.media
+	d.mutex.Unlock()
+	if media.Preview {
+		return nil
+	}
+	seconds = media.clamp(seconds)
+	return d.soap(d.transportUrl, dlnaAVTransport, "Seek", "InstanceID", "0", "Unit", "REL_TIME", "Target", dlnaDuration(seconds))
+}
+
+func (d *dlnaRenderer) SetVolume(volume float64) error {
+	return d.soap(d.renderingUrl, dlnaRenderingControl, "SetVolume",
+		"InstanceID", "0", "Channel", "Master", "DesiredVolume", strconv.Itoa(int(volume*100+0.5)))
+}
+
+// Close stops playback and cancels the event subscriptions
+func (d *dlnaRenderer) Close() error {
+	err := d.soap(d.transportUrl, dlnaAVTransport, "Stop", "InstanceID", "0")
+	for _, subscription := range d.subscriptions {
+		d.mutex.Lock()
+		sid := subscription.sid
+		d.mutex.Unlock()
+		if request, requestErr := http.NewRequest("UNSUBSCRIBE", subscription.eventUrl, nil); requestErr == nil {
+			request.Header.Set("SID", sid)
+			if response, requestErr := dlnaHttp.Do(request); requestErr == nil {
+				response.Body.Close()
+			}
+		}
+	}
+	d.shutdown(nil, false)
+	return err
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// dlnaAction is a SOAP action received by the renderer stand-in with its arguments
+type dlnaAction struct {
+	Path      string
+	Name      string
+	Arguments map[string]string
+}
+
+// dlnaSubscribeRequest is a SUBSCRIBE or UNSUBSCRIBE received by the renderer stand-in
+type dlnaSubscribeRequest struct {
+	Method   string
+	Path     string
+	SID      string
+	Callback string
+}
+
+// dlnaRendererStandIn is a UPnP media renderer with AVTransport and RenderingControl services, it records the actions
+// and subscriptions it receives
+type dlnaRendererStandIn struct {
+	server        *httptest.Server
+	actions       []dlnaAction
+	subscriptions []dlnaSubscribeRequest
+	// refuseRenewal answers renewals like a renderer which forgot the subscription
+	refuseRenewal bool
+	mutex         sync.Mutex
+}
+
+const dlnaStandInDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+		<friendlyName>Kitchen</friendlyName>
+		<UDN>uuid:kitchen</UDN>
+		<serviceList>
+			<service>
+				<serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+				<controlURL>/control/transport</controlURL>
+				<eventSubURL>/events/transport</eventSubURL>
+			</service>
+			<service>
+				<serviceType>urn:schemas-upnp-org:service:RenderingControl:1</serviceType>
+				<controlURL>/control/rendering</controlURL>
+				<eventSubURL>/events/rendering</eventSubURL>
+			</service>
+		</serviceList>
+	</device>
+</root>`
+
+func newDlnaRendererStandIn(t *testing.T) *dlnaRendererStandIn {
+	renderer := new(dlnaRendererStandIn)
+	routes := http.NewServeMux()
+	routes.HandleFunc("/description.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(dlnaStandInDescription))
+	})
+	routes.HandleFunc("/events/", func(w http.ResponseWriter, r *http.Request) {
+		renderer.mutex.Lock()
+		defer renderer.mutex.Unlock()
+		renderer.subscriptions = append(renderer.subscriptions, dlnaSubscribeRequest{r.Method, r.URL.Path, r.Header.Get("SID"), r.Header.Get("CALLBACK")})
+		if r.Method == "SUBSCRIBE" && len(r.Header.Get("SID")) != 0 && renderer.refuseRenewal {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("SID", "uuid:subscription"+r.URL.Path)
+	})
+	routes.HandleFunc("/control/", func(w http.ResponseWriter, r *http.Request) {
+		var envelope struct {
+			Body struct {
+				Action struct {
+					XMLName   xml.Name
+					Arguments []struct {
+						XMLName xml.Name
+						Value   string `xml:",chardata"`
+					} `xml:",any"`
+				} `xml:",any"`
+			} `xml:"Body"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &envelope); err != nil {
+			t.Error(err)
+		}
+		action := dlnaAction{Path: r.URL.Path, Name: envelope.Body.Action.XMLName.Local, Arguments: make(map[string]string)}
+		for _, argument := range envelope.Body.Action.Arguments {
+			action.Arguments[argument.XMLName.Local] = argument.Value
+		}
+		if !strings.HasSuffix(r.Header.Get("SOAPAction"), "#"+action.Name+`"`) {
+			t.Errorf("SOAPAction %q doesn't match %s", r.Header.Get("SOAPAction"), action.Name)
+		}
+		renderer.mutex.Lock()
+		renderer.actions = append(renderer.actions, action)
+		renderer.mutex.Unlock()
+	})
+	renderer.server = httptest.NewServer(routes)
+	t.Cleanup(renderer.server.Close)
+	return renderer
+}
+
+func (r *dlnaRendererStandIn) device() CastDevice {
+	return CastDevice{ID: "dlna:kitchen", Name: "Kitchen", Kind: "dlna", Address: r.server.URL + "/description.xml"}
+}
+
+// received returns the actions received so far
+func (r *dlnaRendererStandIn) received() []dlnaAction {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]dlnaAction(nil), r.actions...)
+}
+
+// subscribed returns the subscription requests received so far
+func (r *dlnaRendererStandIn) subscribed() []dlnaSubscribeRequest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]dlnaSubscribeRequest(nil), r.subscriptions...)
+}
+
+// playback describes the transport actions as "load <url> <duration>", "play", "pause" and "seek <seconds>"
+func (r *dlnaRendererStandIn) playback() []string {
+	seconds := func(duration string) string {
+		var hours, minutes, seconds int
+		fmt.Sscanf(duration, "%d:%d:%d", &hours, &minutes, &seconds)
+		return fmt.Sprint(hours*3600 + minutes*60 + seconds)
+	}
+	var calls []string
+	for _, action := range r.received() {
+		switch action.Name {
+		case "SetAVTransportURI":
+			var metadata struct {
+				Resource struct {
+					Duration string `xml:"duration,attr"`
+				} `xml:"item>res"`
+			}
+			xml.Unmarshal([]byte(action.Arguments["CurrentURIMetaData"]), &metadata)
+			calls = append(calls, "load "+action.Arguments["CurrentURI"]+" "+seconds(metadata.Resource.Duration))
+		case "Seek":
+			calls = append(calls, "seek "+seconds(action.Arguments["Target"]))
+		case "Play", "Pause":
+			calls = append(calls, strings.ToLower(action.Name))
+		}
+	}
+	return calls
+}
+
+// notify sends a GENA notification with a `LastChange` event through the RPC router to the callback Cider subscribed with
+func notify(t *testing.T, callback string, lastChange string) int {
+	router := mux.NewRouter()
+	router.HandleFunc("/cast/dlna/events/{token}", dlnaEventHandler).Methods("NOTIFY")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	target, err := url.Parse(strings.Trim(callback, "<>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `<?xml version="1.0"?><e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property><LastChange>` +
+		xmlEscape(`<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/"><InstanceID val="0">`+lastChange+`</InstanceID></Event>`) +
+		`</LastChange></e:property></e:propertyset>`
+	request, _ := http.NewRequest("NOTIFY", server.URL+target.Path, strings.NewReader(body))
+	request.Header.Set("NT", "upnp:event")
+	request.Header.Set("NTS", "upnp:propchange")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestDlnaEvents(t *testing.T) {
+	renderer := newDlnaRendererStandIn(t)
+	manager := connectCastStandIn(t, renderer.device())
+
+	subscriptions := renderer.subscribed()
+	if len(subscriptions) != 2 || subscriptions[0].Path != "/events/transport" || subscriptions[1].Path != "/events/rendering" {
+		t.Fatalf("expected both services to be subscribed to, got %+v", subscriptions)
+	}
+	callback := subscriptions[0].Callback
+	if !strings.Contains(callback, "/cast/dlna/events/") || subscriptions[1].Callback != callback {
+		t.Fatalf("unexpected callback %q", callback)
+	}
+
+	if status := notify(t, callback, `<TransportState val="PAUSED_PLAYBACK"/>`); status != http.StatusOK {
+		t.Fatalf("the notification was answered with %d", status)
+	}
+	if status := manager.Status(); status.State != "paused" {
+		t.Errorf("expected the renderer state, got %+v", status)
+	}
+	notify(t, callback, `<Volume channel="LF" val="90"/><Volume channel="Master" val="35"/>`)
+	if status := manager.Status(); status.Volume != 0.35 {
+		t.Errorf("expected the master volume, got %+v", status)
+	}
+
+	manager.Disconnect()
+	if status := notify(t, callback, `<TransportState val="PLAYING"/>`); status != http.StatusPreconditionFailed {
+		t.Errorf("a notification for a closed session was answered with %d", status)
+	}
+	var unsubscribed []string
+	for _, request := range renderer.subscribed() {
+		if request.Method == "UNSUBSCRIBE" {
+			unsubscribed = append(unsubscribed, request.SID)
+		}
+	}
+	if strings.Join(unsubscribed, ",") != "uuid:subscription/events/transport,uuid:subscription/events/rendering" {
+		t.Errorf("unexpected unsubscriptions %v", unsubscribed)
+	}
+}
+
+func TestDlnaSetVolume(t *testing.T) {
+	renderer := newDlnaRendererStandIn(t)
+	manager := connectCastStandIn(t, renderer.device())
+
+	if err := manager.SetVolume(0.42); err != nil {
+		t.Fatal(err)
+	}
+	actions := renderer.received()
+	if len(actions) != 1 || actions[0].Path != "/control/rendering" || actions[0].Name != "SetVolume" {
+		t.Fatalf("unexpected actions %+v", actions)
+	}
+	if arguments := actions[0].Arguments; arguments["Channel"] != "Master" || arguments["DesiredVolume"] != "42" {
+		t.Errorf("unexpected arguments %v", arguments)
+	}
+}
+
+func TestDlnaRenewalFailureEndsSession(t *testing.T) {
+	renewal := dlnaRenewal
+	dlnaRenewal = 20 * time.Millisecond
+	t.Cleanup(func() { dlnaRenewal = renewal })
+	renderer := newDlnaRendererStandIn(t)
+	manager := connectCastStandIn(t, renderer.device())
+
+	renewed := func() bool {
+		for _, request := range renderer.subscribed() {
+			if request.Method == "SUBSCRIBE" && request.SID == "uuid:subscription/events/transport" && len(request.Callback) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !renewed() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the subscription to be renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !manager.Status().Connected {
+		t.Fatal("a renewed subscription ended the session")
+	}
+
+	renderer.mutex.Lock()
+	renderer.refuseRenewal = true
+	renderer.mutex.Unlock()
+	status := waitForCastStatus(t, manager, "the session to end", func(status CastStatus) bool { return !status.Connected })
+	if !strings.HasPrefix(status.LastError, "renderer stopped responding") {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// castReceiverStandIn is a Cast device running the default media receiver, it records the media commands it receives
+type castReceiverStandIn struct {
+	listener net.Listener
+	commands []map[string]interface{}
+	volume   float64
+	stopped  bool
+	// silent stops every reply, heartbeats included
+	silent bool
+	conn   net.Conn
+	t      *testing.T
+	mutex  sync.Mutex
+}
+
+// selfSignedCertificate returns a certificate for the stand-in, Cider doesn't verify Cast devices
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newCastReceiverStandIn(t *testing.T) *castReceiverStandIn {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &castReceiverStandIn{listener: listener, volume: 0.5, t: t}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go receiver.serve(conn)
+		}
+	}()
+	return receiver
+}
+
+func (r *castReceiverStandIn) device() CastDevice {
+	return CastDevice{ID: "chromecast:test", Name: "Living Room", Kind: "chromecast", Address: r.listener.Addr().String()}
+}
+
+// write sends a message to the sender, the lock must be held
+func (r *castReceiverStandIn) write(conn net.Conn, source string, destination string, namespace string, payload map[string]interface{}) {
+	b, _ := json.Marshal(payload)
+	message := castMessage{Source: source, Destination: destination, Namespace: namespace, Payload: string(b)}.marshal()
+	conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(message))), message...))
+}
+
+// receiverStatus is the RECEIVER_STATUS of the device, the lock must be held
+func (r *castReceiverStandIn) receiverStatus(requestId interface{}) map[string]interface{} {
+	applications := []interface{}{}
+	if !r.stopped {
+		applications = append(applications, map[string]interface{}{"appId": castMediaReceiver, "sessionId": "session-1", "transportId": "web-1"})
+	}
+	return map[string]interface{}{
+		"type":      "RECEIVER_STATUS",
+		"requestId": requestId,
+		"status":    map[string]interface{}{"applications": applications, "volume": map[string]interface{}{"level": r.volume}},
+	}
+}
+
+func (r *castReceiverStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r.mutex.Lock()
+	r.conn = conn
+	r.mutex.Unlock()
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		message, err := unmarshalCastMessage(body)
+		if err != nil {
+			r.t.Error(err)
+			return
+		}
+		payload := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(message.Payload), &payload); err != nil {
+			r.t.Error(err)
+			return
+		}
+
+		r.mutex.Lock()
+		if r.silent {
+			r.mutex.Unlock()
+			continue
+		}
+		switch message.Namespace {
+		case castNamespaceHeartbeat:
+			r.write(conn, message.Destination, message.Source, castNamespaceHeartbeat, map[string]interface{}{"type": "PONG"})
+		case castNamespaceReceiver:
+			if volume, ok := payload["volume"].(map[string]interface{}); ok && payload["type"] == "SET_VOLUME" {
+				r.volume, _ = volume["level"].(float64)
+			}
+			r.write(conn, message.Destination, message.Source, castNamespaceReceiver, r.receiverStatus(payload["requestId"]))
+		case castNamespaceMedia:
+			r.commands = append(r.commands, payload)
+			r.write(conn, message.Destination, message.Source, castNamespaceMedia, map[string]interface{}{
+				"type":      "MEDIA_STATUS",
+				"requestId": payload["requestId"],
+				"status":    []interface{}{map[string]interface{}{"mediaSessionId": 1, "playerState": "PLAYING", "currentTime": payload["currentTime"]}},
+			})
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// change changes the state of the device, and broadcasts the receiver status unless the device is silent
+func (r *castReceiverStandIn) change(change func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	change()
+	if !r.silent {
+		r.write(r.conn, castReceiver, "*", castNamespaceReceiver, r.receiverStatus(0))
+	}
+}
+
+// close closes the virtual connection like a device that is shutting down
+func (r *castReceiverStandIn) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.write(r.conn, castReceiver, castSender, castNamespaceConnection, map[string]interface{}{"type": "CLOSE"})
+}
+
+// received returns the media commands received so far
+func (r *castReceiverStandIn) received() []map[string]interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]map[string]interface{}(nil), r.commands...)
+}
+
+// playback describes the media commands as "load <url> <duration> at <seconds>", "play", "pause" and "seek <seconds>"
+func (r *castReceiverStandIn) playback() []string {
+	var calls []string
+	for _, command := range r.received() {
+		switch command["type"] {
+		case "LOAD":
+			media, _ := command["media"].(map[string]interface{})
+			calls = append(calls, fmt.Sprintf("load %v %v at %v", media["contentId"], media["duration"], command["currentTime"]))
+		case "SEEK":
+			calls = append(calls, fmt.Sprintf("seek %v", command["currentTime"]))
+		default:
+			calls = append(calls, strings.ToLower(fmt.Sprint(command["type"])))
+		}
+	}
+	return calls
+}
+
+// connectCastStandIn starts a cast session with a stand-in device
+func connectCastStandIn(t *testing.T, device CastDevice) *CastManager {
+	manager := NewCastManager()
+	manager.devices[device.ID] = device
+	if err := manager.Connect(device.ID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(manager.Disconnect)
+	return manager
+}
+
+// waitForCastStatus polls the status of the manager until condition holds
+func waitForCastStatus(t *testing.T, manager *CastManager, what string, condition func(CastStatus) bool) CastStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := manager.Status()
+		if condition(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s, status %+v", what, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var testCastSong = func() Attributes {
+	song := testSong
+	song.Previews = append(song.Previews, struct {
+		URL string `json:"url"`
+	}{"https://audio-ssl.itunes.apple.com/preview.m4a"})
+	return song
+}()
+
+func TestCastMediaIsPreview(t *testing.T) {
+	media, ok := castMediaFromAttributes(testCastSong)
+	if !ok || !media.Preview || media.Duration != castPreviewLength || media.Url != "https://audio-ssl.itunes.apple.com/preview.m4a" {
+		t.Fatalf("unexpected media %+v", media)
+	}
+
+	short := testCastSong
+	short.DurationInMillis = 12000
+	if media, _ := castMediaFromAttributes(short); media.Duration != 12 {
+		t.Errorf("a song shorter than a preview lasted %v seconds", media.Duration)
+	}
+	if _, ok := castMediaFromAttributes(testSong); ok {
+		t.Error("a song without a preview can't be cast")
+	}
+}
+
+// castStandIn is a stand-in device of any kind
+type castStandIn interface {
+	device() CastDevice
+	// playback describes the playback commands received so far, in the terms of the kind of device
+	playback() []string
+}
+
+func TestCastPlaysPreviewFromStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		standIn  func(t *testing.T) castStandIn
+		expected string
+	}{
+		{"chromecast", func(t *testing.T) castStandIn { return newCastReceiverStandIn(t) }, "load https://audio-ssl.itunes.apple.com/preview.m4a 30 at 0,pause"},
+		{"dlna", func(t *testing.T) castStandIn { return newDlnaRendererStandIn(t) }, "load https://audio-ssl.itunes.apple.com/preview.m4a 30,play,pause"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			standIn := test.standIn(t)
+			manager := connectCastStandIn(t, standIn.device())
+
+			media, _ := castMediaFromAttributes(testCastSong)
+			// The position of the full song playing locally
+			if err := manager.Load(media, 200); err != nil {
+				t.Fatal(err)
+			}
+			manager.mirror(PlaybackEvent{Kind: PlaybackSeek, Attributes: testCastSong, State: PlaybackState{Position: 250}})
+			manager.mirror(PlaybackEvent{Kind: PlaybackPause, Attributes: testCastSong})
+
+			if playback := strings.Join(standIn.playback(), ","); playback != test.expected {
+				t.Errorf("expected the preview to play from the start without seeking, got %s", playback)
+			}
+			if status := manager.Status(); !status.Connected || !status.Media.Preview {
+				t.Errorf("unexpected status %+v", status)
+			}
+		})
+	}
+}
+
+func TestCastClampsPosition(t *testing.T) {
+	tests := []struct {
+		name     string
+		standIn  func(t *testing.T) castStandIn
+		expected string
+	}{
+		{"chromecast", func(t *testing.T) castStandIn { return newCastReceiverStandIn(t) }, "load https://example.com/stream.m4a 120 at 120,seek 60,seek 120"},
+		{"dlna", func(t *testing.T) castStandIn { return newDlnaRendererStandIn(t) }, "load https://example.com/stream.m4a 120,play,seek 120,seek 60,seek 120"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			standIn := test.standIn(t)
+			manager := connectCastStandIn(t, standIn.device())
+
+			media := CastMediaInfo{Url: "https://example.com/stream.m4a", ContentType: "audio/mp4", Title: "Stream", Duration: 120}
+			if err := manager.Load(media, 500); err != nil {
+				t.Fatal(err)
+			}
+			manager.mirror(PlaybackEvent{Kind: PlaybackSeek, State: PlaybackState{Position: 60}})
+			manager.mirror(PlaybackEvent{Kind: PlaybackSeek, State: PlaybackState{Position: 300}})
+
+			if playback := strings.Join(standIn.playback(), ","); playback != test.expected {
+				t.Errorf("positions were not clamped to the media: %s", playback)
+			}
+		})
+	}
+}
+
+func TestChromecastMirrorsVolume(t *testing.T) {
+	receiver := newCastReceiverStandIn(t)
+	manager := connectCastStandIn(t, receiver.device())
+
+	if status := manager.Status(); status.Volume != 0.5 {
+		t.Errorf("expected the volume of the device, got %v", status.Volume)
+	}
+	if err := manager.SetVolume(0.3); err != nil {
+		t.Fatal(err)
+	}
+	if status := manager.Status(); status.Volume != 0.3 {
+		t.Errorf("expected the volume that was set, got %v", status.Volume)
+	}
+	// The volume was changed on the device itself
+	receiver.change(func() { receiver.volume = 0.8 })
+	waitForCastStatus(t, manager, "the volume of the device", func(status CastStatus) bool { return status.Volume == 0.8 })
+}
+
+func TestChromecastDeviceClosesSession(t *testing.T) {
+	receiver := newCastReceiverStandIn(t)
+	manager := connectCastStandIn(t, receiver.device())
+
+	receiver.close()
+	status := waitForCastStatus(t, manager, "the session to end", func(status CastStatus) bool { return !status.Connected })
+	if status.State != "disconnected" || status.LastError != "the device closed the session" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if err := manager.Load(CastMediaInfo{Url: "https://example.com/stream.m4a"}, 0); err == nil {
+		t.Error("media was loaded on a closed session")
+	}
+}
+
+func TestChromecastReceiverStopped(t *testing.T) {
+	receiver := newCastReceiverStandIn(t)
+	manager := connectCastStandIn(t, receiver.device())
+
+	// Another sender stopped the media receiver
+	receiver.change(func() { receiver.stopped = true })
+	status := waitForCastStatus(t, manager, "the session to end", func(status CastStatus) bool { return !status.Connected })
+	if status.LastError != "the media receiver was stopped on the device" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestChromecastHeartbeatLoss(t *testing.T) {
+	heartbeat, loss := castHeartbeat, castHeartbeatLoss
+	castHeartbeat, castHeartbeatLoss = 20*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() { castHeartbeat, castHeartbeatLoss = heartbeat, loss })
+	receiver := newCastReceiverStandIn(t)
+	manager := connectCastStandIn(t, receiver.device())
+
+	// Answered heartbeats keep the session alive
+	time.Sleep(3 * castHeartbeatLoss)
+	if !manager.Status().Connected {
+		t.Fatalf("the session ended while the device was answering, status %+v", manager.Status())
+	}
+	receiver.change(func() { receiver.silent = true })
+	status := waitForCastStatus(t, manager, "the session to end", func(status CastStatus) bool { return !status.Connected })
+	if status.LastError != "the device stopped responding" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+// castRendererStandIn is a renderer which only records being closed
+type castRendererStandIn struct {
+	closed chan struct{}
+}
+
+func (r *castRendererStandIn) Load(media CastMediaInfo, position float64) error { return nil }
+func (r *castRendererStandIn) Play() error                                      { return nil }
+func (r *castRendererStandIn) Pause() error                                     { return nil }
+func (r *castRendererStandIn) Seek(seconds float64) error                       { return nil }
+func (r *castRendererStandIn) SetVolume(volume float64) error                   { return nil }
+func (r *castRendererStandIn) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func TestCastDisconnectWhileConnecting(t *testing.T) {
+	release := make(chan struct{})
+	renderer := &castRendererStandIn{closed: make(chan struct{})}
+	castKinds["stand-in"] = castKind{connect: func(device CastDevice, update func(func(*CastStatus)), closed func(error)) (castRenderer, error) {
+		<-release
+		return renderer, nil
+	}}
+	t.Cleanup(func() { delete(castKinds, "stand-in") })
+	manager := NewCastManager()
+	manager.devices["stand-in:slow"] = CastDevice{ID: "stand-in:slow", Name: "Slow", Kind: "stand-in"}
+
+	connected := make(chan error)
+	go func() { connected <- manager.Connect("stand-in:slow") }()
+	waitForCastStatus(t, manager, "the connection to start", func(status CastStatus) bool { return status.State == "connecting" })
+	manager.Disconnect()
+	close(release)
+
+	if err := <-connected; err == nil {
+		t.Fatal("a session disconnected while connecting was started")
+	}
+	select {
+	case <-renderer.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the renderer of the abandoned session was left open")
+	}
+	if status := manager.Status(); status.Connected || status.State != "disconnected" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if _, err := manager.current(); err == nil {
+		t.Error("the abandoned renderer was kept")
+	}
+}
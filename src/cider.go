@@ -14,6 +14,8 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	yomikaki "github.com/freehelpdesk/yomikaki"
@@ -33,7 +35,17 @@ var (
 	FujisanObject           = CreateCider()
 	FujisanIOObject         = NewIO()
 	FujisanKasumiObject     = kasumi.New(&kasumi.Config{ApplicationName: "fujisan"})
-	FujisanDiscordRpcObject = client.New()
+	FujisanDiscordRpcObject = NewDiscordIPC()
+	FujisanPresenceObject   = NewPresenceManager(FujisanDiscordRpcObject)
+	FujisanHistoryObject    = NewHistoryStore(historyFile)
+	FujisanHistoryImporter  = new(historyImporter)
+	FujisanLastFmAccounts   = new(lastFmAccounts)
+	FujisanPlaybackObject   = NewPlaybackTracker()
+	FujisanWebhookObject    = NewWebhookDispatcher()
+	FujisanMqttObject       = new(MqttPublisher)
+	FujisanCastObject       = NewCastManager()
+	FujisanPluginApprovals  = new(pluginApprovals)
+	FujisanPluginLoader     *PluginLoader
 
 	//go:embed all:frontend/dist
 	FujisanAssets embed.FS
@@ -43,10 +55,15 @@ var (
 
 // Cider Main application structure which contains methods to pass through to the front end
 type Cider struct {
-	ctx              context.Context
-	Activity         client.Activity
-	LastFm           *lastfm.Api
-	discordRPCStatus bool
+	ctx            context.Context
+	Activity       client.Activity
+	LastFm         *lastfm.Api
+	Scrobblers     []Scrobbler
+	scrobblerMutex sync.RWMutex
+	playback       presencePlayback
+	// presenceHidden is set when the privacy rules hide the current song, it is guarded by the playback lock
+	presenceHidden   bool
+	privateListening atomic.Bool
 }
 
 // CreateCider creates a new Cider application struct and returns it as a `*Cider`
@@ -107,6 +124,25 @@ func (c *Cider) startup(ctx context.Context) {
 
 	wruntime.WindowSetSize(FujisanObject.ctx, size[0], size[1])
 
+	if localLog, _ := yomikaki.DirectRead("connectivity.scrobbling.localLog", config); localLog == true {
+		c.SetLocalScrobbleLog(true)
+	}
+
+	if err := c.StartMqtt(); err != nil {
+		log.Println("Failed to start MQTT:", err)
+	}
+
+	// Presence connects in the background once there is an activity to show
+	c.privateListening.Store(c.presencePrivacy(config).PrivateListening)
+	c.StartRichPresence()
+	if _, err := c.presenceClientId(config); err != nil {
+		go wruntime.MessageDialog(FujisanObject.ctx, wruntime.MessageDialogOptions{
+			Type:    wruntime.WarningDialog,
+			Title:   "Invalid Discord application",
+			Message: fmt.Sprintf("%s. Rich presence uses the default Cider application until connectivity.discord.clientId is fixed.", err),
+		})
+	}
+
 	// Assure lengths are > 1
 	//if len(config.Visual.WindowPosition) > 1 {
 	//	// Broken at the moment, not sure why.
@@ -136,6 +172,8 @@ func (c *Cider) startup(ctx context.Context) {
 		}).Methods("GET").Schemes("http")
 
 		router.Handle("/rpc", rpcServer)
+		c.registerOverlayRoutes(router)
+		router.HandleFunc("/cast/dlna/events/{token}", dlnaEventHandler).Methods("NOTIFY")
 
 		go func() {
 			if err := http.ListenAndServe(":10782", router); err != nil {
@@ -197,6 +235,11 @@ func (c *Cider) shutdown(ctx context.Context) bool {
 	if !wruntime.WindowIsMinimised(FujisanObject.ctx) {
 		c.saveWindowInformation()
 	}
+	FujisanMqttObject.Stop()
+	FujisanLastFmAccounts.flush()
+	if FujisanPluginLoader != nil {
+		FujisanPluginLoader.StopWatcher()
+	}
 	return false
 }
 
@@ -229,79 +272,56 @@ func (c *Cider) OpenDevToolsWindow() {
 
 // Run automatically started
 func (c *Cider) Run() {
+	FujisanPresenceObject.Start()
+	FujisanPlaybackObject.Subscribe(c.writeNowPlaying)
+	FujisanPlaybackObject.Subscribe(FujisanWebhookObject.HandleEvent)
 }
 
 func (c *Cider) OnDomReady(ctx context.Context) {
 	if !FujisanDOMAlreadyRan {
 		FujisanDOMAlreadyRan = true
 		log.Println("Dom is ready")
-		// Load plugins
-		plugins := NewPluginLoader(filepath.Join(FujisanIOObject.GetConfigPath(), "plugins"))
-		plugins.LoadPlugins()
+		// Load plugins, in the background since plugins may ask for permissions
+		FujisanPluginLoader = NewPluginLoader(filepath.Join(FujisanIOObject.GetConfigPath(), "plugins"))
+		go func() {
+			FujisanPluginLoader.LoadPlugins()
+			if hotReloadEnabled() {
+				if err := FujisanPluginLoader.PluginWatcher(); err != nil {
+					log.Println("Unable to watch plugins:", err)
+				}
+			}
+		}()
 		log.Println("Finished DOM tasks")
-		//plugins.PluginWatcher()
 	}
 }
 
-// StartRichPresence initializes discord rich presence with our app id
+// StartRichPresence sets the discord app id rich presence uses and follows changes to it in the config,
+// the connection itself is owned by `FujisanPresenceObject`
 func (c *Cider) StartRichPresence() {
-	// Start rich presence
-
-	var config map[string]interface{}
-	if err := json.Unmarshal([]byte(FujisanIOObject.ReadFile("spa-config.json")), &config); err != nil {
-		log.Println("Unable to cast json to struct:", err)
-		return
-	}
-
-	clientId := "1032800329332445255"
+	c.presenceConfigChanged(loadConfig())
+	onConfigChange(c.presenceConfigChanged)
+}
 
-	client := "Cider"
-	read, err := yomikaki.DirectRead("connectivity.discord.client", config)
+// presenceConfigChanged switches to the discord app of the config, the presence manager only reconnects when it differs
+func (c *Cider) presenceConfigChanged(config map[string]interface{}) {
+	clientId, err := c.presenceClientId(config)
 	if err != nil {
 		log.Println(err)
 	}
-
-	if read != nil {
-		client = read.(string)
-	}
-
-	switch client {
-	case "AppleMusic":
-		clientId = "886578863147192350"
-	case "Cider-2":
-		clientId = "1020414178047041627"
-	case "Cider":
-		fallthrough
-	default:
-		clientId = "911790844204437504"
-	}
-
-	// Try to login if we don't have a client
-	if err := FujisanDiscordRpcObject.Login(clientId); err == nil {
-		log.Println("Started rich presence")
-		c.discordRPCStatus = true
-	} else {
-		log.Println("Failed to start rich presence")
-	}
+	FujisanPresenceObject.SetClientId(clientId)
 }
 
 // IdlePresence Sets the client status to idle in discord.
 func (c *Cider) IdlePresence() {
-	c.StartRichPresence()
-	if c.discordRPCStatus {
-		now := time.Now()
-		log.Println("Discord RPC going idle")
-		if err := FujisanDiscordRpcObject.SetActivity(client.Activity{
-			Details:    "Browsing Cider",
-			LargeImage: "",
-			Timestamps: &client.Timestamps{
-				Start: &now,
-			},
-		}); err != nil {
-			// Error here.
-			log.Println(err.Error())
-		}
-	}
+	now := time.Now()
+	log.Println("Discord RPC going idle")
+	FujisanPresenceObject.SetActivity(client.Activity{
+		Details:    "Browsing Cider",
+		LargeImage: c.presenceAssets(loadConfig()).LargeImage,
+		Timestamps: &client.Timestamps{
+			Start: &now,
+		},
+	})
 }
 
 func (c *Cider) emptyIfNil(value interface{}) interface{} {
@@ -331,97 +351,106 @@ func (c *Cider) convertInterfaceToIntArray(input interface{}) ([]int, error) {
 	return []int{}, fmt.Errorf("not an []interface{}")
 }
 
+// formatDiscordStatus renders a status template, see `templateRenderer` for the syntax, and fits it into Discord's length limits
 func (c *Cider) formatDiscordStatus(text string, attributes Attributes) string {
-	text = strings.ReplaceAll(text, "{artist}", attributes.ArtistName)
-	text = strings.ReplaceAll(text, "{name}", attributes.Name)
-	text = strings.ReplaceAll(text, "{album}", attributes.AlbumName)
-	return text
+	return truncateDiscordText(renderTemplate(text, attributes))
+}
+
+// presenceTemplates returns the templates for the kind of item playing.
+// `connectivity.discord.templates.<kind>` overrides `connectivity.discord.templates.default`, which overrides the legacy detailsFormat and stateFormat
+func (c *Cider) presenceTemplates(config map[string]interface{}, kind string) PresenceTemplates {
+	templates := PresenceTemplates{Details: "{name}", State: "{artist}", LargeText: "{album}"}
+	if details, _ := yomikaki.DirectRead("connectivity.discord.detailsFormat", config); details != nil && details != "" {
+		templates.Details, _ = details.(string)
+	}
+	if state, _ := yomikaki.DirectRead("connectivity.discord.stateFormat", config); state != nil && state != "" {
+		templates.State, _ = state.(string)
+	}
+	if err := decodeConfig(config, "connectivity.discord.templates.default", &templates); err != nil {
+		log.Println("Unable to read presence templates:", err)
+	}
+	if len(kind) != 0 {
+		if err := decodeConfig(config, "connectivity.discord.templates."+kind, &templates); err != nil {
+			log.Println("Unable to read presence templates for", kind+":", err)
+		}
+	}
+	return templates
 }
 
 // UpdatePresence updates the discord rich presence based on the given attributes
 func (c *Cider) UpdatePresence(attributes Attributes) {
-	var config map[string]interface{}
-	if err := json.Unmarshal([]byte(FujisanIOObject.ReadFile("spa-config.json")), &config); err != nil {
-		log.Println("Unable to cast json to struct:", err)
-		return
-	}
+	config := loadConfig()
+	FujisanPlaybackObject.TrackChanged(attributes, attributes.CurrentPlaybackTime)
 
-	c.StartRichPresence()
-	if c.discordRPCStatus {
-		now := time.Now() // Start time doesn't really matter because latency comes into play and the end timestamp doesn't change.
-		end := time.UnixMilli(attributes.EndTime)
-
-		detailsFormatInterface, _ := yomikaki.DirectRead("connectivity.discord.detailsFormat", config)
-		stateFormatInterface, _ := yomikaki.DirectRead("connectivity.discord.stateFormat", config)
-		hideTimstampInterface, _ := yomikaki.DirectRead("connectivity.discord.hideTimestamp", config)
-		if hideTimstampInterface == nil {
-			hideTimstampInterface = false
-		}
-		hideButtonsInterface, _ := yomikaki.DirectRead("connectivity.discord.hideButtons", config)
-		if hideButtonsInterface == nil {
-			hideButtonsInterface = false
-		}
+	privacy := c.presencePrivacy(config)
+	rule, hidden := privacy.Match(attributes)
+	if hidden {
+		log.Println("Hiding", attributes.ArtistName, "-", attributes.Name, "from rich presence,", rule)
+	}
 
-		c.Activity = client.Activity{
-			Details:    c.formatDiscordStatus(c.emptyIfNil(detailsFormatInterface).(string), attributes),
-			State:      c.formatDiscordStatus(c.emptyIfNil(stateFormatInterface).(string), attributes),
-			LargeImage: c.SetImageResolution(1024, 1024, attributes.Artwork.URL),
-			LargeText:  attributes.AlbumName,
-		}
+	attributes = c.normalizeAttributes(attributes)
 
-		if !hideTimstampInterface.(bool) {
-			// TODO: Sanitize timestamps
-			if !time.Now().After(end) {
-				c.Activity.Timestamps = &client.Timestamps{
-					Start: &now,
-					End:   &end,
-				}
-			}
-		}
+	templates := c.presenceTemplates(config, attributes.Kind)
+	assets := c.presenceAssets(config)
+	if privacy.ArtistOnly {
+		templates = artistOnlyTemplates
+	}
+	options := c.presencePlaybackConfig(config)
+	hideButtonsInterface, _ := yomikaki.DirectRead("connectivity.discord.hideButtons", config)
+	if hideButtonsInterface == nil {
+		hideButtonsInterface = false
+	}
 
-		if !hideTimstampInterface.(bool) {
-			c.Activity.Buttons = []*client.Button{{
-				Label: "Play on Cider",
-				Url:   "",
-			}}
-		}
+	activity := client.Activity{
+		Details:    c.formatDiscordStatus(templates.Details, attributes),
+		State:      c.formatDiscordStatus(templates.State, attributes),
+		LargeImage: assets.LargeImage,
+		LargeText:  c.formatDiscordStatus(templates.LargeText, attributes),
+		SmallImage: assets.SmallImage,
+		SmallText:  c.formatDiscordStatus(assets.SmallText, attributes),
+	}
+	if !privacy.ArtistOnly && len(attributes.Artwork.URL) != 0 {
+		activity.LargeImage = assets.largeImage(c.SetImageResolution(1024, 1024, attributes.Artwork.URL))
+	}
 
-		if err := FujisanDiscordRpcObject.SetActivity(c.Activity); err != nil {
-			log.Println(err.Error())
-		}
+	if !hideButtonsInterface.(bool) && !privacy.ArtistOnly {
+		activity.Buttons = c.presenceButtons(config, attributes)
 	}
-	// Need to check for duplicates; MusicKit loves to fire this event twice, standby to see if we cant prevent it from sending it over javascript.
+
+	// The activity is shared with seeking and pausing, which only change its timestamps and paused indicator
+	c.playback.mutex.Lock()
+	defer c.playback.mutex.Unlock()
+	c.Activity = activity
+	c.presenceHidden = hidden
+	c.playback.reset(secondsToDuration(attributes.CurrentPlaybackTime), time.Duration(attributes.DurationInMillis)*time.Millisecond)
+	c.playback.smallImage, c.playback.smallText = activity.SmallImage, activity.SmallText
+	c.applyPlayback(options)
+
+	// Duplicates from MusicKit firing this event twice are dropped by the presence manager
+	c.sendPresence()
 }
 
 // UpdatePresenceOptions allows us to update buttons, and switch on and off Rich Presence while its running
 func (c *Cider) UpdatePresenceOptions(options RpcOptions) {
-	c.StartRichPresence()
+	FujisanPresenceObject.SetEnabled(options.Enabled)
+	FujisanPlaybackObject.SetPlaying(!options.Paused)
+
 	if options.Enabled {
-		if !c.discordRPCStatus {
-			c.StartRichPresence()
-			c.discordRPCStatus = true
-		}
-	} else {
-		FujisanDiscordRpcObject.Logout()
-		c.discordRPCStatus = false
-	}
+		playback := c.presencePlaybackConfig(loadConfig())
+		c.playback.mutex.Lock()
+		defer c.playback.mutex.Unlock()
 
-	if c.discordRPCStatus {
 		if len(options.Buttons) > 0 {
-			c.Activity.Buttons = []*client.Button{}
+			var buttons []PresenceButton
 			for _, button := range options.Buttons {
-				c.Activity.Buttons = append(c.Activity.Buttons, &client.Button{Label: button.Label, Url: button.Url})
+				buttons = append(buttons, PresenceButton{Label: button.Label, Url: button.Url})
 			}
+			c.Activity.Buttons = filterPresenceButtons(buttons)
 		}
-		if options.Paused {
-			c.Activity.Timestamps = nil
-			c.Activity.Details = fmt.Sprintf("%s - Paused", c.Activity.Details)
-		}
-		if err := FujisanDiscordRpcObject.SetActivity(c.Activity); err != nil {
-			log.Println(err.Error())
-		}
+		c.setPresencePaused(options.Paused, playback)
+		c.applyPlayback(playback)
+		c.sendPresence()
 	}
-	// Need to check for duplicates; MusicKit loves to fire this event twice, standby to see if we cant prevent it from sending it over javascript.
 }
 
 // TokenExists checks to see if the LastFM token has been set
@@ -432,31 +461,51 @@ func (c *Cider) TokenExists() bool {
 	return true
 }
 
-// ScrobbleSong srobbles a song via song attributes passed from the frontend
+// ScrobbleSong srobbles a song via song attributes passed from the frontend to every enabled scrobbler
 func (c *Cider) ScrobbleSong(attributes Attributes) {
-	if c.LastFm != nil {
-		if !c.TokenExists() {
-			log.Println("Failed to get user token, failed to login.")
-			return
-		}
+	if rule, excluded := c.scrobbleExcluded(attributes); excluded {
+		log.Println("Not scrobbling", attributes.ArtistName, "-", attributes.Name+",", rule)
+		return
+	}
+	original := attributes
+	attributes = c.normalizeAttributes(attributes)
 
-		p := lastfm.P{
-			"artist":    attributes.ArtistName,
-			"album":     attributes.AlbumName,
-			"track":     attributes.Name,
-			"timestamp": time.Now().Unix(),
+	timestamp := time.Now()
+	for _, scrobbler := range c.scrobblers() {
+		if filtered, ok := scrobbler.(filteredScrobbler); ok {
+			if rule, matched := filtered.Filter().Match(original); matched {
+				log.Println("Not scrobbling", attributes.ArtistName, "-", attributes.Name, "on", scrobbler.Name()+",", rule)
+				continue
+			}
 		}
 
-		if _, err := c.LastFm.Track.UpdateNowPlaying(p); err != nil {
-			log.Println("Failed to update Now Playing.", err)
-			return
-		}
+		c.submitScrobble(scrobbler, attributes, timestamp)
+	}
+	FujisanPlaybackObject.Scrobbled(attributes)
 
-		if _, err := c.LastFm.Track.Scrobble(p); err != nil {
-			log.Println("Failed to scrobble song.", err)
-			return
-		}
+	if _, err := FujisanHistoryObject.Add(HistoryEntry{
+		Timestamp:  timestamp.Unix(),
+		ArtistName: attributes.ArtistName,
+		AlbumName:  attributes.AlbumName,
+		Name:       attributes.Name,
+		Source:     "cider",
+	}); err != nil {
+		log.Println("Failed to add song to history.", err)
+	}
+}
+
+// submitScrobble updates Now Playing and scrobbles on one scrobbler, a failed Now Playing update doesn't drop the scrobble
+func (c *Cider) submitScrobble(scrobbler Scrobbler, attributes Attributes, timestamp time.Time) error {
+	if err := scrobbler.NowPlaying(attributes); err != nil {
+		log.Println("Failed to update Now Playing on", scrobbler.Name()+".", err)
+	}
+
+	err := scrobbler.Scrobble(attributes, timestamp)
+	if err != nil {
+		log.Println("Failed to scrobble song on", scrobbler.Name()+".", err)
 	}
+	c.recordSubmission(scrobbler, attributes, err)
+	return err
 }
 
 // QuerySong gets a song based on artist and song name
@@ -467,6 +516,7 @@ func (c *Cider) QuerySong(attributes Attributes) string {
 			return ""
 		}
 
+		attributes = c.normalizeAttributes(attributes)
 		p := lastfm.P{
 			"artist": attributes.ArtistName,
 			"track":  attributes.Name,
@@ -481,8 +531,13 @@ func (c *Cider) QuerySong(attributes Attributes) string {
 	return ""
 }
 
-// InitLastFM sets all the necessary configuration options for LastFM to work
+// InitLastFM sets all the necessary configuration options for LastFM to work, and restores every other saved Last.fm account
 func (c *Cider) InitLastFM(key string, secret string, account string, password string) {
+	FujisanLastFmAccounts.mutex.Lock()
+	FujisanLastFmAccounts.key, FujisanLastFmAccounts.secret = key, secret
+	FujisanLastFmAccounts.mutex.Unlock()
+	defer c.restoreLastFmAccounts()
+
 	if len(account) == 0 {
 		log.Println("Not logging into LastFM. Account is not setup.")
 		return
@@ -492,18 +547,26 @@ func (c *Cider) InitLastFM(key string, secret string, account string, password s
 		log.Println("Failed to login to LastFM.", err)
 		return
 	}
+	FujisanLastFmAccounts.mutex.Lock()
+	FujisanLastFmAccounts.primary = account
+	FujisanLastFmAccounts.mutex.Unlock()
+	c.saveLastFmAccount(account, c.LastFm)
 }
 
-func (c *Cider) CastMedia() {
-
-}
-
-func (c *Cider) InitCast() {
-
-}
-
-func (c *Cider) CastSources() {
-
+// InitListenBrainz enables scrobbling to ListenBrainz, apiRoot may point to any compatible server and defaults to `DefaultListenBrainzRoot`
+func (c *Cider) InitListenBrainz(token string, apiRoot string) {
+	if len(token) == 0 {
+		log.Println("Not logging into ListenBrainz. Token is not setup.")
+		return
+	}
+	scrobbler := NewListenBrainzScrobbler(apiRoot, token)
+	user, err := scrobbler.ValidateToken()
+	if err != nil {
+		log.Println("Failed to login to", scrobbler.Name()+".", err)
+		return
+	}
+	log.Println("Logged into", scrobbler.Name(), "as", user)
+	c.addScrobbler(scrobbler)
 }
 
 // GetOSBuild returns the windows build number, used to check if we can enable transparency
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	yomikaki "github.com/freehelpdesk/yomikaki"
+)
+
+// configCache keeps the last parsed `spa-config.json` until the file changes on disk
+var configCache struct {
+	config     map[string]interface{}
+	modified   time.Time
+	size       int64
+	generation uint64
+	derived    map[string]derivedConfig
+	mutex      sync.Mutex
+}
+
+// derivedConfig is a value built from the config generation it belongs to
+type derivedConfig struct {
+	generation uint64
+	value      interface{}
+}
+
+// configListeners are called with the config every time it is parsed again
+var configListeners struct {
+	listeners []func(config map[string]interface{})
+	mutex     sync.Mutex
+}
+
+// onConfigChange calls listener with the new config whenever it changed on disk, changes are noticed the next time the config is read.
+// The config is shared between callers and must not be modified
+func onConfigChange(listener func(config map[string]interface{})) {
+	configListeners.mutex.Lock()
+	defer configListeners.mutex.Unlock()
+	configListeners.listeners = append(configListeners.listeners, listener)
+}
+
+// loadConfigGeneration reads the config and returns it with a generation which changes every time the config is parsed again
+func loadConfigGeneration() (map[string]interface{}, uint64) {
+	config, generation, changed := readConfig()
+	if changed {
+		configListeners.mutex.Lock()
+		listeners := configListeners.listeners
+		configListeners.mutex.Unlock()
+		for _, listener := range listeners {
+			listener(config)
+		}
+	}
+	return config, generation
+}
+
+// readConfig returns the cached config, parsing it again if the file changed
+func readConfig() (map[string]interface{}, uint64, bool) {
+	configCache.mutex.Lock()
+	defer configCache.mutex.Unlock()
+
+	// A missing config is cached with a zero modification time and size, so it is only parsed again once the file is written
+	var modified time.Time
+	var size int64
+	if info, err := os.Stat(filepath.Join(FujisanIOObject.GetConfigPath(), "spa-config.json")); err == nil {
+		modified, size = info.ModTime(), info.Size()
+	}
+	if configCache.config != nil && modified.Equal(configCache.modified) && size == configCache.size {
+		return configCache.config, configCache.generation, false
+	}
+
+	config := make(map[string]interface{})
+	if b := FujisanIOObject.ReadFile("spa-config.json"); len(b) != 0 {
+		if err := json.Unmarshal([]byte(b), &config); err != nil {
+			log.Println("Unable to cast json to struct:", err)
+		}
+	}
+	configCache.generation++
+	configCache.config, configCache.modified, configCache.size = config, modified, size
+	return config, configCache.generation, true
+}
+
+// loadConfig reads `spa-config.json` from the config path, an unreadable config results in an empty map.
+// The map is shared between callers and must not be modified
+func loadConfig() map[string]interface{} {
+	config, _ := loadConfigGeneration()
+	return config
+}
+
+// configDerived returns the value build makes from the config, it is only built again after the config changes.
+// The value is shared between callers and must not be modified
+func configDerived(key string, build func(config map[string]interface{}) interface{}) interface{} {
+	config, generation := loadConfigGeneration()
+	configCache.mutex.Lock()
+	if derived, ok := configCache.derived[key]; ok && derived.generation == generation {
+		configCache.mutex.Unlock()
+		return derived.value
+	}
+	configCache.mutex.Unlock()
+
+	value := build(config)
+	configCache.mutex.Lock()
+	if configCache.derived == nil {
+		configCache.derived = make(map[string]derivedConfig)
+	}
+	configCache.derived[key] = derivedConfig{generation, value}
+	configCache.mutex.Unlock()
+	return value
+}
+
+// decodeConfig decodes the value found at path into out, out is left untouched if the path is not set
+func decodeConfig(config map[string]interface{}, path string, out interface{}) error {
+	read, _ := yomikaki.DirectRead(path, config)
+	if read == nil {
+		return nil
+	}
+	b, err := json.Marshal(read)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
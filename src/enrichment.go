@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ciderapp/lastfm-go/lastfm"
+)
+
+// How long each kind of Last.fm metadata is cached on disk
+const (
+	artistInfoTTL     = 7 * 24 * time.Hour
+	similarTTL        = 7 * 24 * time.Hour
+	albumInfoTTL      = 30 * 24 * time.Hour
+	trackPlaycountTTL = 10 * time.Minute
+)
+
+type LastFmTag struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+type ArtistInfo struct {
+	Name      string      `json:"name"`
+	Url       string      `json:"url"`
+	Listeners string      `json:"listeners"`
+	Plays     string      `json:"plays"`
+	Summary   string      `json:"summary"`
+	Content   string      `json:"content"`
+	Tags      []LastFmTag `json:"tags"`
+}
+
+type SimilarArtist struct {
+	Name  string `json:"name"`
+	Url   string `json:"url"`
+	Match string `json:"match"`
+}
+
+type SimilarTrack struct {
+	ArtistName string `json:"artistName"`
+	Name       string `json:"name"`
+	Url        string `json:"url"`
+	Match      string `json:"match"`
+}
+
+type AlbumInfo struct {
+	Name       string      `json:"name"`
+	ArtistName string      `json:"artistName"`
+	Url        string      `json:"url"`
+	Summary    string      `json:"summary"`
+	Content    string      `json:"content"`
+	Tags       []LastFmTag `json:"tags"`
+}
+
+type TrackPlaycount struct {
+	ArtistName    string `json:"artistName"`
+	Name          string `json:"name"`
+	UserPlayCount int    `json:"userPlayCount"`
+	UserLoved     bool   `json:"userLoved"`
+}
+
+type lastFmCacheEntry struct {
+	Expires int64           `json:"expires"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// lastFmCachePath returns the cache file for a Last.fm method and its arguments
+func (c *Cider) lastFmCachePath(method string, args lastfm.P) string {
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha1.New()
+	hash.Write([]byte(method))
+	for _, key := range keys {
+		hash.Write([]byte(fmt.Sprintf("\x00%s=%v", key, args[key])))
+	}
+	return filepath.Join(FujisanIOObject.GetConfigPath(), "cache", "lastfm", hex.EncodeToString(hash.Sum(nil))+".json")
+}
+
+// cachedLastFm decodes a cached result into out, calling fetch and caching its result for ttl when there is no fresh cache entry
+func (c *Cider) cachedLastFm(method string, args lastfm.P, ttl time.Duration, out interface{}, fetch func() (interface{}, error)) error {
+	if c.LastFm == nil {
+		return errors.New("last.fm is not initialized")
+	}
+
+	path := c.lastFmCachePath(method, args)
+	if b, err := os.ReadFile(path); err == nil {
+		var entry lastFmCacheEntry
+		if err := json.Unmarshal(b, &entry); err == nil && time.Now().Unix() < entry.Expires {
+			if err := json.Unmarshal(entry.Data, out); err == nil {
+				return nil
+			}
+		}
+	}
+
+	result, err := fetch()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if b, err := json.Marshal(lastFmCacheEntry{Expires: time.Now().Add(ttl).Unix(), Data: data}); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err == nil {
+			_ = os.WriteFile(path, b, 0644)
+		}
+	}
+	return json.Unmarshal(data, out)
+}
+
+// GetArtistInfo returns the Last.fm biography and tags of an artist
+func (c *Cider) GetArtistInfo(artist string) (ArtistInfo, error) {
+	var info ArtistInfo
+	p := lastfm.P{"artist": artist, "autocorrect": 1}
+	err := c.cachedLastFm("artist.getInfo", p, artistInfoTTL, &info, func() (interface{}, error) {
+		result, err := c.LastFm.Artist.GetInfo(p)
+		if err != nil {
+			return nil, err
+		}
+		info := ArtistInfo{
+			Name:      result.Name,
+			Url:       result.Url,
+			Listeners: result.Stats.Listeners,
+			Plays:     result.Stats.Plays,
+			Summary:   result.Bio.Summary,
+			Content:   result.Bio.Content,
+		}
+		for _, tag := range result.Tags {
+			info.Tags = append(info.Tags, LastFmTag{Name: tag.Name, Url: tag.Url})
+		}
+		return info, nil
+	})
+	return info, err
+}
+
+// GetSimilarArtists returns artists Last.fm considers similar to the given one
+func (c *Cider) GetSimilarArtists(artist string) ([]SimilarArtist, error) {
+	var similar []SimilarArtist
+	p := lastfm.P{"artist": artist, "autocorrect": 1, "limit": 20}
+	err := c.cachedLastFm("artist.getSimilar", p, similarTTL, &similar, func() (interface{}, error) {
+		result, err := c.LastFm.Artist.GetSimilar(p)
+		if err != nil {
+			return nil, err
+		}
+		similar := []SimilarArtist{}
+		for _, artist := range result.Similars {
+			similar = append(similar, SimilarArtist{Name: artist.Name, Url: artist.Url, Match: artist.Match})
+		}
+		return similar, nil
+	})
+	return similar, err
+}
+
+// GetSimilarTracks returns tracks Last.fm considers similar to the given one
+func (c *Cider) GetSimilarTracks(artist string, track string) ([]SimilarTrack, error) {
+	var similar []SimilarTrack
+	p := lastfm.P{"artist": artist, "track": track, "autocorrect": 1, "limit": 20}
+	err := c.cachedLastFm("track.getSimilar", p, similarTTL, &similar, func() (interface{}, error) {
+		result, err := c.LastFm.Track.GetSimilar(p)
+		if err != nil {
+			return nil, err
+		}
+		similar := []SimilarTrack{}
+		for _, track := range result.Tracks {
+			similar = append(similar, SimilarTrack{ArtistName: track.Artist.Name, Name: track.Name, Url: track.Url, Match: track.Match})
+		}
+		return similar, nil
+	})
+	return similar, err
+}
+
+// GetAlbumInfo returns the Last.fm wiki and tags of an album
+func (c *Cider) GetAlbumInfo(artist string, album string) (AlbumInfo, error) {
+	var info AlbumInfo
+	p := lastfm.P{"artist": artist, "album": album, "autocorrect": 1}
+	err := c.cachedLastFm("album.getInfo", p, albumInfoTTL, &info, func() (interface{}, error) {
+		result, err := c.LastFm.Album.GetInfo(p)
+		if err != nil {
+			return nil, err
+		}
+		info := AlbumInfo{
+			Name:       result.Name,
+			ArtistName: result.Artist,
+			Url:        result.Url,
+			Summary:    result.Wiki.Summary,
+			Content:    result.Wiki.Content,
+		}
+		for _, tag := range result.TopTags {
+			info.Tags = append(info.Tags, LastFmTag{Name: tag.Name, Url: tag.Url})
+		}
+		return info, nil
+	})
+	return info, err
+}
+
+// GetTrackPlaycount returns how often the logged in Last.fm user has played a track
+func (c *Cider) GetTrackPlaycount(artist string, track string) (TrackPlaycount, error) {
+	var playcount TrackPlaycount
+	scrobbler := c.lastFmScrobbler()
+	if scrobbler == nil {
+		return playcount, errors.New("last.fm is not initialized")
+	}
+	p := lastfm.P{"artist": artist, "track": track, "autocorrect": 1, "username": scrobbler.User}
+	err := c.cachedLastFm("track.getInfo", p, trackPlaycountTTL, &playcount, func() (interface{}, error) {
+		result, err := c.LastFm.Track.GetInfo(p)
+		if err != nil {
+			return nil, err
+		}
+		// Last.fm leaves out the play count of songs the user never played
+		userPlayCount, _ := strconv.Atoi(strings.TrimSpace(result.UserPlayCount))
+		return TrackPlaycount{
+			ArtistName:    result.Artist.Name,
+			Name:          result.Name,
+			UserPlayCount: userPlayCount,
+			UserLoved:     strings.TrimSpace(result.UserLoved) == "1",
+		}, nil
+	})
+	return playcount, err
+}
+
+// EnrichmentArgs picks the song to enrich, the currently playing song is used when no artist is passed
+type EnrichmentArgs struct {
+	ArtistName string `json:"artistName"`
+	AlbumName  string `json:"albumName"`
+	Name       string `json:"name"`
+}
+
+type SimilarArtistsType struct {
+	Artists []SimilarArtist `json:"artists"`
+}
+
+type SimilarTracksType struct {
+	Tracks []SimilarTrack `json:"tracks"`
+}
+
+// enrichmentAttributes returns the normalized song described by the arguments
+func (f *FujisanRpc) enrichmentAttributes(args *EnrichmentArgs) (Attributes, error) {
+	attributes := Attributes{}
+	if args != nil && len(args.ArtistName) != 0 {
+		attributes.ArtistName = args.ArtistName
+		attributes.AlbumName = args.AlbumName
+		attributes.Name = args.Name
+	} else {
+		current, err := FujisanObject.currentAttributes()
+		if err != nil {
+			return attributes, err
+		}
+		attributes = current
+	}
+	return FujisanObject.normalizeAttributes(attributes), nil
+}
+
+func (f *FujisanRpc) GetArtistInfo(r *http.Request, args *EnrichmentArgs, result *ArtistInfo) error {
+	attributes, err := f.enrichmentAttributes(args)
+	if err != nil {
+		return err
+	}
+	*result, err = FujisanObject.GetArtistInfo(attributes.ArtistName)
+	return err
+}
+
+func (f *FujisanRpc) GetSimilarArtists(r *http.Request, args *EnrichmentArgs, result *SimilarArtistsType) error {
+	attributes, err := f.enrichmentAttributes(args)
+	if err != nil {
+		return err
+	}
+	result.Artists, err = FujisanObject.GetSimilarArtists(attributes.ArtistName)
+	return err
+}
+
+func (f *FujisanRpc) GetSimilarTracks(r *http.Request, args *EnrichmentArgs, result *SimilarTracksType) error {
+	attributes, err := f.enrichmentAttributes(args)
+	if err != nil {
+		return err
+	}
+	result.Tracks, err = FujisanObject.GetSimilarTracks(attributes.ArtistName, attributes.Name)
+	return err
+}
+
+func (f *FujisanRpc) GetAlbumInfo(r *http.Request, args *EnrichmentArgs, result *AlbumInfo) error {
+	attributes, err := f.enrichmentAttributes(args)
+	if err != nil {
+		return err
+	}
+	*result, err = FujisanObject.GetAlbumInfo(attributes.ArtistName, attributes.AlbumName)
+	return err
+}
+
+func (f *FujisanRpc) GetTrackPlaycount(r *http.Request, args *EnrichmentArgs, result *TrackPlaycount) error {
+	attributes, err := f.enrichmentAttributes(args)
+	if err != nil {
+		return err
+	}
+	*result, err = FujisanObject.GetTrackPlaycount(attributes.ArtistName, attributes.Name)
+	return err
+}
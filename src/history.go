@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ciderapp/lastfm-go/lastfm"
+	wruntime "github.com/ciderapp/wails/v2/pkg/runtime"
+)
+
+const (
+	historyFile       = "history.jsonl"
+	historyImportFile = "history-import.json"
+)
+
+// HistoryEntry is a single listen in the local history
+type HistoryEntry struct {
+	Timestamp  int64  `json:"timestamp"`
+	ArtistName string `json:"artistName"`
+	AlbumName  string `json:"albumName"`
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+}
+
+// HistoryStore is the local listening history, stored as one JSON entry per line and deduplicated by timestamp
+type HistoryStore struct {
+	filename string
+	entries  map[int64]HistoryEntry
+	mutex    sync.Mutex
+}
+
+// NewHistoryStore returns a `*HistoryStore` for a file relative to the config path
+func NewHistoryStore(filename string) *HistoryStore {
+	return &HistoryStore{filename: filename}
+}
+
+func (h *HistoryStore) path() string {
+	return filepath.Join(FujisanIOObject.GetConfigPath(), h.filename)
+}
+
+// load reads the history file the first time the store is used, the lock must be held
+func (h *HistoryStore) load() {
+	if h.entries != nil {
+		return
+	}
+	h.entries = make(map[int64]HistoryEntry)
+	file, err := os.Open(h.path())
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		h.entries[entry.Timestamp] = entry
+	}
+}
+
+// Add appends the entries whose timestamp is not in the history yet and returns how many were added
+func (h *HistoryStore) Add(entries ...HistoryEntry) (int, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.load()
+
+	file, err := os.OpenFile(h.path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	added := 0
+	for _, entry := range entries {
+		if _, ok := h.entries[entry.Timestamp]; ok {
+			continue
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return added, err
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			return added, err
+		}
+		h.entries[entry.Timestamp] = entry
+		added++
+	}
+	return added, nil
+}
+
+// Entries returns the history sorted from newest to oldest
+func (h *HistoryStore) Entries() []HistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.load()
+
+	entries := make([]HistoryEntry, 0, len(h.entries))
+	for _, entry := range h.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Timestamp > entries[j].Timestamp
+	})
+	return entries
+}
+
+// HistoryImportState is the progress of a Last.fm history import, it is saved after every page so an import can be resumed
+type HistoryImportState struct {
+	Running    bool   `json:"running"`
+	Done       bool   `json:"done"`
+	User       string `json:"user"`
+	From       int64  `json:"from"`
+	To         int64  `json:"to"`
+	Page       int    `json:"page"`
+	TotalPages int    `json:"totalPages"`
+	Imported   int    `json:"imported"`
+	Duplicates int    `json:"duplicates"`
+	Error      string `json:"error"`
+}
+
+// historyImporter runs a single Last.fm history import at a time
+type historyImporter struct {
+	state HistoryImportState
+	stop  chan struct{}
+	mutex sync.Mutex
+}
+
+func (h *historyImporter) status() HistoryImportState {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.state
+}
+
+// update changes the state, saves it and reports it to the frontend
+func (h *historyImporter) update(change func(state *HistoryImportState)) {
+	h.mutex.Lock()
+	change(&h.state)
+	state := h.state
+	h.mutex.Unlock()
+
+	if b, err := json.Marshal(state); err == nil {
+		FujisanIOObject.WriteFile(historyImportFile, string(b))
+	}
+	if FujisanObject.ctx != nil {
+		wruntime.EventsEmit(FujisanObject.ctx, "fujisan:historyImport", state)
+	}
+}
+
+// StartHistoryImport imports the scrobbles of the logged in Last.fm user into the local history.
+// An interrupted import is resumed from its last page, a finished one only imports what was scrobbled since
+func (c *Cider) StartHistoryImport() HistoryImportState {
+	importer := FujisanHistoryImporter
+	importer.mutex.Lock()
+	if importer.state.Running {
+		importer.mutex.Unlock()
+		return importer.status()
+	}
+
+	scrobbler := c.lastFmScrobbler()
+	if scrobbler == nil {
+		importer.state.Error = "last.fm is not initialized"
+		importer.mutex.Unlock()
+		return importer.status()
+	}
+
+	var saved HistoryImportState
+	if b := FujisanIOObject.ReadFile(historyImportFile); len(b) != 0 {
+		if err := json.Unmarshal([]byte(b), &saved); err != nil {
+			log.Println("Unable to read history import state:", err)
+		}
+	}
+
+	state := HistoryImportState{User: scrobbler.User, To: time.Now().Unix()}
+	if saved.User == scrobbler.User {
+		if saved.Done {
+			state.From = saved.To
+		} else {
+			state = saved
+			state.Error = ""
+		}
+	}
+	state.Running = true
+	state.Done = false
+	importer.state = state
+	stop := make(chan struct{})
+	importer.stop = stop
+	importer.mutex.Unlock()
+
+	go c.runHistoryImport(importer, scrobbler, stop)
+	return importer.status()
+}
+
+func (c *Cider) runHistoryImport(importer *historyImporter, scrobbler *LastFmScrobbler, stop chan struct{}) {
+	state := importer.status()
+	log.Println("Importing Last.fm history for", state.User, "from page", state.Page+1)
+
+	for page := state.Page + 1; ; page++ {
+		select {
+		case <-stop:
+			importer.update(func(state *HistoryImportState) { state.Running = false })
+			log.Println("Stopped Last.fm history import")
+			return
+		default:
+		}
+
+		p := lastfm.P{"user": state.User, "limit": 200, "page": page, "to": state.To}
+		if state.From != 0 {
+			p["from"] = state.From
+		}
+		recent, err := scrobbler.Api.User.GetRecentTracks(p)
+		if err != nil {
+			importer.update(func(state *HistoryImportState) {
+				state.Running = false
+				state.Error = err.Error()
+			})
+			log.Println("Failed to import Last.fm history:", err)
+			return
+		}
+
+		var entries []HistoryEntry
+		for _, track := range recent.Tracks {
+			if track.NowPlaying == "true" {
+				continue
+			}
+			timestamp, err := strconv.ParseInt(track.Date.Uts, 10, 64)
+			if err != nil {
+				continue
+			}
+			entries = append(entries, HistoryEntry{
+				Timestamp:  timestamp,
+				ArtistName: track.Artist.Name,
+				AlbumName:  track.Album.Name,
+				Name:       track.Name,
+				Source:     "lastfm",
+			})
+		}
+		added, err := FujisanHistoryObject.Add(entries...)
+		if err != nil {
+			// The page stays unfinished so resuming the import retries it
+			importer.update(func(state *HistoryImportState) {
+				state.Running = false
+				state.Error = "unable to write history: " + err.Error()
+			})
+			log.Println("Failed to write history:", err)
+			return
+		}
+
+		done := page >= recent.TotalPages
+		importer.update(func(state *HistoryImportState) {
+			state.Page = page
+			state.TotalPages = recent.TotalPages
+			state.Imported += added
+			state.Duplicates += len(entries) - added
+			state.Done = done
+			state.Running = !done
+		})
+		if done {
+			log.Println("Finished importing Last.fm history")
+			return
+		}
+		// Stay well below the Last.fm rate limit
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// StopHistoryImport stops a running import after the current page, it can be resumed later
+func (c *Cider) StopHistoryImport() {
+	importer := FujisanHistoryImporter
+	importer.mutex.Lock()
+	defer importer.mutex.Unlock()
+	if importer.state.Running && importer.stop != nil {
+		close(importer.stop)
+		importer.stop = nil
+	}
+}
+
+// GetHistoryImportStatus returns the progress of the current or last history import
+func (c *Cider) GetHistoryImportStatus() HistoryImportState {
+	return FujisanHistoryImporter.status()
+}
+
+func (f *FujisanRpc) StartHistoryImport(r *http.Request, args *interface{}, result *HistoryImportState) error {
+	*result = FujisanObject.StartHistoryImport()
+	if len(result.Error) != 0 && !result.Running {
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
+func (f *FujisanRpc) StopHistoryImport(r *http.Request, args *interface{}, result *HistoryImportState) error {
+	FujisanObject.StopHistoryImport()
+	*result = FujisanObject.GetHistoryImportStatus()
+	return nil
+}
+
+func (f *FujisanRpc) GetHistoryImportStatus(r *http.Request, args *interface{}, result *HistoryImportState) error {
+	*result = FujisanObject.GetHistoryImportStatus()
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ciderapp/lastfm-go/lastfm"
+)
+
+const (
+	lastFmAccountsFile = "lastfm-accounts.json"
+	// lastFmStatusSaveDelay batches the status updates of scrobbles into one write of the accounts file
+	lastFmStatusSaveDelay = 10 * time.Second
+)
+
+// LastFmAccountStatus tracks the submissions made to a Last.fm account
+type LastFmAccountStatus struct {
+	LastSubmission time.Time `json:"lastSubmission"`
+	LastTrack      string    `json:"lastTrack"`
+	LastError      string    `json:"lastError"`
+	Scrobbled      int       `json:"scrobbled"`
+	Failed         int       `json:"failed"`
+}
+
+// LastFmAccount is an authenticated Last.fm account, the session key is saved so the password is never stored
+type LastFmAccount struct {
+	User       string              `json:"user"`
+	SessionKey string              `json:"sessionKey"`
+	Enabled    bool                `json:"enabled"`
+	Filters    *ScrobbleFilter     `json:"filters"`
+	Status     LastFmAccountStatus `json:"status"`
+}
+
+// lastFmAccounts holds every Last.fm account Cider scrobbles to, all of them share the API key of `Cider.InitLastFM`.
+// The primary account is the one logged in through `Cider.InitLastFM`, it scrobbles through `Cider.LastFm`
+type lastFmAccounts struct {
+	key       string
+	secret    string
+	primary   string
+	accounts  []*LastFmAccount
+	loaded    bool
+	saveTimer *time.Timer
+	mutex     sync.Mutex
+}
+
+// load reads the saved accounts the first time they are used, the lock must be held
+func (l *lastFmAccounts) load() {
+	if l.loaded {
+		return
+	}
+	l.loaded = true
+	if b := FujisanIOObject.ReadFile(lastFmAccountsFile); len(b) != 0 {
+		if err := json.Unmarshal([]byte(b), &l.accounts); err != nil {
+			log.Println("Unable to read Last.fm accounts:", err)
+		}
+	}
+}
+
+// saveLater writes the accounts to disk after `lastFmStatusSaveDelay`, the lock must be held
+func (l *lastFmAccounts) saveLater() {
+	if l.saveTimer != nil {
+		return
+	}
+	l.saveTimer = time.AfterFunc(lastFmStatusSaveDelay, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.saveTimer != nil {
+			l.save()
+		}
+	})
+}
+
+// flush writes pending status updates to disk
+func (l *lastFmAccounts) flush() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.saveTimer != nil {
+		l.save()
+	}
+}
+
+// save writes the accounts to disk and cancels a pending `saveLater`, the lock must be held
+func (l *lastFmAccounts) save() {
+	if l.saveTimer != nil {
+		l.saveTimer.Stop()
+		l.saveTimer = nil
+	}
+	b, err := json.MarshalIndent(l.accounts, "", "\t")
+	if err != nil {
+		log.Println("Unable to save Last.fm accounts:", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(FujisanIOObject.GetConfigPath(), lastFmAccountsFile), b, 0600); err != nil {
+		log.Println("Unable to save Last.fm accounts:", err)
+	}
+}
+
+// find returns the account for a user, the lock must be held
+func (l *lastFmAccounts) find(user string) *LastFmAccount {
+	for _, account := range l.accounts {
+		if account.User == user {
+			return account
+		}
+	}
+	return nil
+}
+
+// scrobbler returns a scrobbler for the account using api, or a new session if api is nil
+func (l *lastFmAccounts) scrobbler(account *LastFmAccount, api *lastfm.Api) *LastFmScrobbler {
+	if api == nil {
+		api = lastfm.New(l.key, l.secret)
+		api.SetSession(account.SessionKey)
+	}
+	scrobbler := NewLastFmScrobbler(api, account.User)
+	if account.Filters != nil {
+		filters := *account.Filters
+		scrobbler.Filters = filters.Compile()
+	}
+	return scrobbler
+}
+
+// registerLastFmAccount enables or disables the scrobbler of an account to match its toggle, the lock of the accounts must be held.
+// The primary account always uses `Cider.LastFm` so reading from Last.fm keeps working after it is toggled
+func (c *Cider) registerLastFmAccount(account *LastFmAccount, api *lastfm.Api) {
+	accounts := FujisanLastFmAccounts
+	if !account.Enabled {
+		c.RemoveScrobbler(NewLastFmScrobbler(nil, account.User).Name())
+		return
+	}
+	if account.User == accounts.primary && c.LastFm != nil {
+		api = c.LastFm
+	}
+	if api == nil {
+		for _, scrobbler := range c.scrobblers() {
+			if existing, ok := scrobbler.(*LastFmScrobbler); ok && existing.User == account.User {
+				api = existing.Api
+			}
+		}
+	}
+	c.addScrobbler(accounts.scrobbler(account, api))
+}
+
+// restoreLastFmAccounts enables every saved account that isn't enabled yet
+func (c *Cider) restoreLastFmAccounts() {
+	accounts := FujisanLastFmAccounts
+	accounts.mutex.Lock()
+	defer accounts.mutex.Unlock()
+	accounts.load()
+	for _, account := range accounts.accounts {
+		if account.Enabled && len(account.SessionKey) != 0 {
+			c.registerLastFmAccount(account, nil)
+		}
+	}
+}
+
+// saveLastFmAccount adds or updates the account of a logged in api
+func (c *Cider) saveLastFmAccount(user string, api *lastfm.Api) {
+	accounts := FujisanLastFmAccounts
+	accounts.mutex.Lock()
+	defer accounts.mutex.Unlock()
+	accounts.load()
+
+	account := accounts.find(user)
+	if account == nil {
+		account = &LastFmAccount{User: user, Enabled: true}
+		accounts.accounts = append(accounts.accounts, account)
+	}
+	account.SessionKey = api.GetSessionKey()
+	accounts.save()
+	c.registerLastFmAccount(account, api)
+}
+
+// recordSubmission updates the status of the Last.fm account behind a scrobbler
+func (c *Cider) recordSubmission(scrobbler Scrobbler, attributes Attributes, err error) {
+	lastFm, ok := scrobbler.(*LastFmScrobbler)
+	if !ok {
+		return
+	}
+	accounts := FujisanLastFmAccounts
+	accounts.mutex.Lock()
+	defer accounts.mutex.Unlock()
+	accounts.load()
+
+	account := accounts.find(lastFm.User)
+	if account == nil {
+		return
+	}
+	account.Status.LastSubmission = time.Now()
+	account.Status.LastTrack = attributes.ArtistName + " - " + attributes.Name
+	if err != nil {
+		account.Status.LastError = err.Error()
+		account.Status.Failed++
+	} else {
+		account.Status.LastError = ""
+		account.Status.Scrobbled++
+	}
+	accounts.saveLater()
+}
+
+// AddLastFmAccount logs into another Last.fm account and starts scrobbling to it
+func (c *Cider) AddLastFmAccount(user string, password string) error {
+	accounts := FujisanLastFmAccounts
+	accounts.mutex.Lock()
+	key, secret := accounts.key, accounts.secret
+	accounts.mutex.Unlock()
+	if len(key) == 0 {
+		return errors.New("last.fm is not initialized")
+	}
+
+	api := lastfm.New(key, secret)
+	if err := api.Login(user, password); err != nil {
+		return err
+	}
+	c.saveLastFmAccount(user, api)
+	log.Println("Added Last.fm account", user)
+	return nil
+}
+
+// RemoveLastFmAccount stops scrobbling to a Last.fm account and forgets its session, removing the primary account logs out of `Cider.LastFm`
+func (c *Cider) RemoveLastFmAccount(user string) bool {
+	accounts := FujisanLastFmAccounts
+	accounts.mutex.Lock()
+	defer accounts.mutex.Unlock()
+	accounts.load()
+
+	for i, account := range accounts.accounts {
+		if account.User == user {
+			accounts.accounts = append(accounts.accounts[:i], accounts.accounts[i+1:]...)
+			accounts.save()
+			c.RemoveScrobbler(NewLastFmScrobbler(nil, user).Name())
+			// Loves, enrichment and history import read through the primary account, they stop until `Cider.InitLastFM` logs in again
+			if user == accounts.primary {
+				accounts.primary = ""
+				c.LastFm = nil
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// SetLastFmAccountEnabled toggles scrobbling to a Last.fm account without forgetting it
+func (c *Cider) SetLastFmAccountEnabled(user string, enabled bool) bool {
+	accounts := FujisanLastFmAccounts
+	accounts.mutex.Lock()
+	defer accounts.mutex.Unlock()
+	accounts.load()
+
+	account := accounts.find(user)
+	if account == nil {
+		return false
+	}
+	account.Enabled = enabled
+	accounts.save()
+	c.registerLastFmAccount(account, nil)
+	return true
+}
+
+// SetLastFmAccountFilters sets the filter rules applied to a Last.fm account on top of `connectivity.scrobbling.filters`
+func (c *Cider) SetLastFmAccountFilters(user string, filters ScrobbleFilter) bool {
+	accounts := FujisanLastFmAccounts
+	accounts.mutex.Lock()
+	defer accounts.mutex.Unlock()
+	accounts.load()
+
+	account := accounts.find(user)
+	if account == nil {
+		return false
+	}
+	account.Filters = &filters
+	accounts.save()
+	c.registerLastFmAccount(account, nil)
+	return true
+}
+
+// ListLastFmAccounts returns every Last.fm account with its submission status, session keys are left out
+func (c *Cider) ListLastFmAccounts() []LastFmAccount {
+	accounts := FujisanLastFmAccounts
+	accounts.mutex.Lock()
+	defer accounts.mutex.Unlock()
+	accounts.load()
+
+	list := []LastFmAccount{}
+	for _, account := range accounts.accounts {
+		copied := *account
+		copied.SessionKey = ""
+		list = append(list, copied)
+	}
+	return list
+}
+
+type LastFmAccountArgs struct {
+	User     string          `json:"user"`
+	Password string          `json:"password"`
+	Enabled  bool            `json:"enabled"`
+	Filters  *ScrobbleFilter `json:"filters"`
+}
+
+type LastFmAccountsType struct {
+	Accounts []LastFmAccount `json:"accounts"`
+}
+
+func (f *FujisanRpc) ListLastFmAccounts(r *http.Request, args *interface{}, result *LastFmAccountsType) error {
+	*result = LastFmAccountsType{FujisanObject.ListLastFmAccounts()}
+	return nil
+}
+
+func (f *FujisanRpc) AddLastFmAccount(r *http.Request, args *LastFmAccountArgs, result *SuccessType) error {
+	if args == nil || len(args.User) == 0 {
+		return errors.New("must pass in user")
+	}
+	if err := FujisanObject.AddLastFmAccount(args.User, args.Password); err != nil {
+		return err
+	}
+	*result = SuccessType{true}
+	return nil
+}
+
+func (f *FujisanRpc) RemoveLastFmAccount(r *http.Request, args *LastFmAccountArgs, result *SuccessType) error {
+	if args == nil {
+		return errors.New("must pass in user")
+	}
+	*result = SuccessType{FujisanObject.RemoveLastFmAccount(args.User)}
+	return nil
+}
+
+func (f *FujisanRpc) SetLastFmAccountEnabled(r *http.Request, args *LastFmAccountArgs, result *SuccessType) error {
+	if args == nil {
+		return errors.New("must pass in user")
+	}
+	*result = SuccessType{FujisanObject.SetLastFmAccountEnabled(args.User, args.Enabled)}
+	return nil
+}
+
+func (f *FujisanRpc) SetLastFmAccountFilters(r *http.Request, args *LastFmAccountArgs, result *SuccessType) error {
+	if args == nil || args.Filters == nil {
+		return errors.New("must pass in user and filters")
+	}
+	*result = SuccessType{FujisanObject.SetLastFmAccountFilters(args.User, *args.Filters)}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultListenBrainzRoot is the API root of the public ListenBrainz instance
+const DefaultListenBrainzRoot = "https://api.listenbrainz.org"
+
+// ListenBrainzScrobbler submits listens to ListenBrainz, or any server implementing its API such as Maloja
+type ListenBrainzScrobbler struct {
+	ApiRoot string
+	Token   string
+	Client  *http.Client
+}
+
+type listenBrainzTrackMetadata struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	ReleaseName    string                 `json:"release_name,omitempty"`
+	AdditionalInfo map[string]interface{} `json:"additional_info,omitempty"`
+}
+
+type listenBrainzListen struct {
+	ListenedAt    int64                     `json:"listened_at,omitempty"`
+	TrackMetadata listenBrainzTrackMetadata `json:"track_metadata"`
+}
+
+type listenBrainzSubmission struct {
+	ListenType string               `json:"listen_type"`
+	Payload    []listenBrainzListen `json:"payload"`
+}
+
+// NewListenBrainzScrobbler returns a `*ListenBrainzScrobbler` for the API root, an empty root uses `DefaultListenBrainzRoot`
+func NewListenBrainzScrobbler(apiRoot string, token string) *ListenBrainzScrobbler {
+	if len(apiRoot) == 0 {
+		apiRoot = DefaultListenBrainzRoot
+	}
+	return &ListenBrainzScrobbler{
+		ApiRoot: strings.TrimRight(apiRoot, "/"),
+		Token:   token,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (l *ListenBrainzScrobbler) Name() string {
+	host := l.ApiRoot
+	if parsed, err := url.Parse(l.ApiRoot); err == nil && len(parsed.Host) != 0 {
+		host = parsed.Host
+	}
+	return "ListenBrainz (" + host + ")"
+}
+
+// request sends an authenticated request to the API and decodes the JSON response into out when it is not nil
+func (l *ListenBrainzScrobbler) request(method string, endpoint string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequest(method, l.ApiRoot+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Token "+l.Token)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := l.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var apiError struct {
+			Code  int    `json:"code"`
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&apiError); err == nil && len(apiError.Error) != 0 {
+			return fmt.Errorf("%s: %s", response.Status, apiError.Error)
+		}
+		return errors.New(response.Status)
+	}
+
+	if out != nil {
+		return json.NewDecoder(response.Body).Decode(out)
+	}
+	return nil
+}
+
+// ValidateToken checks the token against the server and returns the user it belongs to
+func (l *ListenBrainzScrobbler) ValidateToken() (string, error) {
+	var validation struct {
+		Valid    bool   `json:"valid"`
+		Message  string `json:"message"`
+		UserName string `json:"user_name"`
+	}
+	if err := l.request("GET", "/1/validate-token", nil, &validation); err != nil {
+		return "", err
+	}
+	if !validation.Valid {
+		return "", errors.New(validation.Message)
+	}
+	return validation.UserName, nil
+}
+
+func (l *ListenBrainzScrobbler) trackMetadata(attributes Attributes) listenBrainzTrackMetadata {
+	info := map[string]interface{}{
+		"media_player":              "Cider",
+		"submission_client":         "Cider",
+		"submission_client_version": Version,
+		"music_service":             "music.apple.com",
+	}
+	if attributes.DurationInMillis > 0 {
+		info["duration_ms"] = attributes.DurationInMillis
+	}
+	if len(attributes.Isrc) != 0 {
+		info["isrc"] = attributes.Isrc
+	}
+	if attributes.TrackNumber > 0 {
+		info["tracknumber"] = attributes.TrackNumber
+	}
+	if len(attributes.URL.AppleMusic) != 0 {
+		info["origin_url"] = attributes.URL.AppleMusic
+	}
+	return listenBrainzTrackMetadata{
+		ArtistName:     attributes.ArtistName,
+		TrackName:      attributes.Name,
+		ReleaseName:    attributes.AlbumName,
+		AdditionalInfo: info,
+	}
+}
+
+func (l *ListenBrainzScrobbler) NowPlaying(attributes Attributes) error {
+	return l.request("POST", "/1/submit-listens", listenBrainzSubmission{
+		ListenType: "playing_now",
+		Payload:    []listenBrainzListen{{TrackMetadata: l.trackMetadata(attributes)}},
+	}, nil)
+}
+
+func (l *ListenBrainzScrobbler) Scrobble(attributes Attributes, timestamp time.Time) error {
+	return l.request("POST", "/1/submit-listens", listenBrainzSubmission{
+		ListenType: "single",
+		Payload: []listenBrainzListen{{
+			ListenedAt:    timestamp.Unix(),
+			TrackMetadata: l.trackMetadata(attributes),
+		}},
+	}, nil)
+}
+
+// Love looks up the MusicBrainz recording for the song and sends recording feedback for it
+func (l *ListenBrainzScrobbler) Love(attributes Attributes, love bool) error {
+	query := url.Values{}
+	query.Set("artist_name", attributes.ArtistName)
+	query.Set("recording_name", attributes.Name)
+	if len(attributes.AlbumName) != 0 {
+		query.Set("release_name", attributes.AlbumName)
+	}
+
+	var lookup struct {
+		RecordingMbid string `json:"recording_mbid"`
+	}
+	if err := l.request("GET", "/1/metadata/lookup/?"+query.Encode(), nil, &lookup); err != nil {
+		return err
+	}
+	if len(lookup.RecordingMbid) == 0 {
+		return errors.New("unable to find a recording for " + attributes.ArtistName + " - " + attributes.Name)
+	}
+
+	score := 0
+	if love {
+		score = 1
+	}
+	return l.request("POST", "/1/feedback/recording-feedback", map[string]interface{}{
+		"recording_mbid": lookup.RecordingMbid,
+		"score":          score,
+	}, nil)
+}
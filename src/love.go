@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciderapp/lastfm-go/lastfm"
+)
+
+// loveSyncStateFile stores the songs which were loved on both sides at the last sync, songs in conflict since then are kept until resolved
+const loveSyncStateFile = "love-sync.json"
+
+var loveSyncMutex sync.Mutex
+
+// LoveSyncConflict is a song whose love state differs between Apple Music and Last.fm in a way that can't be resolved automatically
+type LoveSyncConflict struct {
+	ArtistName string `json:"artistName"`
+	Name       string `json:"name"`
+	Reason     string `json:"reason"`
+}
+
+// LoveSyncReport is the outcome of `SyncLovedTracks`
+type LoveSyncReport struct {
+	LovedOnLastFm     []string           `json:"lovedOnLastFm"`
+	LovedOnAppleMusic []string           `json:"lovedOnAppleMusic"`
+	Conflicts         []LoveSyncConflict `json:"conflicts"`
+	Unmatched         []string           `json:"unmatched"`
+	Errors            []string           `json:"errors"`
+	Finished          time.Time          `json:"finished"`
+}
+
+// lovedSong is a song on either side of the sync
+type lovedSong struct {
+	ArtistName string
+	Name       string
+	CatalogId  string
+	Isrc       string
+	Rating     int
+}
+
+func (l lovedSong) String() string {
+	return l.ArtistName + " - " + l.Name
+}
+
+// loveKey matches songs by normalized artist and title
+func (c *Cider) loveKey(normalizer *MetadataNormalizer, artist string, name string) string {
+	normalized := normalizer.Normalize(Attributes{ArtistName: artist, Name: name})
+	return strings.ToLower(normalized.ArtistName) + "\x00" + strings.ToLower(normalized.Name)
+}
+
+// setLove loves or unloves the song on every scrobbler, it returns false if none of them succeeded
+func (c *Cider) setLove(attributes Attributes, love bool) bool {
+	FujisanPlaybackObject.Loved(attributes, love)
+	attributes = c.normalizeAttributes(attributes)
+	success := false
+	for _, scrobbler := range c.scrobblers() {
+		if err := scrobbler.Love(attributes, love); errors.Is(err, errLoveNotSupported) {
+			continue
+		} else if err != nil {
+			log.Println("Failed to update love on", scrobbler.Name()+".", err)
+			continue
+		}
+		success = true
+	}
+	return success
+}
+
+// LoveTrack loves the song on every scrobbler
+func (c *Cider) LoveTrack(attributes Attributes) bool {
+	return c.setLove(attributes, true)
+}
+
+// UnloveTrack unloves the song on every scrobbler
+func (c *Cider) UnloveTrack(attributes Attributes) bool {
+	return c.setLove(attributes, false)
+}
+
+// appleMusicLovedSongs returns every rated song in the users library keyed by `loveKey`
+func (c *Cider) appleMusicLovedSongs(normalizer *MetadataNormalizer) (map[string]*lovedSong, error) {
+	type libraryPage struct {
+		Next string `json:"next"`
+		Data []struct {
+			Id         string `json:"id"`
+			Attributes struct {
+				Name       string `json:"name"`
+				ArtistName string `json:"artistName"`
+				PlayParams struct {
+					CatalogId string `json:"catalogId"`
+				} `json:"playParams"`
+			} `json:"attributes"`
+			Relationships struct {
+				Catalog struct {
+					Data []struct {
+						Id         string `json:"id"`
+						Attributes struct {
+							Isrc string `json:"isrc"`
+						} `json:"attributes"`
+					} `json:"data"`
+				} `json:"catalog"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	type ratingsPage struct {
+		Data []struct {
+			Id         string `json:"id"`
+			Attributes struct {
+				Value int `json:"value"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+
+	songs := make(map[string]*lovedSong)
+	next := "/v1/me/library/songs?limit=100&include=catalog"
+	for len(next) != 0 {
+		page := new(libraryPage)
+		if err := c.musicKitRequest("GET", next, nil, page); err != nil {
+			return nil, err
+		}
+		next = page.Next
+
+		var ids []string
+		library := make(map[string]*lovedSong)
+		for _, data := range page.Data {
+			song := &lovedSong{
+				ArtistName: data.Attributes.ArtistName,
+				Name:       data.Attributes.Name,
+				CatalogId:  data.Attributes.PlayParams.CatalogId,
+			}
+			if len(data.Relationships.Catalog.Data) != 0 {
+				song.CatalogId = data.Relationships.Catalog.Data[0].Id
+				song.Isrc = data.Relationships.Catalog.Data[0].Attributes.Isrc
+			}
+			library[data.Id] = song
+			ids = append(ids, data.Id)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		ratings := new(ratingsPage)
+		if err := c.musicKitRequest("GET", "/v1/me/ratings/library-songs?ids="+strings.Join(ids, ","), nil, ratings); err != nil {
+			return nil, err
+		}
+		for _, rating := range ratings.Data {
+			if song, ok := library[rating.Id]; ok {
+				song.Rating = rating.Attributes.Value
+			}
+		}
+		for _, song := range library {
+			songs[c.loveKey(normalizer, song.ArtistName, song.Name)] = song
+		}
+	}
+	return songs, nil
+}
+
+// lastFmLovedSongs returns every loved track of the user of a Last.fm scrobbler keyed by `loveKey`
+func (c *Cider) lastFmLovedSongs(normalizer *MetadataNormalizer, scrobbler *LastFmScrobbler) (map[string]*lovedSong, error) {
+	songs := make(map[string]*lovedSong)
+	for page, totalPages := 1, 1; page <= totalPages; page++ {
+		loved, err := scrobbler.Api.User.GetLovedTracks(lastfm.P{"user": scrobbler.User, "limit": 200, "page": page})
+		if err != nil {
+			return nil, err
+		}
+		totalPages = loved.TotalPages
+		for _, track := range loved.Tracks {
+			songs[c.loveKey(normalizer, track.Artist.Name, track.Name)] = &lovedSong{ArtistName: track.Artist.Name, Name: track.Name, Rating: 1}
+		}
+	}
+	return songs, nil
+}
+
+// findAppleMusicSong searches the catalog for a Last.fm track, matching by artist and title first and by ISRC against the library second
+func (c *Cider) findAppleMusicSong(normalizer *MetadataNormalizer, storefront string, song *lovedSong, library map[string]*lovedSong) (*lovedSong, error) {
+	var search struct {
+		Results struct {
+			Songs struct {
+				Data []struct {
+					Id         string `json:"id"`
+					Attributes struct {
+						Name       string `json:"name"`
+						ArtistName string `json:"artistName"`
+						Isrc       string `json:"isrc"`
+					} `json:"attributes"`
+				} `json:"data"`
+			} `json:"songs"`
+		} `json:"results"`
+	}
+	term := url.QueryEscape(song.ArtistName + " " + song.Name)
+	if err := c.musicKitRequest("GET", fmt.Sprintf("/v1/catalog/%s/search?types=songs&limit=10&term=%s", storefront, term), nil, &search); err != nil {
+		return nil, err
+	}
+
+	key := c.loveKey(normalizer, song.ArtistName, song.Name)
+	for _, result := range search.Results.Songs.Data {
+		if c.loveKey(normalizer, result.Attributes.ArtistName, result.Attributes.Name) == key {
+			return &lovedSong{ArtistName: result.Attributes.ArtistName, Name: result.Attributes.Name, CatalogId: result.Id, Isrc: result.Attributes.Isrc}, nil
+		}
+	}
+	for _, result := range search.Results.Songs.Data {
+		if len(result.Attributes.Isrc) == 0 {
+			continue
+		}
+		for _, librarySong := range library {
+			if librarySong.Isrc == result.Attributes.Isrc {
+				return librarySong, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// SyncLovedTracks makes Apple Music love ratings and Last.fm loved tracks consistent in both directions.
+// Songs which were unloved on one side since the last sync, or are disliked on Apple Music, are reported as conflicts instead of being changed
+func (c *Cider) SyncLovedTracks() LoveSyncReport {
+	report := LoveSyncReport{}
+	if !loveSyncMutex.TryLock() {
+		report.Errors = append(report.Errors, "a sync is already running")
+		return report
+	}
+	defer loveSyncMutex.Unlock()
+
+	scrobbler := c.lastFmScrobbler()
+	if scrobbler == nil {
+		report.Errors = append(report.Errors, "last.fm is not initialized")
+		return report
+	}
+	if err := scrobbler.checkToken(); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+
+	normalizer := c.normalizer()
+
+	appleMusic, err := c.appleMusicLovedSongs(normalizer)
+	if err != nil {
+		report.Errors = append(report.Errors, "unable to read Apple Music ratings: "+err.Error())
+		return report
+	}
+	lastFm, err := c.lastFmLovedSongs(normalizer, scrobbler)
+	if err != nil {
+		report.Errors = append(report.Errors, "unable to read Last.fm loved tracks: "+err.Error())
+		return report
+	}
+
+	previous := make(map[string]bool)
+	if state := FujisanIOObject.ReadFile(loveSyncStateFile); len(state) != 0 {
+		if err := json.Unmarshal([]byte(state), &previous); err != nil {
+			log.Println("Unable to read love sync state:", err)
+		}
+	}
+	// synced is the state for the next sync, songs in conflict keep their last known state until the user resolves them
+	// so an unlove on one side is never undone by loving the song again
+	synced := make(map[string]bool)
+
+	for key, song := range appleMusic {
+		if song.Rating != 1 {
+			continue
+		}
+		if _, ok := lastFm[key]; ok {
+			synced[key] = true
+			continue
+		}
+		if previous[key] {
+			report.Conflicts = append(report.Conflicts, LoveSyncConflict{song.ArtistName, song.Name, "unloved on Last.fm since the last sync but still loved on Apple Music"})
+			synced[key] = true
+			continue
+		}
+		if err := scrobbler.Love(Attributes{ArtistName: song.ArtistName, Name: song.Name}, true); err != nil {
+			report.Errors = append(report.Errors, song.String()+": "+err.Error())
+			continue
+		}
+		report.LovedOnLastFm = append(report.LovedOnLastFm, song.String())
+		synced[key] = true
+	}
+
+	storefront := c.storefront()
+	for key, song := range lastFm {
+		librarySong, inLibrary := appleMusic[key]
+		if inLibrary && librarySong.Rating == 1 {
+			continue
+		}
+		if inLibrary && librarySong.Rating == -1 {
+			report.Conflicts = append(report.Conflicts, LoveSyncConflict{song.ArtistName, song.Name, "loved on Last.fm but disliked on Apple Music"})
+			synced[key] = previous[key]
+			continue
+		}
+		if previous[key] {
+			report.Conflicts = append(report.Conflicts, LoveSyncConflict{song.ArtistName, song.Name, "unloved on Apple Music since the last sync but still loved on Last.fm"})
+			synced[key] = true
+			continue
+		}
+
+		match := librarySong
+		if !inLibrary || len(match.CatalogId) == 0 {
+			match, err = c.findAppleMusicSong(normalizer, storefront, song, appleMusic)
+			if err != nil {
+				report.Errors = append(report.Errors, song.String()+": "+err.Error())
+				continue
+			}
+			if match == nil || len(match.CatalogId) == 0 {
+				report.Unmatched = append(report.Unmatched, song.String())
+				continue
+			}
+			if match.Rating == -1 {
+				report.Conflicts = append(report.Conflicts, LoveSyncConflict{song.ArtistName, song.Name, "loved on Last.fm but disliked on Apple Music"})
+				synced[key] = previous[key]
+				continue
+			}
+			if match.Rating == 1 {
+				// Matched a loved library song by ISRC under a different title
+				synced[key] = true
+				continue
+			}
+		}
+
+		if err := c.musicKitRequest("PUT", "/v1/me/ratings/songs/"+match.CatalogId, map[string]interface{}{
+			"type":       "rating",
+			"attributes": map[string]interface{}{"value": 1},
+		}, nil); err != nil {
+			report.Errors = append(report.Errors, song.String()+": "+err.Error())
+			continue
+		}
+		report.LovedOnAppleMusic = append(report.LovedOnAppleMusic, song.String())
+		synced[key] = true
+	}
+
+	for key, loved := range synced {
+		if !loved {
+			delete(synced, key)
+		}
+	}
+	if state, err := json.Marshal(synced); err == nil {
+		FujisanIOObject.WriteFile(loveSyncStateFile, string(state))
+	}
+	report.Finished = time.Now()
+	log.Printf("Love sync finished: %d loved on Last.fm, %d loved on Apple Music, %d conflicts, %d unmatched", len(report.LovedOnLastFm), len(report.LovedOnAppleMusic), len(report.Conflicts), len(report.Unmatched))
+	return report
+}
+
+type LoveArgs struct {
+	Love       bool        `json:"love"`
+	Attributes *Attributes `json:"attributes"`
+}
+
+// LoveTrack loves or unloves the given song, or the currently playing song when no attributes are passed
+func (f *FujisanRpc) LoveTrack(r *http.Request, args *LoveArgs, result *SuccessType) error {
+	if args == nil {
+		return errors.New("must pass in love")
+	}
+	var attributes Attributes
+	if args.Attributes != nil {
+		attributes = *args.Attributes
+	} else {
+		current, err := FujisanObject.currentAttributes()
+		if err != nil {
+			return err
+		}
+		attributes = current
+	}
+	*result = SuccessType{FujisanObject.setLove(attributes, args.Love)}
+	return nil
+}
+
+func (f *FujisanRpc) SyncLovedTracks(r *http.Request, args *interface{}, result *LoveSyncReport) error {
+	*result = FujisanObject.SyncLovedTracks()
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttQos byte = 1
+
+// MqttTLSConfig configures TLS for `ssl://` and `wss://` brokers, the system roots are used without a CA file
+type MqttTLSConfig struct {
+	CAFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// MqttConfig is read from `connectivity.mqtt`
+type MqttConfig struct {
+	Enabled         bool          `json:"enabled"`
+	Broker          string        `json:"broker"`
+	ClientId        string        `json:"clientId"`
+	Username        string        `json:"username"`
+	Password        string        `json:"password"`
+	TopicPrefix     string        `json:"topicPrefix"`
+	TLS             MqttTLSConfig `json:"tls"`
+	Discovery       bool          `json:"discovery"`
+	DiscoveryPrefix string        `json:"discoveryPrefix"`
+}
+
+// mqttConfig reads the MQTT options with their defaults
+func (c *Cider) mqttConfig() MqttConfig {
+	hostname, _ := os.Hostname()
+	config := MqttConfig{
+		Broker:          "tcp://localhost:1883",
+		ClientId:        "cider-" + strings.ToLower(hostname),
+		TopicPrefix:     "cider",
+		Discovery:       true,
+		DiscoveryPrefix: "homeassistant",
+	}
+	if err := decodeConfig(loadConfig(), "connectivity.mqtt", &config); err != nil {
+		log.Println("Unable to read MQTT options:", err)
+	}
+	config.TopicPrefix = strings.Trim(config.TopicPrefix, "/")
+	return config
+}
+
+// tlsConfig builds the TLS configuration of the broker connection
+func (m MqttTLSConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: m.InsecureSkipVerify}
+	if len(m.CAFile) != 0 {
+		pem, err := os.ReadFile(m.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", m.CAFile)
+		}
+	}
+	if len(m.CertFile) != 0 {
+		certificate, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// MqttStatus reports the broker connection
+type MqttStatus struct {
+	Enabled   bool   `json:"enabled"`
+	Connected bool   `json:"connected"`
+	Broker    string `json:"broker"`
+	LastError string `json:"lastError"`
+}
+
+// MqttPublisher publishes the playback state to an MQTT broker and runs the commands received on `<prefix>/command/<action>`.
+// Availability is published on `<prefix>/availability` with a last will, so it reads `offline` when Cider goes away
+type MqttPublisher struct {
+	client      mqtt.Client
+	config      MqttConfig
+	unsubscribe func()
+	lastError   string
+	mutex       sync.Mutex
+}
+
+// topic returns a topic below the configured prefix
+func (m MqttConfig) topic(parts ...string) string {
+	return m.TopicPrefix + "/" + strings.Join(parts, "/")
+}
+
+// current returns the client and the config it was started with
+func (m *MqttPublisher) current() (mqtt.Client, MqttConfig) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.client, m.config
+}
+
+// setError records the last connection error
+func (m *MqttPublisher) setError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err != nil {
+		m.lastError = err.Error()
+	} else {
+		m.lastError = ""
+	}
+}
+
+// Start connects to the broker when MQTT is enabled, replacing any previous connection
+func (m *MqttPublisher) Start(config MqttConfig) error {
+	m.Stop()
+	if !config.Enabled {
+		return nil
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientId).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(time.Minute)
+	if strings.HasPrefix(config.Broker, "ssl://") || strings.HasPrefix(config.Broker, "tls://") ||
+		strings.HasPrefix(config.Broker, "mqtts://") || strings.HasPrefix(config.Broker, "wss://") {
+		tlsConfig, err := config.TLS.tlsConfig()
+		if err != nil {
+			m.setError(err)
+			return err
+		}
+		options.SetTLSConfig(tlsConfig)
+	}
+
+	m.mutex.Lock()
+	m.config = config
+	m.lastError = ""
+	options.SetWill(config.topic("availability"), "offline", mqttQos, true)
+	options.SetOnConnectHandler(func(client mqtt.Client) {
+		m.onConnect(client, config)
+	})
+	options.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Println("Lost connection to MQTT broker:", err)
+		m.setError(err)
+	})
+	m.client = mqtt.NewClient(options)
+	m.unsubscribe = FujisanPlaybackObject.Subscribe(m.handleEvent)
+	client := m.client
+	m.mutex.Unlock()
+
+	// The token only completes once connected since the connection is retried in the background
+	client.Connect()
+	log.Println("Connecting to MQTT broker", config.Broker)
+	return nil
+}
+
+// Stop publishes `offline` and disconnects from the broker
+func (m *MqttPublisher) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.unsubscribe != nil {
+		m.unsubscribe()
+		m.unsubscribe = nil
+	}
+	if m.client != nil {
+		if m.client.IsConnected() {
+			m.client.Publish(m.config.topic("availability"), mqttQos, true, "offline").WaitTimeout(time.Second)
+		}
+		m.client.Disconnect(250)
+		m.client = nil
+	}
+}
+
+// Status returns the state of the broker connection
+func (m *MqttPublisher) Status() MqttStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return MqttStatus{
+		Enabled:   m.client != nil,
+		Connected: m.client != nil && m.client.IsConnected(),
+		Broker:    m.config.Broker,
+		LastError: m.lastError,
+	}
+}
+
+// publish sends a message, payloads other than strings are sent as JSON
+func (m *MqttPublisher) publish(client mqtt.Client, topic string, retained bool, payload interface{}) {
+	if _, ok := payload.(string); !ok {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			log.Println("Unable to encode MQTT payload:", err)
+			return
+		}
+		payload = b
+	}
+	token := client.Publish(topic, mqttQos, retained, payload)
+	go func() {
+		if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			log.Println("Failed to publish to", topic+":", token.Error())
+		}
+	}()
+}
+
+// onConnect announces availability, subscribes to the command topics and publishes the current state, it runs on every reconnect.
+// config is the one the client was started with, `m.config` may already belong to a newer client
+func (m *MqttPublisher) onConnect(client mqtt.Client, config MqttConfig) {
+	m.setError(nil)
+	log.Println("Connected to MQTT broker")
+	m.publish(client, config.topic("availability"), true, "online")
+	client.Subscribe(config.topic("command", "+"), mqttQos, func(client mqtt.Client, message mqtt.Message) {
+		m.handleCommand(client, config, message)
+	})
+	if config.Discovery {
+		m.publishDiscovery(client, config)
+	}
+	m.publishState(client, config, FujisanPlaybackObject.State())
+}
+
+// handleEvent publishes the state after every playback change
+func (m *MqttPublisher) handleEvent(event PlaybackEvent) {
+	client, config := m.current()
+	if client == nil || !client.IsConnected() {
+		return
+	}
+	switch event.Kind {
+	case PlaybackScrobble, PlaybackLove, PlaybackUnlove:
+		m.publish(client, config.topic("event", string(event.Kind)), false, event.Attributes)
+	default:
+		m.publishState(client, config, event.State)
+	}
+}
+
+// mqttState is the payload of `<prefix>/state`
+type mqttState struct {
+	State    string  `json:"state"`
+	Name     string  `json:"name"`
+	Artist   string  `json:"artist"`
+	Album    string  `json:"album"`
+	Artwork  string  `json:"artwork"`
+	Duration float64 `json:"duration"`
+	Position float64 `json:"position"`
+}
+
+// publishState publishes the retained state and attributes of the current song
+func (m *MqttPublisher) publishState(client mqtt.Client, config MqttConfig, state PlaybackState) {
+	attributes := FujisanObject.normalizeAttributes(state.Attributes)
+	payload := mqttState{
+		State:    "idle",
+		Name:     attributes.Name,
+		Artist:   attributes.ArtistName,
+		Album:    attributes.AlbumName,
+		Artwork:  FujisanObject.SetImageResolution(512, 512, attributes.Artwork.URL),
+		Duration: float64(attributes.DurationInMillis) / 1000,
+		Position: state.CurrentPosition(),
+	}
+	if len(attributes.Name) != 0 {
+		payload.State = "paused"
+		if state.Playing {
+			payload.State = "playing"
+		}
+	}
+	m.publish(client, config.topic("state"), true, payload)
+	m.publish(client, config.topic("attributes"), true, state.Attributes)
+}
+
+// handleCommand maps `<prefix>/command/<action>` to the matching RPC method
+func (m *MqttPublisher) handleCommand(client mqtt.Client, config MqttConfig, message mqtt.Message) {
+	action := message.Topic()[strings.LastIndex(message.Topic(), "/")+1:]
+	payload := strings.TrimSpace(string(message.Payload()))
+	var result RpcType
+	var empty interface{}
+	var err error
+
+	switch action {
+	case "play":
+		err = FujisanRpcObject.Play(nil, nil, &result)
+	case "pause":
+		err = FujisanRpcObject.Pause(nil, nil, &result)
+	case "playpause":
+		err = FujisanRpcObject.PlayPause(nil, nil, &result)
+	case "stop":
+		err = FujisanRpcObject.Stop(nil, nil, &empty)
+	case "next":
+		err = FujisanRpcObject.Next(nil, nil, &empty)
+	case "previous":
+		err = FujisanRpcObject.Previous(nil, nil, &empty)
+	case "volume":
+		// The volume is a percentage like the volume number of Home Assistant
+		var volume float64
+		if volume, err = strconv.ParseFloat(payload, 64); err == nil {
+			if volume < 0 || volume > 100 {
+				err = fmt.Errorf("volume %v must be between 0 and 100", volume)
+			} else if err = FujisanRpcObject.SetVolume(nil, &VolumeArgs{volume / 100}, &empty); err == nil {
+				m.publish(client, config.topic("volume"), true, strconv.Itoa(int(volume+0.5)))
+			}
+		}
+	case "seek":
+		var second float64
+		if second, err = strconv.ParseFloat(payload, 64); err == nil {
+			err = FujisanRpcObject.SeekTo(nil, &SeekToArgs{int(second)}, &empty)
+		}
+	default:
+		err = errors.New("unknown command")
+	}
+	if err != nil {
+		log.Println("Failed to run MQTT command", action+":", err)
+	}
+}
+
+// publishDiscovery announces the entities of Cider to Home Assistant. MQTT discovery has no media player platform,
+// so playback is exposed as sensors, buttons and a volume number grouped under one Cider device
+func (m *MqttPublisher) publishDiscovery(client mqtt.Client, config MqttConfig) {
+	id := strings.NewReplacer(" ", "_", "/", "_", "+", "_", "#", "_").Replace(config.ClientId)
+	device := map[string]interface{}{
+		"identifiers":  []string{id},
+		"name":         "Cider",
+		"manufacturer": "Cider Collective",
+		"model":        "Cider",
+		"sw_version":   Version,
+	}
+	entity := func(component string, object string, entity map[string]interface{}) {
+		entity["unique_id"] = id + "_" + object
+		entity["object_id"] = "cider_" + object
+		entity["device"] = device
+		entity["availability_topic"] = config.topic("availability")
+		m.publish(client, strings.Join([]string{config.DiscoveryPrefix, component, id, object, "config"}, "/"), true, entity)
+	}
+
+	entity("sensor", "now_playing", map[string]interface{}{
+		"name":                  "Now playing",
+		"icon":                  "mdi:music",
+		"state_topic":           config.topic("state"),
+		"value_template":        "{{ value_json.artist ~ ' - ' ~ value_json.name if value_json.name else 'Nothing' }}",
+		"json_attributes_topic": config.topic("attributes"),
+	})
+	entity("sensor", "state", map[string]interface{}{
+		"name":           "Playback state",
+		"icon":           "mdi:play-pause",
+		"state_topic":    config.topic("state"),
+		"value_template": "{{ value_json.state }}",
+	})
+	for _, button := range []struct{ action, name, icon string }{
+		{"play", "Play", "mdi:play"},
+		{"pause", "Pause", "mdi:pause"},
+		{"next", "Next", "mdi:skip-next"},
+		{"previous", "Previous", "mdi:skip-previous"},
+	} {
+		entity("button", button.action, map[string]interface{}{
+			"name":          button.name,
+			"icon":          button.icon,
+			"command_topic": config.topic("command", button.action),
+		})
+	}
+	entity("number", "volume", map[string]interface{}{
+		"name":          "Volume",
+		"icon":          "mdi:volume-high",
+		"command_topic": config.topic("command", "volume"),
+		"state_topic":   config.topic("volume"),
+		"min":           0,
+		"max":           100,
+		"step":          1,
+		"mode":          "slider",
+	})
+}
+
+// StartMqtt connects to the MQTT broker configured in `connectivity.mqtt`, it can be called again after the config changed
+func (c *Cider) StartMqtt() error {
+	return FujisanMqttObject.Start(c.mqttConfig())
+}
+
+func (f *FujisanRpc) StartMqtt(r *http.Request, args *interface{}, result *SuccessType) error {
+	if err := FujisanObject.StartMqtt(); err != nil {
+		return err
+	}
+	*result = SuccessType{true}
+	return nil
+}
+
+func (f *FujisanRpc) GetMqttStatus(r *http.Request, args *interface{}, result *MqttStatus) error {
+	*result = FujisanMqttObject.Status()
+	return nil
+}
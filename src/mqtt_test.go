@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// mqttBroker is a minimal MQTT 3.1.1 broker embedded in the tests, it records what the client connects and publishes with
+type mqttBroker struct {
+	listener   net.Listener
+	connect    *packets.ConnectPacket
+	published  []*packets.PublishPacket
+	subscribed []string
+	conn       net.Conn
+	t          *testing.T
+	mutex      sync.Mutex
+}
+
+func newMqttBroker(t *testing.T) *mqttBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &mqttBroker{listener: listener, t: t}
+	t.Cleanup(func() {
+		listener.Close()
+		broker.mutex.Lock()
+		if broker.conn != nil {
+			broker.conn.Close()
+		}
+		broker.mutex.Unlock()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			broker.mutex.Lock()
+			broker.conn = conn
+			broker.mutex.Unlock()
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *mqttBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// serve answers the packets of a client, the replies are written under the lock so `send` can't interleave with them
+func (b *mqttBroker) serve(conn net.Conn) {
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		b.mutex.Lock()
+		switch packet := packet.(type) {
+		case *packets.ConnectPacket:
+			b.connect = packet
+			connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			connack.ReturnCode = packets.Accepted
+			connack.Write(conn)
+		case *packets.PublishPacket:
+			b.published = append(b.published, packet)
+			if packet.Qos == 1 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = packet.MessageID
+				puback.Write(conn)
+			}
+		case *packets.SubscribePacket:
+			b.subscribed = append(b.subscribed, packet.Topics...)
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = packet.MessageID
+			suback.ReturnCodes = packet.Qoss
+			suback.Write(conn)
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// send publishes a message to the client
+func (b *mqttBroker) send(topic string, payload string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Payload = []byte(payload)
+	if err := publish.Write(b.conn); err != nil {
+		b.t.Error(err)
+	}
+}
+
+// messages returns the payloads published on a topic so far
+func (b *mqttBroker) messages(topic string) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var payloads []string
+	for _, packet := range b.published {
+		if packet.TopicName == topic {
+			payloads = append(payloads, string(packet.Payload))
+		}
+	}
+	return payloads
+}
+
+// waitFor polls condition until it holds
+func (b *mqttBroker) waitFor(what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			b.t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startTestMqtt(t *testing.T, broker *mqttBroker) *MqttPublisher {
+	publisher := new(MqttPublisher)
+	err := publisher.Start(MqttConfig{
+		Enabled:         true,
+		Broker:          broker.url(),
+		ClientId:        "cider-test",
+		TopicPrefix:     "cider",
+		Discovery:       true,
+		DiscoveryPrefix: "homeassistant",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(publisher.Stop)
+	broker.waitFor("the command subscription", func() bool {
+		broker.mutex.Lock()
+		defer broker.mutex.Unlock()
+		return len(broker.subscribed) != 0
+	})
+	return publisher
+}
+
+func TestMqttConnect(t *testing.T) {
+	broker := newMqttBroker(t)
+	publisher := startTestMqtt(t, broker)
+
+	broker.mutex.Lock()
+	connect, subscribed := broker.connect, broker.subscribed
+	broker.mutex.Unlock()
+	if connect.ClientIdentifier != "cider-test" || !connect.WillFlag || !connect.WillRetain || connect.WillTopic != "cider/availability" || string(connect.WillMessage) != "offline" {
+		t.Errorf("unexpected connect %v", connect)
+	}
+	if len(subscribed) != 1 || subscribed[0] != "cider/command/+" {
+		t.Errorf("unexpected subscriptions %v", subscribed)
+	}
+
+	broker.waitFor("the state", func() bool { return len(broker.messages("cider/state")) != 0 })
+	if online := broker.messages("cider/availability"); len(online) != 1 || online[0] != "online" {
+		t.Errorf("unexpected availability %v", online)
+	}
+	if len(broker.messages("homeassistant/number/cider-test/volume/config")) != 1 {
+		t.Error("the volume entity was not announced")
+	}
+	if status := publisher.Status(); !status.Connected || status.Broker != broker.url() {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	publisher.Stop()
+	if availability := broker.messages("cider/availability"); availability[len(availability)-1] != "offline" {
+		t.Errorf("stopping didn't publish offline, got %v", availability)
+	}
+}
+
+func TestMqttVolumeCommand(t *testing.T) {
+	broker := newMqttBroker(t)
+	startTestMqtt(t, broker)
+
+	// Out of range volumes are rejected rather than taken as a fraction or clamped
+	broker.send("cider/command/volume", "150")
+	broker.send("cider/command/volume", "-1")
+	broker.send("cider/command/volume", "1")
+	broker.waitFor("the volume", func() bool { return len(broker.messages("cider/volume")) != 0 })
+	broker.send("cider/command/volume", "40")
+	broker.waitFor("the second volume", func() bool { return len(broker.messages("cider/volume")) > 1 })
+
+	if volumes := broker.messages("cider/volume"); len(volumes) != 2 || volumes[0] != "1" || volumes[1] != "40" {
+		t.Fatalf("unexpected volumes %v", volumes)
+	}
+}
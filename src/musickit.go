@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// musicKitRequest calls an Apple Music API endpoint through `FujisanRpc.MusicKit`, encoding body and decoding the response into out when they are not nil
+func (c *Cider) musicKitRequest(method string, endpoint string, body interface{}, out interface{}) error {
+	args := &MusicKitArgs{Method: method, Endpoint: endpoint}
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		args.Body = string(encoded)
+	}
+
+	ret := new(EndpointReturn)
+	if err := FujisanRpcObject.MusicKit(nil, args, ret); err != nil {
+		return err
+	}
+	if ret.Status < 200 || ret.Status > 299 {
+		return fmt.Errorf("%s %s returned %d", method, endpoint, ret.Status)
+	}
+	if out != nil && len(ret.Body) != 0 {
+		return json.Unmarshal(ret.Body, out)
+	}
+	return nil
+}
+
+// currentAttributes returns the attributes of the song MusicKit is currently playing
+func (c *Cider) currentAttributes() (Attributes, error) {
+	var attributes Attributes
+	output := FujisanRpcObject.ExecuteAndReceiveJS("MusicKit.getInstance().nowPlayingItem.attributes")
+	if output == nil || output == "" {
+		return attributes, fmt.Errorf("nothing is playing")
+	}
+	encoded, err := json.Marshal(output)
+	if err != nil {
+		return attributes, err
+	}
+	err = json.Unmarshal(encoded, &attributes)
+	return attributes, err
+}
+
+// storefront returns the storefront of the signed in Apple Music user, defaulting to `us`
+func (c *Cider) storefront() string {
+	if storefront, ok := FujisanRpcObject.ExecuteAndReceiveJS("MusicKit.getInstance().storefrontId").(string); ok && len(storefront) != 0 {
+		return storefront
+	}
+	return "us"
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	// "Song (Remastered 2011)", "Album [Deluxe Edition]"
+	editionParenRegex = regexp.MustCompile(`(?i)\s*[(\[][^()\[\]]*\b(remaster(ed)?|deluxe|expanded|anniversary|edition|bonus tracks?)\b[^()\[\]]*[)\]]`)
+	// "Song - Remastered 2011", "Song - 2011 Remaster"
+	editionDashRegex = regexp.MustCompile(`(?i)\s+-\s+[^-]*\b(remaster(ed)?|deluxe|expanded|anniversary|edition)\b[^-]*$`)
+	// "Album - Single", "Album - EP"
+	singleSuffixRegex = regexp.MustCompile(`(?i)\s+-\s+(single|ep)$`)
+	// "Artist feat. Featured", "Artist ft. Featured", "Artist featuring Featured"
+	featuringArtistRegex = regexp.MustCompile(`(?i)^(.+?)\s+(?:feat\.?|ft\.?|featuring)\s+(.+)$`)
+	// "Artist & Featured", "Artist, Featured & Other"
+	splitArtistRegex    = regexp.MustCompile(`^(.+?)(?:,\s+|\s+&\s+)(.+)$`)
+	featuringTitleRegex = regexp.MustCompile(`(?i)[(\[]\s*(feat\.?|ft\.?|featuring|with)\s`)
+)
+
+// NormalizationRewrite rewrites a field with a regular expression, Field is one of `artistName`, `name` or `albumName`
+type NormalizationRewrite struct {
+	Field   string `json:"field"`
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+
+	expression *regexp.Regexp
+}
+
+// ArtistOverride replaces the artist name of a specific artist, and optionally turns off the built-in rules for them
+type ArtistOverride struct {
+	Artist       string `json:"artist"`
+	Name         string `json:"name"`
+	SkipBuiltins bool   `json:"skipBuiltins"`
+}
+
+// MetadataNormalizer cleans up Apple Music metadata before it is scrobbled, queried or shown in presence, it is read from `connectivity.normalization`
+type MetadataNormalizer struct {
+	StripEditions     bool                   `json:"stripEditions"`
+	StripSingleSuffix bool                   `json:"stripSingleSuffix"`
+	ExtractFeaturing  bool                   `json:"extractFeaturing"`
+	SplitArtists      bool                   `json:"splitArtists"`
+	Rewrites          []NormalizationRewrite `json:"rewrites"`
+	Overrides         []ArtistOverride       `json:"overrides"`
+}
+
+// Compile prepares the rewrite patterns once so `Normalize` doesn't compile them for every song
+func (m *MetadataNormalizer) Compile() *MetadataNormalizer {
+	for i := range m.Rewrites {
+		expression, err := regexp.Compile(m.Rewrites[i].Pattern)
+		if err != nil {
+			log.Println("Invalid normalization pattern", m.Rewrites[i].Pattern+":", err)
+			continue
+		}
+		m.Rewrites[i].expression = expression
+	}
+	return m
+}
+
+// NewMetadataNormalizer returns a `*MetadataNormalizer` with the default built-in rules enabled
+func NewMetadataNormalizer() *MetadataNormalizer {
+	return &MetadataNormalizer{
+		StripEditions:     true,
+		StripSingleSuffix: true,
+		ExtractFeaturing:  true,
+	}
+}
+
+// moveFeaturing moves secondary artists out of the artist name and into the title as `(feat. ...)`
+func (m *MetadataNormalizer) moveFeaturing(attributes *Attributes, expression *regexp.Regexp) {
+	match := expression.FindStringSubmatch(attributes.ArtistName)
+	if match == nil {
+		return
+	}
+	attributes.ArtistName = strings.TrimSpace(match[1])
+	if !featuringTitleRegex.MatchString(attributes.Name) {
+		attributes.Name = attributes.Name + " (feat. " + strings.TrimSpace(match[2]) + ")"
+	}
+}
+
+// Normalize returns a copy of the attributes with every enabled rule applied
+func (m *MetadataNormalizer) Normalize(attributes Attributes) Attributes {
+	builtins := true
+	for _, override := range m.Overrides {
+		if strings.EqualFold(override.Artist, attributes.ArtistName) {
+			if len(override.Name) != 0 {
+				attributes.ArtistName = override.Name
+			}
+			builtins = !override.SkipBuiltins
+			break
+		}
+	}
+
+	if builtins {
+		if m.StripEditions {
+			attributes.Name = editionDashRegex.ReplaceAllString(editionParenRegex.ReplaceAllString(attributes.Name, ""), "")
+			attributes.AlbumName = editionDashRegex.ReplaceAllString(editionParenRegex.ReplaceAllString(attributes.AlbumName, ""), "")
+		}
+		if m.StripSingleSuffix {
+			attributes.AlbumName = singleSuffixRegex.ReplaceAllString(attributes.AlbumName, "")
+		}
+		if m.ExtractFeaturing {
+			m.moveFeaturing(&attributes, featuringArtistRegex)
+		}
+		if m.SplitArtists {
+			m.moveFeaturing(&attributes, splitArtistRegex)
+		}
+	}
+
+	for _, rewrite := range m.Rewrites {
+		expression := rewrite.expression
+		if expression == nil {
+			var err error
+			if expression, err = regexp.Compile(rewrite.Pattern); err != nil {
+				continue
+			}
+		}
+		switch rewrite.Field {
+		case "artistName":
+			attributes.ArtistName = expression.ReplaceAllString(attributes.ArtistName, rewrite.Replace)
+		case "albumName":
+			attributes.AlbumName = expression.ReplaceAllString(attributes.AlbumName, rewrite.Replace)
+		case "name":
+			attributes.Name = expression.ReplaceAllString(attributes.Name, rewrite.Replace)
+		default:
+			log.Println("Unknown normalization field", rewrite.Field)
+		}
+	}
+
+	attributes.ArtistName = strings.TrimSpace(attributes.ArtistName)
+	attributes.AlbumName = strings.TrimSpace(attributes.AlbumName)
+	attributes.Name = strings.TrimSpace(attributes.Name)
+	return attributes
+}
+
+// normalizer returns the normalization rules of the config, they are decoded and compiled once per config change
+func (c *Cider) normalizer() *MetadataNormalizer {
+	return configDerived("connectivity.normalization", func(config map[string]interface{}) interface{} {
+		normalizer := NewMetadataNormalizer()
+		if err := decodeConfig(config, "connectivity.normalization", normalizer); err != nil {
+			log.Println("Unable to read normalization rules:", err)
+		}
+		return normalizer.Compile()
+	}).(*MetadataNormalizer)
+}
+
+// normalizeAttributes applies the configured normalization rules to the attributes
+func (c *Cider) normalizeAttributes(attributes Attributes) Attributes {
+	return c.normalizer().Normalize(attributes)
+}
+
+type NormalizePreviewType struct {
+	ArtistName string `json:"artistName"`
+	Name       string `json:"name"`
+	AlbumName  string `json:"albumName"`
+	Changed    bool   `json:"changed"`
+}
+
+// NormalizePreview returns what the given song looks like after normalization
+func (f *FujisanRpc) NormalizePreview(r *http.Request, args *Attributes, result *NormalizePreviewType) error {
+	if args == nil {
+		return errors.New("must pass in song attributes")
+	}
+	normalized := FujisanObject.normalizeAttributes(*args)
+	*result = NormalizePreviewType{
+		ArtistName: normalized.ArtistName,
+		Name:       normalized.Name,
+		AlbumName:  normalized.AlbumName,
+		Changed:    normalized.ArtistName != args.ArtistName || normalized.Name != args.Name || normalized.AlbumName != args.AlbumName,
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NowPlayingConfig is read from `connectivity.nowPlaying`, an empty file name turns that output off
+type NowPlayingConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Directory string `json:"directory"`
+	// Template uses the status template syntax of Discord presence
+	Template    string `json:"template"`
+	TextFile    string `json:"textFile"`
+	JsonFile    string `json:"jsonFile"`
+	ArtworkFile string `json:"artworkFile"`
+	ArtworkSize int    `json:"artworkSize"`
+}
+
+// nowPlayingConfig reads the now playing outputs with their defaults
+func (c *Cider) nowPlayingConfig() NowPlayingConfig {
+	config := NowPlayingConfig{
+		Directory:   filepath.Join(FujisanIOObject.GetConfigPath(), "now-playing"),
+		Template:    "{artist} - {name}",
+		TextFile:    "now-playing.txt",
+		JsonFile:    "now-playing.json",
+		ArtworkFile: "artwork.jpg",
+		ArtworkSize: 512,
+	}
+	if err := decodeConfig(loadConfig(), "connectivity.nowPlaying", &config); err != nil {
+		log.Println("Unable to read now playing outputs:", err)
+	}
+	return config
+}
+
+// writeFileAtomic writes into a temporary file next to path and renames it over path, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// downloadArtwork fetches the artwork of a song at size
+func (c *Cider) downloadArtwork(attributes Attributes, size int) ([]byte, error) {
+	if len(attributes.Artwork.URL) == 0 {
+		return nil, errors.New("song has no artwork")
+	}
+	httpClient := http.Client{Timeout: 10 * time.Second}
+	response, err := httpClient.Get(c.SetImageResolution(size, size, attributes.Artwork.URL))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("artwork returned %s", response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// writeNowPlaying writes the enabled now playing outputs when the song changes
+func (c *Cider) writeNowPlaying(event PlaybackEvent) {
+	if event.Kind != PlaybackTrackChange {
+		return
+	}
+	config := c.nowPlayingConfig()
+	if !config.Enabled {
+		return
+	}
+	c.writeNowPlayingOutputs(config, c.normalizeAttributes(event.Attributes))
+}
+
+// writeNowPlayingOutputs writes the outputs of config for a song
+func (c *Cider) writeNowPlayingOutputs(config NowPlayingConfig, attributes Attributes) {
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		log.Println("Unable to create now playing directory:", err)
+		return
+	}
+
+	if len(config.TextFile) != 0 {
+		text := renderTemplate(config.Template, attributes)
+		if err := writeFileAtomic(filepath.Join(config.Directory, config.TextFile), []byte(text)); err != nil {
+			log.Println("Unable to write now playing text:", err)
+		}
+	}
+
+	if len(config.JsonFile) != 0 {
+		b, err := json.MarshalIndent(attributes, "", "\t")
+		if err == nil {
+			err = writeFileAtomic(filepath.Join(config.Directory, config.JsonFile), b)
+		}
+		if err != nil {
+			log.Println("Unable to write now playing json:", err)
+		}
+	}
+
+	if len(config.ArtworkFile) != 0 && config.ArtworkSize > 0 {
+		path := filepath.Join(config.Directory, config.ArtworkFile)
+		artwork, err := c.downloadArtwork(attributes, config.ArtworkSize)
+		if err == nil {
+			err = writeFileAtomic(path, artwork)
+		}
+		if err != nil {
+			// The artwork of the previous song must not stay next to the new song
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Println("Unable to remove now playing artwork:", err)
+			}
+			if len(attributes.Artwork.URL) != 0 {
+				log.Println("Unable to write now playing artwork:", err)
+			}
+		}
+	}
+}
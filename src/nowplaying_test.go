@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNowPlayingArtworkReplaced(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/512x512bb.jpg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("artwork"))
+	}))
+	defer server.Close()
+
+	c := new(Cider)
+	config := NowPlayingConfig{Directory: t.TempDir(), Template: "{artist} - {name}", TextFile: "now-playing.txt", ArtworkFile: "artwork.jpg", ArtworkSize: 512}
+	artwork := filepath.Join(config.Directory, "artwork.jpg")
+
+	song := testSong
+	song.Artwork.URL = server.URL + "/{w}x{h}bb.jpg"
+	c.writeNowPlayingOutputs(config, song)
+	if b, err := os.ReadFile(artwork); err != nil || string(b) != "artwork" {
+		t.Fatalf("artwork not written: %q, %v", b, err)
+	}
+
+	next := testSong
+	next.Name = "Aerodynamic"
+	c.writeNowPlayingOutputs(config, next)
+	if _, err := os.Stat(artwork); !os.IsNotExist(err) {
+		t.Fatal("the artwork of the previous song was kept")
+	}
+	if b, _ := os.ReadFile(filepath.Join(config.Directory, "now-playing.txt")); string(b) != "Daft Punk - Aerodynamic" {
+		t.Fatalf("unexpected text %q", b)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// overlayDirectory holds user themes inside the config path, every theme is a folder with an `index.html`
+	overlayDirectory = "overlays"
+	// overlayKeepAlive keeps idle event streams from being closed by OBS
+	overlayKeepAlive = 15 * time.Second
+	// overlayArtworkSize is the resolution of the artwork sent to overlays
+	overlayArtworkSize = 600
+)
+
+//go:embed overlays
+var overlayAssets embed.FS
+
+// overlayThemeName restricts theme names so they can't escape the overlay folders
+var overlayThemeName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// OverlayState is the playback state sent to overlays, Position is in seconds as of UpdatedAt
+type OverlayState struct {
+	Event     PlaybackEventKind `json:"event"`
+	Name      string            `json:"name"`
+	Artist    string            `json:"artist"`
+	Album     string            `json:"album"`
+	Artwork   string            `json:"artwork"`
+	Duration  float64           `json:"duration"`
+	Position  float64           `json:"position"`
+	Playing   bool              `json:"playing"`
+	Lyric     string            `json:"lyric"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// overlayState converts the playback state for overlays
+func (c *Cider) overlayState(kind PlaybackEventKind, state PlaybackState) OverlayState {
+	attributes := c.normalizeAttributes(state.Attributes)
+	return OverlayState{
+		Event:     kind,
+		Name:      attributes.Name,
+		Artist:    attributes.ArtistName,
+		Album:     attributes.AlbumName,
+		Artwork:   c.SetImageResolution(overlayArtworkSize, overlayArtworkSize, attributes.Artwork.URL),
+		Duration:  float64(attributes.DurationInMillis) / 1000,
+		Position:  state.CurrentPosition(),
+		Playing:   state.Playing,
+		Lyric:     state.Lyric,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// overlayStateHandler returns the current playback state as JSON
+func (c *Cider) overlayStateHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(writer).Encode(c.overlayState("", FujisanPlaybackObject.State())); err != nil {
+		log.Println("Unable to send overlay state:", err)
+	}
+}
+
+// overlayEventsHandler streams the playback state as server sent events until the overlay disconnects
+func (c *Cider) overlayEventsHandler(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Connection", "keep-alive")
+
+	events := make(chan PlaybackEvent, playbackSubscriberBuffer)
+	unsubscribe := FujisanPlaybackObject.Subscribe(func(event PlaybackEvent) {
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	send := func(state OverlayState) bool {
+		b, err := json.Marshal(state)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(writer, "data: %s\n\n", b); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !send(c.overlayState("", FujisanPlaybackObject.State())) {
+		return
+	}
+	keepAlive := time.NewTicker(overlayKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case event := <-events:
+			// Scrobble and love events are about a song, the overlay only shows the current one
+			if event.Kind == PlaybackScrobble || event.Kind == PlaybackLove || event.Kind == PlaybackUnlove {
+				continue
+			}
+			if !send(c.overlayState(event.Kind, event.State)) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// overlayThemeHandler serves a theme, user themes in `overlays` of the config path take precedence over the built in ones
+func (c *Cider) overlayThemeHandler(writer http.ResponseWriter, request *http.Request) {
+	theme := mux.Vars(request)["theme"]
+	if !overlayThemeName.MatchString(theme) {
+		http.NotFound(writer, request)
+		return
+	}
+	file := strings.TrimPrefix(request.URL.Path, "/overlay/"+theme)
+	if len(file) == 0 {
+		// Relative asset paths of the theme need the trailing slash
+		target := "/overlay/" + theme + "/"
+		if len(request.URL.RawQuery) != 0 {
+			target += "?" + request.URL.RawQuery
+		}
+		http.Redirect(writer, request, target, http.StatusMovedPermanently)
+		return
+	}
+	request.URL.Path = file
+	writer.Header().Set("Cache-Control", "no-store")
+
+	userTheme := filepath.Join(FujisanIOObject.GetConfigPath(), overlayDirectory, theme)
+	if info, err := os.Stat(userTheme); err == nil && info.IsDir() {
+		http.FileServer(http.Dir(userTheme)).ServeHTTP(writer, request)
+		return
+	}
+	builtIn, err := fs.Sub(overlayAssets, "overlays/"+theme)
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	if _, err := fs.Stat(builtIn, "index.html"); err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	http.FileServer(http.FS(builtIn)).ServeHTTP(writer, request)
+}
+
+// registerOverlayRoutes adds the overlay pages and their state endpoints to the RPC router
+func (c *Cider) registerOverlayRoutes(router *mux.Router) {
+	router.HandleFunc("/overlay-api/state", c.overlayStateHandler).Methods("GET")
+	router.HandleFunc("/overlay-api/events", c.overlayEventsHandler).Methods("GET")
+	router.PathPrefix("/overlay/{theme}").HandlerFunc(c.overlayThemeHandler).Methods("GET")
+}
+
+// UpdateLyricLine is called by the frontend with the lyric line currently sung so overlays can show it
+func (c *Cider) UpdateLyricLine(line string) {
+	FujisanPlaybackObject.SetLyric(line)
+}
+
+// ListOverlayThemes returns the built in and user overlay themes
+func (c *Cider) ListOverlayThemes() []string {
+	themes := make(map[string]bool)
+	if entries, err := overlayAssets.ReadDir("overlays"); err == nil {
+		for _, entry := range entries {
+			themes[entry.Name()] = true
+		}
+	}
+	if entries, err := os.ReadDir(filepath.Join(FujisanIOObject.GetConfigPath(), overlayDirectory)); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() && overlayThemeName.MatchString(entry.Name()) {
+				themes[entry.Name()] = true
+			}
+		}
+	}
+
+	list := []string{}
+	for theme := range themes {
+		list = append(list, theme)
+	}
+	sort.Strings(list)
+	return list
+}
+
+type OverlayThemesType struct {
+	Themes []string `json:"themes"`
+}
+
+func (f *FujisanRpc) ListOverlayThemes(r *http.Request, args *interface{}, result *OverlayThemesType) error {
+	*result = OverlayThemesType{FujisanObject.ListOverlayThemes()}
+	return nil
+}
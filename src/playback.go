@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// PlaybackEventKind is the kind of change a `PlaybackEvent` reports
+type PlaybackEventKind string
+
+const (
+	PlaybackTrackChange PlaybackEventKind = "trackChange"
+	PlaybackPlay        PlaybackEventKind = "play"
+	PlaybackPause       PlaybackEventKind = "pause"
+	PlaybackSeek        PlaybackEventKind = "seek"
+	PlaybackScrobble    PlaybackEventKind = "scrobble"
+	PlaybackLove        PlaybackEventKind = "love"
+	PlaybackUnlove      PlaybackEventKind = "unlove"
+	PlaybackLyric       PlaybackEventKind = "lyric"
+)
+
+// playbackDuplicateWindow is how long after a track change the same song is taken as MusicKit reporting it again rather than a repeat
+const playbackDuplicateWindow = 5 * time.Second
+
+// playbackSubscriberBuffer is how many events a slow subscriber may fall behind before events are dropped for it
+const playbackSubscriberBuffer = 32
+
+// PlaybackState is what the backend knows about the current song, Position is in seconds as of UpdatedAt
+type PlaybackState struct {
+	Attributes Attributes `json:"attributes"`
+	Playing    bool       `json:"playing"`
+	Position   float64    `json:"position"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	Lyric      string     `json:"lyric"`
+}
+
+// CurrentPosition returns the position in seconds as of now
+func (p PlaybackState) CurrentPosition() float64 {
+	if !p.Playing || p.UpdatedAt.IsZero() {
+		return p.Position
+	}
+	position := p.Position + time.Since(p.UpdatedAt).Seconds()
+	if duration := float64(p.Attributes.DurationInMillis) / 1000; duration > 0 && position > duration {
+		return duration
+	}
+	return position
+}
+
+// PlaybackEvent is sent to subscribers on every playback change, Attributes is the song the event is about
+type PlaybackEvent struct {
+	Kind       PlaybackEventKind `json:"kind"`
+	Attributes Attributes        `json:"attributes"`
+	State      PlaybackState     `json:"state"`
+	Time       time.Time         `json:"time"`
+}
+
+// PlaybackTracker keeps the playback state reported by the frontend and fans changes out to subscribers such as
+// the now playing outputs. Every subscriber receives events in order on its own goroutine
+type PlaybackTracker struct {
+	state       PlaybackState
+	subscribers map[int]chan PlaybackEvent
+	next        int
+	// changed is when the current song started
+	changed time.Time
+	mutex   sync.Mutex
+}
+
+// NewPlaybackTracker returns an empty `*PlaybackTracker`
+func NewPlaybackTracker() *PlaybackTracker {
+	return &PlaybackTracker{subscribers: make(map[int]chan PlaybackEvent)}
+}
+
+// Subscribe calls handler for every following event until the returned function is called
+func (p *PlaybackTracker) Subscribe(handler func(PlaybackEvent)) func() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	id := p.next
+	p.next++
+	events := make(chan PlaybackEvent, playbackSubscriberBuffer)
+	p.subscribers[id] = events
+	go func() {
+		for event := range events {
+			handler(event)
+		}
+	}()
+
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if events, ok := p.subscribers[id]; ok {
+			delete(p.subscribers, id)
+			close(events)
+		}
+	}
+}
+
+// State returns the current playback state
+func (p *PlaybackTracker) State() PlaybackState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state
+}
+
+// publish sends an event to every subscriber, the lock must be held
+func (p *PlaybackTracker) publish(kind PlaybackEventKind, attributes Attributes) {
+	event := PlaybackEvent{Kind: kind, Attributes: attributes, State: p.state, Time: time.Now()}
+	for _, events := range p.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Println("Dropping playback event", kind, "for a slow subscriber")
+		}
+	}
+}
+
+// playbackSongKey identifies a song by its catalog or library id, songs without one by their metadata
+func playbackSongKey(attributes Attributes) string {
+	if len(attributes.PlayParams.ID) != 0 {
+		return attributes.PlayParams.Kind + ":" + attributes.PlayParams.ID
+	}
+	return attributes.ArtistName + "\x00" + attributes.Name + "\x00" + attributes.AlbumName
+}
+
+// TrackChanged starts a new song at the given position in seconds.
+// MusicKit reports a song change more than once, the same song again within `playbackDuplicateWindow` is dropped
+func (p *PlaybackTracker) TrackChanged(attributes Attributes, position float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	if !p.changed.IsZero() && now.Sub(p.changed) < playbackDuplicateWindow && playbackSongKey(p.state.Attributes) == playbackSongKey(attributes) {
+		return
+	}
+	p.changed = now
+	p.state = PlaybackState{Attributes: attributes, Playing: true, Position: position, UpdatedAt: now}
+	p.publish(PlaybackTrackChange, attributes)
+}
+
+// SetPlaying reports play and pause, nothing is published when the state didn't change
+func (p *PlaybackTracker) SetPlaying(playing bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.state.Playing == playing {
+		return
+	}
+	p.state.Position = p.state.CurrentPosition()
+	p.state.Playing = playing
+	p.state.UpdatedAt = time.Now()
+	if playing {
+		p.publish(PlaybackPlay, p.state.Attributes)
+	} else {
+		p.publish(PlaybackPause, p.state.Attributes)
+	}
+}
+
+// Seek moves the position to the given seconds
+func (p *PlaybackTracker) Seek(position float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.state.Position = position
+	p.state.UpdatedAt = time.Now()
+	p.publish(PlaybackSeek, p.state.Attributes)
+}
+
+// SetLyric sets the lyric line currently sung, nothing is published when it didn't change
+func (p *PlaybackTracker) SetLyric(line string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.state.Lyric == line {
+		return
+	}
+	p.state.Lyric = line
+	p.publish(PlaybackLyric, p.state.Attributes)
+}
+
+// Scrobbled reports a song that was scrobbled
+func (p *PlaybackTracker) Scrobbled(attributes Attributes) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.publish(PlaybackScrobble, attributes)
+}
+
+// Loved reports a song that was loved or unloved
+func (p *PlaybackTracker) Loved(attributes Attributes, love bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if love {
+		p.publish(PlaybackLove, attributes)
+	} else {
+		p.publish(PlaybackUnlove, attributes)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// collectPlayback subscribes to a tracker and returns the events received so far when called
+func collectPlayback(t *testing.T, tracker *PlaybackTracker) func() []PlaybackEvent {
+	events := make(chan PlaybackEvent, playbackSubscriberBuffer)
+	t.Cleanup(tracker.Subscribe(func(event PlaybackEvent) { events <- event }))
+	return func() []PlaybackEvent {
+		var received []PlaybackEvent
+		for {
+			select {
+			case event := <-events:
+				received = append(received, event)
+			case <-time.After(50 * time.Millisecond):
+				return received
+			}
+		}
+	}
+}
+
+func TestTrackChangedDropsDuplicates(t *testing.T) {
+	tracker := NewPlaybackTracker()
+	received := collectPlayback(t, tracker)
+
+	song := testSong
+	song.PlayParams.ID, song.PlayParams.Kind = "697195787", "song"
+	tracker.TrackChanged(song, 0)
+	tracker.TrackChanged(song, 0.2)
+	if events := received(); len(events) != 1 || events[0].Kind != PlaybackTrackChange {
+		t.Fatalf("expected a single track change, got %+v", events)
+	}
+
+	next := song
+	next.Name, next.PlayParams.ID = "Aerodynamic", "697195788"
+	tracker.TrackChanged(next, 0)
+	if events := received(); len(events) != 1 || events[0].Attributes.Name != "Aerodynamic" {
+		t.Fatalf("expected the next song, got %+v", events)
+	}
+}
+
+func TestTrackChangedRepeatsSong(t *testing.T) {
+	tracker := NewPlaybackTracker()
+	received := collectPlayback(t, tracker)
+
+	tracker.TrackChanged(testSong, 0)
+	// The same song after the duplicate window is playing again on repeat
+	tracker.changed = tracker.changed.Add(-playbackDuplicateWindow)
+	tracker.TrackChanged(testSong, 0)
+	if events := received(); len(events) != 2 {
+		t.Fatalf("expected two track changes, got %d", len(events))
+	}
+}
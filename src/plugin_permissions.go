@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	wruntime "github.com/ciderapp/wails/v2/pkg/runtime"
+)
+
+const (
+	pluginPermissionsFile = "plugin-permissions.json"
+	// Requests made by plugins are cut off after this long or this many bytes of response
+	pluginRequestTimeout = 30 * time.Second
+	pluginResponseLimit  = 10 << 20
+)
+
+// Permissions a plugin can declare in its metadata, only the APIs of granted permissions are injected into its VM
+const (
+	PluginPermissionConfigRead = "config:read"
+	PluginPermissionMusicKit   = "musicKit"
+	PluginPermissionDialogs    = "dialogs"
+	PluginPermissionNetwork    = "network"
+	PluginPermissionPlayer     = "player"
+)
+
+// pluginPermissionDescriptions are shown to the user when a plugin asks for permissions
+var pluginPermissionDescriptions = map[string]string{
+	PluginPermissionConfigRead: "Read your Cider settings",
+	PluginPermissionMusicKit:   "Use the Apple Music API with your account",
+	PluginPermissionDialogs:    "Show dialogs",
+	PluginPermissionNetwork:    "Make network requests",
+	PluginPermissionPlayer:     "Control playback and volume",
+}
+
+// PluginApproval is the decision of the user on the permissions a plugin asked for.
+// Decisions are keyed by `pluginApprovalKey`, so a plugin can't inherit them by taking the name of another
+type PluginApproval struct {
+	Name        string   `json:"name"`
+	Directory   string   `json:"directory"`
+	Version     string   `json:"version"`
+	Permissions []string `json:"permissions"`
+	// Frontend is set when the plugin has a frontend script, which runs with everything the frontend can do
+	Frontend  bool      `json:"frontend,omitempty"`
+	Approved  bool      `json:"approved"`
+	DecidedAt time.Time `json:"decidedAt"`
+}
+
+// pluginApprovals holds the permission decisions, saved to `plugin-permissions.json`
+type pluginApprovals struct {
+	approvals map[string]*PluginApproval
+	loaded    bool
+	mutex     sync.Mutex
+}
+
+// load reads the saved decisions the first time they are used, the lock must be held
+func (p *pluginApprovals) load() {
+	if p.loaded {
+		return
+	}
+	p.loaded = true
+	p.approvals = make(map[string]*PluginApproval)
+	if b := FujisanIOObject.ReadFile(pluginPermissionsFile); len(b) != 0 {
+		if err := json.Unmarshal([]byte(b), &p.approvals); err != nil {
+			log.Println("Unable to read plugin permissions:", err)
+		}
+	}
+}
+
+// save writes the decisions to disk, the lock must be held
+func (p *pluginApprovals) save() {
+	b, err := json.MarshalIndent(p.approvals, "", "\t")
+	if err != nil {
+		log.Println("Unable to save plugin permissions:", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(FujisanIOObject.GetConfigPath(), pluginPermissionsFile), b, 0600); err != nil {
+		log.Println("Unable to save plugin permissions:", err)
+	}
+}
+
+// pluginApprovalKey identifies the decision for a plugin by its folder relative to the plugin folder and its name
+func pluginApprovalKey(directory string, name string) string {
+	return filepath.ToSlash(directory) + ":" + name
+}
+
+// requestedPermissions returns the known permissions of a plugin sorted and without duplicates
+func requestedPermissions(metadata *PluginMetadata) []string {
+	seen := make(map[string]bool)
+	var permissions []string
+	for _, permission := range metadata.Permissions {
+		permission = strings.TrimSpace(permission)
+		if _, ok := pluginPermissionDescriptions[permission]; !ok {
+			log.Println("Ignoring unknown permission", permission, "of plugin", metadata.Name)
+			continue
+		}
+		if !seen[permission] {
+			seen[permission] = true
+			permissions = append(permissions, permission)
+		}
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// samePermissions compares two sorted permission lists
+func samePermissions(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// askPluginPermissions shows the approval dialog. The permissions only limit the backend script, a frontend script
+// runs in the window with every API of the frontend, which the dialog says
+func askPluginPermissions(metadata *PluginMetadata, permissions []string, previous *PluginApproval) (bool, error) {
+	frontend := len(metadata.FrontendMainScript) != 0
+	var message strings.Builder
+	if previous != nil {
+		fmt.Fprintf(&message, "%s %s changed the permissions it needs.\n\n", metadata.Name, metadata.Version)
+	}
+	fmt.Fprintf(&message, "%s by %s wants to:\n", metadata.Name, strings.Join(metadata.Authors, ", "))
+	for _, permission := range permissions {
+		fmt.Fprintf(&message, "\n• %s", pluginPermissionDescriptions[permission])
+	}
+	if frontend {
+		message.WriteString("\n• Run a script in the Cider window, with full access to Cider and your account")
+	}
+	message.WriteString("\n\nOnly allow plugins you trust.")
+
+	answer, err := wruntime.MessageDialog(FujisanObject.ctx, wruntime.MessageDialogOptions{
+		Type:          wruntime.QuestionDialog,
+		Title:         "Allow " + metadata.Name + "?",
+		Message:       message.String(),
+		Buttons:       []string{"Allow", "Deny"},
+		DefaultButton: "Deny",
+		CancelButton:  "Deny",
+	})
+	if err != nil {
+		return false, err
+	}
+	return answer == "Allow" || answer == "Yes", nil
+}
+
+// decided returns if an approval still covers what a plugin asks for
+func (approval *PluginApproval) decided(permissions []string, frontend bool) bool {
+	return approval != nil && samePermissions(approval.Permissions, permissions) && approval.Frontend == frontend
+}
+
+// approvePluginPermissions returns the permissions granted to the plugin in directory, relative to the plugin folder, and false if it must not be loaded.
+// The user is asked on the first load and whenever the requested permissions change, the decision is saved.
+// The lock is not held while the dialog is open, so the decisions can be listed and revoked meanwhile
+func approvePluginPermissions(directory string, metadata *PluginMetadata) (map[string]bool, bool) {
+	requested := requestedPermissions(metadata)
+	frontend := len(metadata.FrontendMainScript) != 0
+	granted := make(map[string]bool)
+	if len(requested) == 0 && !frontend {
+		return granted, true
+	}
+
+	approvals := FujisanPluginApprovals
+	key := pluginApprovalKey(directory, metadata.Name)
+	approvals.mutex.Lock()
+	approvals.load()
+	approval := approvals.approvals[key]
+	approvals.mutex.Unlock()
+
+	if !approval.decided(requested, frontend) {
+		approved, err := askPluginPermissions(metadata, requested, approval)
+		if err != nil {
+			log.Println("Unable to ask for the permissions of", metadata.Name+":", err)
+			return nil, false
+		}
+
+		approvals.mutex.Lock()
+		// Another load of the plugin may have been decided while the dialog was open, the first decision stays
+		if current := approvals.approvals[key]; current != approval && current.decided(requested, frontend) {
+			approval = current
+		} else {
+			approval = &PluginApproval{
+				Name:        metadata.Name,
+				Directory:   filepath.ToSlash(directory),
+				Version:     metadata.Version,
+				Permissions: requested,
+				Frontend:    frontend,
+				Approved:    approved,
+				DecidedAt:   time.Now(),
+			}
+			approvals.approvals[key] = approval
+			approvals.save()
+		}
+		approvals.mutex.Unlock()
+	}
+	if !approval.Approved {
+		return nil, false
+	}
+	for _, permission := range approval.Permissions {
+		granted[permission] = true
+	}
+	return granted, true
+}
+
+// PluginHttpResponse is the result of `httpRequest` in a plugin
+type PluginHttpResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+var errPluginAddressBlocked = errors.New("plugins can't make requests to local or private addresses")
+
+// pluginCarrierNat is the shared address space of carrier-grade NAT, which is as internal as the private ranges
+var _, pluginCarrierNat, _ = net.ParseCIDR("100.64.0.0/10")
+
+// pluginAddressBlocked returns if plugins must not connect to an address: loopback, link-local, private,
+// carrier-grade NAT, multicast and unspecified addresses all reach the machine or the network Cider runs on
+func pluginAddressBlocked(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsPrivate() || ip.IsUnspecified() || pluginCarrierNat.Contains(ip)
+}
+
+// pluginDialControl rejects connections to blocked addresses. It runs for every connection once the host is resolved,
+// so redirects and host names resolving to the local network are stopped too
+func pluginDialControl(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || pluginAddressBlocked(ip) {
+		return fmt.Errorf("%w: %s", errPluginAddressBlocked, host)
+	}
+	return nil
+}
+
+var pluginHttpClient = &http.Client{
+	Timeout: pluginRequestTimeout,
+	Transport: &http.Transport{
+		// No proxy, every connection has to go through the dialer checking where it goes
+		Proxy:               nil,
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: pluginDialControl}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// pluginHttpRequest makes an http or https request for a plugin with the network permission, errors are thrown in the plugin.
+// Local and private addresses can't be reached, see `pluginDialControl`
+func pluginHttpRequest(method string, address string, body string, headers map[string]string) (*PluginHttpResponse, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, errors.New("only http and https requests are allowed")
+	}
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(method), parsed.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Cider/"+Version)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := pluginHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, pluginResponseLimit))
+	if err != nil {
+		return nil, err
+	}
+	response := &PluginHttpResponse{Status: resp.StatusCode, Headers: make(map[string]string), Body: string(b)}
+	for key := range resp.Header {
+		response.Headers[strings.ToLower(key)] = resp.Header.Get(key)
+	}
+	return response, nil
+}
+
+// pluginPlayer returns the `player` object of a plugin with the player permission
+func pluginPlayer() map[string]interface{} {
+	var result RpcType
+	var empty interface{}
+	return map[string]interface{}{
+		"play":      func() error { return FujisanRpcObject.Play(nil, nil, &result) },
+		"pause":     func() error { return FujisanRpcObject.Pause(nil, nil, &result) },
+		"playPause": func() error { return FujisanRpcObject.PlayPause(nil, nil, &result) },
+		"stop":      func() error { return FujisanRpcObject.Stop(nil, nil, &empty) },
+		"next":      func() error { return FujisanRpcObject.Next(nil, nil, &empty) },
+		"previous":  func() error { return FujisanRpcObject.Previous(nil, nil, &empty) },
+		"seek": func(second int) error {
+			return FujisanRpcObject.SeekTo(nil, &SeekToArgs{second}, &empty)
+		},
+		"setVolume": func(volume float64) error {
+			return FujisanRpcObject.SetVolume(nil, &VolumeArgs{volume}, &empty)
+		},
+		"state": func() PlaybackState { return FujisanPlaybackObject.State() },
+	}
+}
+
+// ListPluginPermissions returns the permission decisions for every plugin, keyed by `pluginApprovalKey`
+func (c *Cider) ListPluginPermissions() map[string]PluginApproval {
+	approvals := FujisanPluginApprovals
+	approvals.mutex.Lock()
+	defer approvals.mutex.Unlock()
+	approvals.load()
+
+	list := make(map[string]PluginApproval)
+	for name, approval := range approvals.approvals {
+		list[name] = *approval
+	}
+	return list
+}
+
+// RevokePluginPermissions forgets the decision with the key `ListPluginPermissions` returns and unloads the plugin, it is asked again on the next load
+func (c *Cider) RevokePluginPermissions(key string) bool {
+	approvals := FujisanPluginApprovals
+	approvals.mutex.Lock()
+	approvals.load()
+	approval, ok := approvals.approvals[key]
+	if ok {
+		delete(approvals.approvals, key)
+		approvals.save()
+	}
+	approvals.mutex.Unlock()
+
+	if ok && FujisanPluginLoader != nil {
+		FujisanPluginLoader.UnloadPluginDirectory(filepath.Join(FujisanPluginLoader.PluginFolder, filepath.FromSlash(approval.Directory)))
+	}
+	return ok
+}
+
+type PluginPermissionsArgs struct {
+	Name string `json:"name"`
+	// Key selects a permission decision returned by `ListPluginPermissions`
+	Key string `json:"key"`
+}
+
+type PluginPermissionsType struct {
+	Plugins map[string]PluginApproval `json:"plugins"`
+}
+
+func (f *FujisanRpc) ListPluginPermissions(r *http.Request, args *interface{}, result *PluginPermissionsType) error {
+	*result = PluginPermissionsType{FujisanObject.ListPluginPermissions()}
+	return nil
+}
+
+func (f *FujisanRpc) RevokePluginPermissions(r *http.Request, args *PluginPermissionsArgs, result *SuccessType) error {
+	if args == nil || len(args.Key) == 0 {
+		return errors.New("must pass in key")
+	}
+	*result = SuccessType{FujisanObject.RevokePluginPermissions(args.Key)}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPluginAddressBlocked(t *testing.T) {
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.0.0.8", true},
+		{"172.16.4.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"224.0.0.251", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:192.168.1.1", true},
+		{"17.253.144.10", false},
+		{"2606:4700::6810:85e5", false},
+	}
+	for _, test := range tests {
+		if blocked := pluginAddressBlocked(net.ParseIP(test.address)); blocked != test.blocked {
+			t.Errorf("%s: blocked = %v, want %v", test.address, blocked, test.blocked)
+		}
+	}
+}
+
+func TestPluginDialControl(t *testing.T) {
+	if err := pluginDialControl("tcp4", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("a public address was rejected: %v", err)
+	}
+	for _, address := range []string{"127.0.0.1:10782", "[::1]:80", "[fe80::1%eth0]:80", "192.168.1.1:80"} {
+		if err := pluginDialControl("tcp", address, nil); !errors.Is(err, errPluginAddressBlocked) {
+			t.Errorf("%s: expected the connection to be rejected, got %v", address, err)
+		}
+	}
+}
+
+func TestPluginHttpRequestRejectsLoopback(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	_, err := pluginHttpRequest("GET", server.URL, "", nil)
+	if !errors.Is(err, errPluginAddressBlocked) {
+		t.Fatalf("expected the request to be rejected, got %v", err)
+	}
+	// A name resolving to loopback is rejected the same way
+	_, err = pluginHttpRequest("GET", "http://localhost:"+server.URL[len("http://127.0.0.1:"):], "", nil)
+	if !errors.Is(err, errPluginAddressBlocked) {
+		t.Fatalf("expected the request to localhost to be rejected, got %v", err)
+	}
+	if requests != 0 {
+		t.Fatalf("the server received %d requests", requests)
+	}
+	if _, err := pluginHttpRequest("GET", "file:///etc/passwd", "", nil); err == nil {
+		t.Fatal("expected other schemes to be rejected")
+	}
+}
+
+func TestPluginApprovalKey(t *testing.T) {
+	if pluginApprovalKey("my-plugin", "My Plugin") == pluginApprovalKey("copycat", "My Plugin") {
+		t.Fatal("plugins in different folders must not share a decision")
+	}
+	if key := pluginApprovalKey("vendor/my-plugin", "My Plugin"); key != "vendor/my-plugin:My Plugin" {
+		t.Fatalf("unexpected key %q", key)
+	}
+}
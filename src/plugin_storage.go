@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	yomikaki "github.com/freehelpdesk/yomikaki"
+)
+
+const (
+	// pluginStorageQuota is the default space a plugin may use, in MiB, overridden by `plugins.storageQuota`
+	pluginStorageQuota = 50
+	// pluginStoreFile holds the key-value store of a plugin, next to its files folder
+	pluginStoreFile = "store.json"
+	// pluginDirectoryLength is how much of the plugin key is kept in its data folder name
+	pluginDirectoryLength = 64
+)
+
+var (
+	errStorageOutside = errors.New("path is outside of the plugin storage")
+	errStorageQuota   = errors.New("plugin storage quota exceeded")
+
+	// pluginDirectoryUnsafe matches the characters of a plugin key which are replaced in its data folder name
+	pluginDirectoryUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+)
+
+// PluginStorage is the storage of one plugin, rooted at `plugin-data/<key>` in the config path.
+// Plugins only see paths relative to their `files` folder, the key-value store lives beside it and both count towards the quota
+type PluginStorage struct {
+	root  string
+	quota int64
+	mutex sync.Mutex
+}
+
+// pluginDataDirectory returns the data folder of the plugin with a `pluginApprovalKey`, so a plugin can't reach the data of
+// another by taking its name. Keys are reduced to characters safe in any filesystem and followed by a hash of the key,
+// so keys that reduce to the same folder or only differ in case get their own folders
+func pluginDataDirectory(key string) string {
+	directory := strings.Trim(pluginDirectoryUnsafe.ReplaceAllString(key, "_"), ".")
+	if len(directory) > pluginDirectoryLength {
+		directory = directory[:pluginDirectoryLength]
+	}
+	hash := sha256.Sum256([]byte(key))
+	directory += "-" + hex.EncodeToString(hash[:6])
+	return filepath.Join(FujisanIOObject.GetConfigPath(), "plugin-data", directory)
+}
+
+// pluginStorageQuotaBytes returns the configured quota
+func pluginStorageQuotaBytes() int64 {
+	quota := float64(pluginStorageQuota)
+	if read, _ := yomikaki.DirectRead("plugins.storageQuota", loadConfig()); read != nil {
+		if value, ok := read.(float64); ok && value > 0 {
+			quota = value
+		}
+	}
+	return int64(quota * (1 << 20))
+}
+
+// NewPluginStorage returns the `*PluginStorage` of the plugin with a `pluginApprovalKey`
+func NewPluginStorage(key string) *PluginStorage {
+	return &PluginStorage{root: pluginDataDirectory(key), quota: pluginStorageQuotaBytes()}
+}
+
+func (s *PluginStorage) filesRoot() string {
+	return filepath.Join(s.root, "files")
+}
+
+// resolve turns a path given by a plugin into a path inside its files folder.
+// Absolute paths, paths leaving the folder and paths through symlinks are rejected
+func (s *PluginStorage) resolve(name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errStorageOutside
+	}
+	root := s.filesRoot()
+	path := filepath.Join(root, name)
+	relative, err := filepath.Rel(root, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", errStorageOutside
+	}
+
+	current := root
+	for _, part := range strings.Split(relative, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", errStorageOutside
+		}
+	}
+	return path, nil
+}
+
+// usage returns the bytes used by the plugin, the lock must be held
+func (s *PluginStorage) usage() int64 {
+	var total int64
+	filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// write replaces a file within the quota, the lock must be held
+func (s *PluginStorage) write(path string, data []byte) error {
+	var existing int64
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a folder", filepath.Base(path))
+		}
+		existing = info.Size()
+	}
+	if s.usage()-existing+int64(len(data)) > s.quota {
+		return errStorageQuota
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// ReadFile reads a file of the plugin
+func (s *PluginStorage) ReadFile(name string) (string, error) {
+	path, err := s.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// WriteFile writes a file of the plugin, creating its folders
+func (s *PluginStorage) WriteFile(name string, data string) error {
+	path, err := s.resolve(name)
+	if err != nil {
+		return err
+	}
+	if path == s.filesRoot() {
+		return errors.New("must pass in a file name")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(path, []byte(data))
+}
+
+// RemoveFile removes a file or an empty folder of the plugin
+func (s *PluginStorage) RemoveFile(name string) error {
+	path, err := s.resolve(name)
+	if err != nil {
+		return err
+	}
+	if path == s.filesRoot() {
+		return errors.New("must pass in a file name")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return os.Remove(path)
+}
+
+// FileExists checks if a file of the plugin exists
+func (s *PluginStorage) FileExists(name string) bool {
+	path, err := s.resolve(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// ListFiles returns the names in a folder of the plugin, folders end with a slash
+func (s *PluginStorage) ListFiles(name string) ([]string, error) {
+	path, err := s.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, fs.ErrNotExist) && path == s.filesRoot() {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name()+"/")
+		} else {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Usage returns the bytes used by the plugin
+func (s *PluginStorage) Usage() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.usage()
+}
+
+// Quota returns the bytes the plugin may use
+func (s *PluginStorage) Quota() int64 {
+	return s.quota
+}
+
+// readStore reads the key-value store, the lock must be held
+func (s *PluginStorage) readStore() (map[string]interface{}, error) {
+	store := make(map[string]interface{})
+	b, err := os.ReadFile(filepath.Join(s.root, pluginStoreFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// writeStore writes the key-value store, the lock must be held
+func (s *PluginStorage) writeStore(store map[string]interface{}) error {
+	b, err := json.MarshalIndent(store, "", "\t")
+	if err != nil {
+		return err
+	}
+	return s.write(filepath.Join(s.root, pluginStoreFile), b)
+}
+
+// Get returns the value of a key, or nil when it is not set
+func (s *PluginStorage) Get(key string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	store, err := s.readStore()
+	if err != nil {
+		return nil, err
+	}
+	return store[key], nil
+}
+
+// Set stores a JSON serializable value under a key
+func (s *PluginStorage) Set(key string, value interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	store, err := s.readStore()
+	if err != nil {
+		return err
+	}
+	store[key] = value
+	return s.writeStore(store)
+}
+
+// Delete removes a key
+func (s *PluginStorage) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	store, err := s.readStore()
+	if err != nil {
+		return err
+	}
+	if _, ok := store[key]; !ok {
+		return nil
+	}
+	delete(store, key)
+	return s.writeStore(store)
+}
+
+// Keys returns the sorted keys of the store
+func (s *PluginStorage) Keys() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	store, err := s.readStore()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(store))
+	for key := range store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Clear removes everything the plugin stored
+func (s *PluginStorage) Clear() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return os.RemoveAll(s.root)
+}
+
+// api returns the `storage` object of a plugin, errors are thrown in the plugin
+func (s *PluginStorage) api() map[string]interface{} {
+	return map[string]interface{}{
+		"readFile":   s.ReadFile,
+		"writeFile":  s.WriteFile,
+		"removeFile": s.RemoveFile,
+		"fileExists": s.FileExists,
+		"listFiles":  s.ListFiles,
+		"usage":      s.Usage,
+		"quota":      s.Quota,
+		"get":        s.Get,
+		"set":        s.Set,
+		"delete":     s.Delete,
+		"keys":       s.Keys,
+	}
+}
+
+// pluginConfig returns the `config` object of a plugin with the config:read permission, giving read only access to `spa-config.json`
+func pluginConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"get": func(path string) (interface{}, error) {
+			read, _ := yomikaki.DirectRead(path, loadConfig())
+			if read == nil {
+				return nil, nil
+			}
+			// The config is shared, the plugin gets a copy it can't modify the cache through
+			b, err := json.Marshal(read)
+			if err != nil {
+				return nil, err
+			}
+			var value interface{}
+			err = json.Unmarshal(b, &value)
+			return value, err
+		},
+	}
+}
+
+// ClearPluginStorage removes everything the plugin with a `pluginApprovalKey` stored
+func (c *Cider) ClearPluginStorage(key string) error {
+	return NewPluginStorage(key).Clear()
+}
+
+type PluginStorageType struct {
+	Usage int64 `json:"usage"`
+	Quota int64 `json:"quota"`
+}
+
+// GetPluginStorage returns the space used by the plugin with a `pluginApprovalKey`
+func (c *Cider) GetPluginStorage(key string) PluginStorageType {
+	storage := NewPluginStorage(key)
+	return PluginStorageType{storage.Usage(), storage.Quota()}
+}
+
+func (f *FujisanRpc) GetPluginStorage(r *http.Request, args *PluginPermissionsArgs, result *PluginStorageType) error {
+	if args == nil || len(args.Key) == 0 {
+		return errors.New("must pass in key")
+	}
+	*result = FujisanObject.GetPluginStorage(args.Key)
+	return nil
+}
+
+func (f *FujisanRpc) ClearPluginStorage(r *http.Request, args *PluginPermissionsArgs, result *SuccessType) error {
+	if args == nil || len(args.Key) == 0 {
+		return errors.New("must pass in key")
+	}
+	err := FujisanObject.ClearPluginStorage(args.Key)
+	*result = SuccessType{err == nil}
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPluginDataDirectoryCollisions(t *testing.T) {
+	seen := make(map[string]string)
+	for _, name := range []string{"My Plugin", "My_Plugin", "My/Plugin", "my plugin", "My Plugin.", "..", ""} {
+		directory := filepath.Base(pluginDataDirectory(pluginApprovalKey("plugin", name)))
+		if other, ok := seen[strings.ToLower(directory)]; ok {
+			t.Errorf("%q and %q share the data folder %s", name, other, directory)
+		}
+		seen[strings.ToLower(directory)] = name
+		if strings.ContainsAny(directory, `/\ :`) || strings.HasPrefix(directory, ".") {
+			t.Errorf("%q got the unsafe folder name %q", name, directory)
+		}
+	}
+	key := pluginApprovalKey("my-plugin", "My Plugin")
+	if directory := filepath.Base(pluginDataDirectory(key)); !strings.HasPrefix(directory, "my-plugin_My_Plugin-") {
+		t.Errorf("the folder should start with the plugin folder and name, got %s", directory)
+	}
+	if pluginDataDirectory(key) != pluginDataDirectory(key) {
+		t.Error("the folder of a plugin must not change")
+	}
+	// A plugin taking the name of another gets its own data
+	if pluginDataDirectory(key) == pluginDataDirectory(pluginApprovalKey("impostor", "My Plugin")) {
+		t.Error("plugins with the same name in different folders share their data")
+	}
+}
+
+func TestPluginStorageStaysInside(t *testing.T) {
+	storage := &PluginStorage{root: t.TempDir(), quota: 1 << 20}
+
+	if err := storage.WriteFile("notes/today.txt", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.ReadFile("notes/today.txt"); err != nil || data != "hello" {
+		t.Fatalf("ReadFile() = %q, %v", data, err)
+	}
+	for _, name := range []string{"../store.json", "notes/../../escape.txt", filepath.Join(os.TempDir(), "escape.txt")} {
+		if err := storage.WriteFile(name, "x"); !errors.Is(err, errStorageOutside) {
+			t.Errorf("%s: expected the path to be rejected, got %v", name, err)
+		}
+	}
+
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(storage.filesRoot(), "link")); err != nil {
+		t.Skip("symlinks are not available:", err)
+	}
+	if err := storage.WriteFile("link/escape.txt", "x"); !errors.Is(err, errStorageOutside) {
+		t.Errorf("expected writing through a symlink to be rejected, got %v", err)
+	}
+}
+
+func TestPluginStorageQuota(t *testing.T) {
+	storage := &PluginStorage{root: t.TempDir(), quota: 16}
+
+	if err := storage.WriteFile("a.txt", "0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteFile("b.txt", "0123456789"); !errors.Is(err, errStorageQuota) {
+		t.Fatalf("expected the quota to be exceeded, got %v", err)
+	}
+	// Replacing a file only counts the difference
+	if err := storage.WriteFile("a.txt", "0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if usage := storage.Usage(); usage != 16 {
+		t.Fatalf("Usage() = %d", usage)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	wruntime "github.com/ciderapp/wails/v2/pkg/runtime"
+	yomikaki "github.com/freehelpdesk/yomikaki"
+	"github.com/fsnotify/fsnotify"
+)
+
+// pluginReloadDebounce waits for editors and build tools to finish writing before a plugin is reloaded
+const pluginReloadDebounce = 300 * time.Millisecond
+
+// PluginEvent reports a plugin being reloaded or failing, it is emitted to the frontend as `fujisan:plugin`
+type PluginEvent struct {
+	Name      string `json:"name"`
+	Directory string `json:"directory"`
+	Action    string `json:"action"`
+	Error     string `json:"error,omitempty"`
+}
+
+// emit sends a plugin event to the frontend
+func (p *PluginLoader) emit(event PluginEvent) {
+	if FujisanObject.ctx != nil {
+		wruntime.EventsEmit(FujisanObject.ctx, "fujisan:plugin", event)
+	}
+}
+
+// reportError logs a plugin error and reports it to the frontend
+func (p *PluginLoader) reportError(pluginName string, err error) {
+	p.Logger.Println(pluginName+":", err)
+	p.emit(PluginEvent{Name: pluginName, Action: "error", Error: err.Error()})
+}
+
+// hotReloadEnabled returns if plugins are reloaded on change, always in dev mode and otherwise with `plugins.hotReload`
+func hotReloadEnabled() bool {
+	if FujisanObject.InDevMode() {
+		return true
+	}
+	read, _ := yomikaki.DirectRead("plugins.hotReload", loadConfig())
+	enabled, _ := read.(bool)
+	return enabled
+}
+
+// pluginDirectory returns the top level plugin folder a changed path belongs to
+func (p *PluginLoader) pluginDirectory(path string) (string, bool) {
+	relative, err := filepath.Rel(p.PluginFolder, path)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.Join(p.PluginFolder, strings.Split(relative, string(filepath.Separator))[0]), true
+}
+
+// watch adds a folder and everything below it to the watcher, fsnotify does not watch recursively
+func (p *PluginLoader) watch(watcher *fsnotify.Watcher, root string) {
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				p.Logger.Println("Unable to watch", path+":", err)
+			}
+		}
+		return nil
+	})
+}
+
+// ReloadPluginDirectory unloads the plugins loaded from a top level plugin folder and loads it again,
+// a removed folder only unloads its plugins
+func (p *PluginLoader) ReloadPluginDirectory(directory string) {
+	p.reloadMutex.Lock()
+	defer p.reloadMutex.Unlock()
+
+	p.Mutex.Lock()
+	loaded := make(map[string]string)
+	for path, name := range p.Directories {
+		if path == directory || strings.HasPrefix(path, directory+string(filepath.Separator)) {
+			loaded[path] = name
+			delete(p.Directories, path)
+		}
+	}
+	p.Mutex.Unlock()
+
+	for path, name := range loaded {
+		p.UnloadPlugin(path)
+		p.emit(PluginEvent{Name: name, Directory: directory, Action: "unloaded"})
+	}
+	if _, err := os.Stat(directory); err != nil {
+		return
+	}
+
+	p.Logger.Println("Reloading", directory)
+	filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(path, "metadata.json")); err != nil {
+			return nil
+		}
+		if err := p.LoadPluginDirectory(path); err != nil {
+			p.reportError(filepath.Base(path), err)
+			return nil
+		}
+		p.Mutex.Lock()
+		name, loaded := p.Directories[path]
+		p.Mutex.Unlock()
+		if loaded {
+			p.emit(PluginEvent{Name: name, Directory: directory, Action: "reloaded"})
+		}
+		return nil
+	})
+}
+
+// pluginDebouncer reloads a plugin folder once it stopped changing for `delay`. Every change starts a new generation of the
+// folder and a timer only reloads if no change came after it, a timer firing while it is replaced can't reload twice
+type pluginDebouncer struct {
+	delay       time.Duration
+	reload      func(directory string)
+	timers      map[string]*time.Timer
+	generations map[string]uint64
+	stopped     bool
+	mutex       sync.Mutex
+}
+
+func newPluginDebouncer(delay time.Duration, reload func(directory string)) *pluginDebouncer {
+	return &pluginDebouncer{
+		delay:       delay,
+		reload:      reload,
+		timers:      make(map[string]*time.Timer),
+		generations: make(map[string]uint64),
+	}
+}
+
+// changed schedules a reload of directory, replacing the one scheduled before
+func (d *pluginDebouncer) changed(directory string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		return
+	}
+	if timer, ok := d.timers[directory]; ok {
+		timer.Stop()
+	}
+	d.generations[directory]++
+	generation := d.generations[directory]
+	d.timers[directory] = time.AfterFunc(d.delay, func() {
+		d.mutex.Lock()
+		current := !d.stopped && d.generations[directory] == generation
+		if current {
+			delete(d.timers, directory)
+		}
+		d.mutex.Unlock()
+		if current {
+			d.reload(directory)
+		}
+	})
+}
+
+// stop cancels every scheduled reload
+func (d *pluginDebouncer) stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.stopped = true
+	for _, timer := range d.timers {
+		timer.Stop()
+	}
+}
+
+// PluginWatcher reloads a plugin whenever a file in its folder changes, until `StopWatcher` is called
+func (p *PluginLoader) PluginWatcher() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	p.Watcher = watcher
+	p.watch(watcher, p.PluginFolder)
+	p.Logger.Println("Watching", p.PluginFolder, "for changes")
+
+	go func() {
+		debouncer := newPluginDebouncer(pluginReloadDebounce, p.ReloadPluginDirectory)
+		defer debouncer.stop()
+		errs := watcher.Errors
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Create) {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						p.watch(watcher, event.Name)
+					}
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if directory, ok := p.pluginDirectory(event.Name); ok {
+					debouncer.changed(directory)
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				p.Logger.Println("Plugin watcher:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// StopWatcher stops reloading plugins on change
+func (p *PluginLoader) StopWatcher() {
+	if p.Watcher != nil {
+		p.Watcher.Close()
+		p.Watcher = nil
+	}
+}
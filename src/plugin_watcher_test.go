@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reloadRecorder counts the reloads of every folder
+type reloadRecorder struct {
+	reloads map[string]int
+	mutex   sync.Mutex
+}
+
+func (r *reloadRecorder) reload(directory string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reloads[directory]++
+}
+
+func (r *reloadRecorder) count(directory string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reloads[directory]
+}
+
+func TestPluginDebouncer(t *testing.T) {
+	recorder := &reloadRecorder{reloads: make(map[string]int)}
+	debouncer := newPluginDebouncer(20*time.Millisecond, recorder.reload)
+	defer debouncer.stop()
+
+	// Changes keep coming around the moment the timer fires, every burst must reload once
+	for i := 0; i < 20; i++ {
+		debouncer.changed("first")
+		time.Sleep(time.Duration(15+i%10) * time.Millisecond)
+	}
+	debouncer.changed("second")
+	time.Sleep(200 * time.Millisecond)
+	if count := recorder.count("first"); count < 1 {
+		t.Fatal("the changed folder was not reloaded")
+	}
+	first := recorder.count("first")
+	if count := recorder.count("second"); count != 1 {
+		t.Errorf("the second folder was reloaded %d times", count)
+	}
+
+	// Nothing changed since, a timer replaced while firing must not reload again
+	time.Sleep(100 * time.Millisecond)
+	if count := recorder.count("first"); count != first {
+		t.Errorf("the folder was reloaded %d times after the changes stopped", count-first)
+	}
+
+	debouncer.changed("first")
+	debouncer.stop()
+	time.Sleep(100 * time.Millisecond)
+	if count := recorder.count("first"); count != first {
+		t.Error("a reload happened after stopping")
+	}
+}
+
+func TestPluginDebouncerCoalesces(t *testing.T) {
+	recorder := &reloadRecorder{reloads: make(map[string]int)}
+	debouncer := newPluginDebouncer(50*time.Millisecond, recorder.reload)
+	defer debouncer.stop()
+
+	for i := 0; i < 10; i++ {
+		debouncer.changed("plugin")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if count := recorder.count("plugin"); count != 1 {
+		t.Errorf("expected one reload, got %d", count)
+	}
+}
+
+func TestPluginDirectory(t *testing.T) {
+	loader := NewPluginLoader("plugins")
+	tests := []struct {
+		path      string
+		directory string
+		ok        bool
+	}{
+		{filepath.Join("plugins", "lyrics", "index.js"), filepath.Join("plugins", "lyrics"), true},
+		{filepath.Join("plugins", "lyrics"), filepath.Join("plugins", "lyrics"), true},
+		{"plugins", "", false},
+		{filepath.Join("other", "index.js"), "", false},
+	}
+	for _, test := range tests {
+		if directory, ok := loader.pluginDirectory(test.path); directory != test.directory || ok != test.ok {
+			t.Errorf("%s: got %q, %v", test.path, directory, ok)
+		}
+	}
+}
+
+func TestPluginWatcherReloadsChangedPlugin(t *testing.T) {
+	folder := t.TempDir()
+	loader := NewPluginLoader(folder)
+	first, second := filepath.Join(folder, "first"), filepath.Join(folder, "second")
+	writePluginDirectory(t, first, "Plugin", `var version = 1`)
+	writePluginDirectory(t, second, "Plugin", `var version = 1`)
+
+	loader.LoadPlugins()
+	waitForPlugin(t, loader, first, "the first plugin to load", func(c *Container) bool { return c != nil })
+	waitForPlugin(t, loader, second, "the second plugin to load", func(c *Container) bool { return c != nil })
+	loadedFirst, loadedSecond := loadedContainer(loader, first), loadedContainer(loader, second)
+
+	if err := loader.PluginWatcher(); err != nil {
+		t.Skip("file watching is not available:", err)
+	}
+	t.Cleanup(loader.StopWatcher)
+
+	if err := os.WriteFile(filepath.Join(first, "index.js"), []byte(`var version = 2`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForPlugin(t, loader, first, "the changed plugin to reload", func(c *Container) bool { return c != nil && c != loadedFirst })
+	if loadedContainer(loader, second) != loadedSecond {
+		t.Fatal("the plugin with the same name in another folder was reloaded")
+	}
+}
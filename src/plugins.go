@@ -8,6 +8,7 @@ import (
 	"github.com/dop251/goja_nodejs/eventloop"
 	"github.com/dop251/goja_nodejs/require"
 	"github.com/dop251/goja_nodejs/url"
+	"github.com/fsnotify/fsnotify"
 	"io/fs"
 	"log"
 	"os"
@@ -17,17 +18,25 @@ import (
 )
 
 type Container struct {
-	VM        *js.Runtime
-	Registry  *require.Registry
-	EventLoop *eventloop.EventLoop
-	// Watcher  *fsnotify.Watcher
+	Name        string
+	VM          *js.Runtime
+	Registry    *require.Registry
+	EventLoop   *eventloop.EventLoop
+	Permissions map[string]bool
+	Storage     *PluginStorage
+	stopping    sync.Once
 }
 
 type PluginLoader struct {
 	PluginFolder string
-	VM           map[string]*Container
-	Logger       *log.Logger
-	Mutex        sync.Mutex
+	// VM maps the folder of every loaded plugin to its container, names are not unique across folders
+	VM map[string]*Container
+	// Directories maps the folder of every loaded plugin to its name, for reloading it when the folder changes
+	Directories map[string]string
+	Watcher     *fsnotify.Watcher
+	Logger      *log.Logger
+	Mutex       sync.Mutex
+	reloadMutex sync.Mutex
 }
 
 func NewPluginLoader(folder string) *PluginLoader {
@@ -37,32 +46,83 @@ func NewPluginLoader(folder string) *PluginLoader {
 		PluginFolder: folder,
 		Logger:       logger,
 		VM:           make(map[string]*Container),
+		Directories:  make(map[string]string),
 	}
 	return &plugin
 }
 
-func (p *PluginLoader) UnloadPlugin(pluginName string) {
-	if p.VM[pluginName] != nil {
-		//p.VM[pluginName].Watcher.Close()
-		p.VM[pluginName].EventLoop.Stop()
-		p.VM[pluginName].VM.Interrupt("halt")
-		delete(p.VM, pluginName)
-		p.Logger.Println("Unloaded:", pluginName)
+// stop halts the script of a container and its event loop, the script is interrupted first so a busy script can't keep the loop from stopping
+func (c *Container) stop() {
+	c.stopping.Do(func() {
+		c.VM.Interrupt("halt")
+		c.EventLoop.Stop()
+	})
+}
+
+// UnloadPlugin unloads the plugin loaded from a folder
+func (p *PluginLoader) UnloadPlugin(directory string) {
+	p.Mutex.Lock()
+	container := p.VM[directory]
+	delete(p.VM, directory)
+	p.Mutex.Unlock()
+
+	if container != nil {
+		container.stop()
+		p.Logger.Println("Unloaded:", container.Name)
 	} else {
-		p.Logger.Println(pluginName, "already unloaded")
+		p.Logger.Println(filepath.Base(directory), "already unloaded")
+	}
+}
+
+// unloadContainer stops a container and removes it if it is still the one loaded from its folder, a plugin loaded again meanwhile stays
+func (p *PluginLoader) unloadContainer(directory string, container *Container) {
+	p.Mutex.Lock()
+	if p.VM[directory] == container {
+		delete(p.VM, directory)
+	}
+	p.Mutex.Unlock()
+
+	container.stop()
+	p.Logger.Println("Unloaded:", container.Name)
+}
+
+// UnloadPluginDirectory unloads the plugin loaded from a folder and forgets the folder
+func (p *PluginLoader) UnloadPluginDirectory(path string) {
+	p.Mutex.Lock()
+	_, ok := p.Directories[path]
+	delete(p.Directories, path)
+	p.Mutex.Unlock()
+	if ok {
+		p.UnloadPlugin(path)
+	}
+}
+
+// relativeDirectory returns the folder of a plugin relative to the plugin folder, as `pluginApprovalKey` expects it
+func (p *PluginLoader) relativeDirectory(path string) string {
+	directory, err := filepath.Rel(p.PluginFolder, path)
+	if err != nil {
+		return path
 	}
+	return directory
 }
 
-func (p *PluginLoader) SetupPluginCalls(loader *PluginLoader, vm *js.Runtime, filename string, pluginName string) {
+// SetupPluginCalls injects the backend APIs into the VM of a plugin and returns its container with a running event loop,
+// only the APIs of granted permissions are exposed
+func (p *PluginLoader) SetupPluginCalls(loader *PluginLoader, vm *js.Runtime, filename string, pluginName string, storage *PluginStorage, permissions map[string]bool) *Container {
 	vmLogger := log.New(loader.Logger.Writer(), loader.Logger.Prefix(), loader.Logger.Flags())
 	vmLogger.SetPrefix(fmt.Sprintf("[%s] ", pluginName))
 	vm.Set("print", vmLogger.Print)
 
-	p.VM[pluginName] = new(Container)
-	p.VM[pluginName].Registry = require.NewRegistry(require.WithGlobalFolders(filepath.Dir(filename)))
-	p.VM[pluginName].EventLoop = eventloop.NewEventLoop()
-	p.VM[pluginName].EventLoop.Start()
-	p.VM[pluginName].Registry.Enable(vm)
+	container := &Container{
+		Name:        pluginName,
+		VM:          vm,
+		Permissions: permissions,
+		Storage:     storage,
+		Registry:    require.NewRegistry(require.WithGlobalFolders(filepath.Dir(filename))),
+		EventLoop:   eventloop.NewEventLoop(),
+	}
+	container.EventLoop.Start()
+	container.Registry.Enable(vm)
 	url.Enable(vm)
 
 	// Expose backend methods to JS
@@ -71,65 +131,90 @@ func (p *PluginLoader) SetupPluginCalls(loader *PluginLoader, vm *js.Runtime, fi
 		Status int         `json:"status"`
 	}
 
-	vm.Set("musicKit", func(method js.Value, endpoint js.Value, body js.Value) js.Value {
-		musicArgs := new(MusicKitArgs)
-		musicArgs.Method = method.String()
-		musicArgs.Endpoint = endpoint.String()
-		musicArgs.Body = body.String()
+	if permissions[PluginPermissionMusicKit] {
+		vm.Set("musicKit", func(method js.Value, endpoint js.Value, body js.Value) js.Value {
+			musicArgs := new(MusicKitArgs)
+			musicArgs.Method = method.String()
+			musicArgs.Endpoint = endpoint.String()
+			musicArgs.Body = body.String()
 
-		ret := new(EndpointReturn)
-		FujisanRpcObject.MusicKit(nil, musicArgs, ret)
+			ret := new(EndpointReturn)
+			FujisanRpcObject.MusicKit(nil, musicArgs, ret)
 
-		var obj map[string]interface{}
-		err := json.Unmarshal(ret.Body, &obj)
-		if err != nil {
-			return nil
-		}
-		return vm.ToValue(ReadableEndpointReturn{Body: obj, Status: ret.Status})
-	})
+			var obj map[string]interface{}
+			err := json.Unmarshal(ret.Body, &obj)
+			if err != nil {
+				return nil
+			}
+			return vm.ToValue(ReadableEndpointReturn{Body: obj, Status: ret.Status})
+		})
+	}
 
-	vm.Set("alert", func(title js.Value, message js.Value) js.Value {
-		wruntime.MessageDialog(FujisanObject.ctx, wruntime.MessageDialogOptions{
-			Type:    wruntime.InfoDialog,
-			Title:   fmt.Sprintf("%s: %s", filename, title.String()),
-			Message: message.String(),
+	if permissions[PluginPermissionDialogs] {
+		vm.Set("alert", func(title js.Value, message js.Value) js.Value {
+			wruntime.MessageDialog(FujisanObject.ctx, wruntime.MessageDialogOptions{
+				Type:    wruntime.InfoDialog,
+				Title:   fmt.Sprintf("%s: %s", filename, title.String()),
+				Message: message.String(),
+			})
+			return nil
 		})
-		return nil
-	})
+	}
+
+	// Every plugin gets its own storage instead of the config folder
+	vm.Set("storage", container.Storage.api())
+
+	if permissions[PluginPermissionConfigRead] {
+		vm.Set("config", pluginConfig())
+	}
+
+	if permissions[PluginPermissionNetwork] {
+		vm.Set("httpRequest", pluginHttpRequest)
+	}
 
-	// Pass through IO
-	vm.Set("IO", *FujisanIOObject)
+	if permissions[PluginPermissionPlayer] {
+		vm.Set("player", pluginPlayer())
+	}
+	return container
 }
 
-func (p *PluginLoader) LoadPlugin(filename string, pluginName string) {
+// LoadPlugin runs the backend script filename of the plugin in directory
+func (p *PluginLoader) LoadPlugin(filename string, pluginName string, directory string, permissions map[string]bool) {
 	file, err := os.ReadFile(filename)
 	if err != nil {
 		p.Logger.Println("Unable to load:", filename, err)
 		return
 	}
 
+	// The storage is set up before loading in the background, looking up the config path is not safe to do concurrently
+	storage := NewPluginStorage(pluginApprovalKey(p.relativeDirectory(directory), pluginName))
 	go func(loader *PluginLoader, filename string, pluginName string) {
 		formattedName := filepath.Base(filename)
 
 		vm := js.New()
-		p.SetupPluginCalls(loader, vm, filename, pluginName)
+		container := p.SetupPluginCalls(loader, vm, filename, pluginName, storage, permissions)
 
+		// The container is only published once it is complete, a plugin loaded from the same folder before is replaced
 		loader.Mutex.Lock()
-		loader.VM[pluginName].VM = vm
+		replaced := loader.VM[directory]
+		loader.VM[directory] = container
 		loader.Mutex.Unlock()
+		if replaced != nil {
+			replaced.stop()
+		}
 
 		compile, err := js.Compile(formattedName, string(file), false)
 		if err != nil {
-			p.Logger.Println(formattedName+":", err)
+			p.unloadContainer(directory, container)
+			p.reportError(pluginName, fmt.Errorf("%s: %w", formattedName, err))
 			return
 		}
 
-		p.VM[pluginName].EventLoop.RunOnLoop(func(runtime *js.Runtime) {
-			_, err = vm.RunProgram(compile)
-			if err != nil {
-				p.UnloadPlugin(pluginName)
-				loader.Logger.Println(formattedName+":", err)
-				return
+		container.EventLoop.RunOnLoop(func(runtime *js.Runtime) {
+			if _, err := vm.RunProgram(compile); err != nil {
+				// Stopping waits for the loop this runs on, so it happens after returning
+				go p.unloadContainer(directory, container)
+				p.reportError(pluginName, fmt.Errorf("%s: %w", formattedName, err))
 			}
 		})
 	}(p, filename, pluginName)
@@ -152,30 +237,51 @@ func (p *PluginLoader) ReadPluginMetadata(directory string) (metadata *PluginMet
 	return
 }
 
+// LoadPluginDirectory loads the plugin described by the metadata in path into the backend and frontend
+func (p *PluginLoader) LoadPluginDirectory(path string) error {
+	metadata := p.ReadPluginMetadata(path)
+	if metadata == nil {
+		return fmt.Errorf("no valid metadata.json in %s", filepath.Base(path))
+	}
+	p.Logger.Println("Found program metadata")
+	p.Logger.Printf("Name: %v\nVersion: %v\nDescription: %s\nAuthor(s): %v\nFrontend Script: %v\nBackend Script: %v\nPermissions: %v", metadata.Name, metadata.Version, metadata.Description, strings.Join(metadata.Authors, ", "), metadata.FrontendMainScript, metadata.BackendMainScript, strings.Join(metadata.Permissions, ", "))
+	permissions, approved := approvePluginPermissions(p.relativeDirectory(path), metadata)
+	if !approved {
+		p.Logger.Printf("Not loading %s, its permissions were not approved", metadata.Name)
+		return nil
+	}
+
+	p.Mutex.Lock()
+	p.Directories[path] = metadata.Name
+	p.Mutex.Unlock()
+
+	if len(metadata.BackendMainScript) != 0 {
+		p.Logger.Printf("Loading %s into backend", metadata.Name)
+		p.LoadPlugin(filepath.Join(path, metadata.BackendMainScript), metadata.Name, path, permissions)
+	}
+
+	if len(metadata.FrontendMainScript) != 0 {
+		p.Logger.Printf("Loading %s into frontend", metadata.Name)
+		file, err := os.ReadFile(filepath.Join(path, metadata.FrontendMainScript))
+		if err != nil {
+			return fmt.Errorf("unable to load %s: %w", metadata.FrontendMainScript, err)
+		}
+
+		wruntime.WindowExecJS(FujisanObject.ctx, string(file))
+	}
+	return nil
+}
+
 func (p *PluginLoader) LoadPlugins() {
 	if err := os.MkdirAll(p.PluginFolder, os.FileMode(0755)); err != nil {
 		return
 	}
 
 	filepath.Walk(p.PluginFolder, func(path string, info fs.FileInfo, err error) error {
-		if info.IsDir() && info.Name() != "plugins" {
-			if metadata := p.ReadPluginMetadata(path); metadata != nil {
-				p.Logger.Println("Found program metadata")
-				p.Logger.Printf("Name: %v\nVersion: %v\nDescription: %s\nAuthor(s): %v\nFrontend Script: %v\nBackend Script: %v", metadata.Name, metadata.Version, metadata.Description, strings.Join(metadata.Authors, ", "), metadata.FrontendMainScript, metadata.BackendMainScript)
-				if len(metadata.BackendMainScript) != 0 {
-					p.Logger.Printf("Loading %s into backend", metadata.Name)
-					p.LoadPlugin(filepath.Join(path, metadata.BackendMainScript), metadata.Name)
-				}
-
-				if len(metadata.FrontendMainScript) != 0 {
-					p.Logger.Printf("Loading %s into frontend", metadata.Name)
-					file, err := os.ReadFile(filepath.Join(path, metadata.FrontendMainScript))
-					if err != nil {
-						p.Logger.Println("Unable to load:", metadata.FrontendMainScript, err)
-						return nil
-					}
-
-					wruntime.WindowExecJS(FujisanObject.ctx, string(file))
+		if err == nil && info.IsDir() && info.Name() != "plugins" {
+			if _, err := os.Stat(filepath.Join(path, "metadata.json")); err == nil {
+				if err := p.LoadPluginDirectory(path); err != nil {
+					p.Logger.Println(err)
 				}
 			}
 		}
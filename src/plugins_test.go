@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loadedContainer returns the container loaded from a folder
+func loadedContainer(loader *PluginLoader, directory string) *Container {
+	loader.Mutex.Lock()
+	defer loader.Mutex.Unlock()
+	return loader.VM[directory]
+}
+
+// waitForPlugin polls until condition holds for the container loaded from a folder
+func waitForPlugin(t *testing.T, loader *PluginLoader, directory string, what string, condition func(*Container) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition(loadedContainer(loader, directory)) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writePluginScript(t *testing.T, folder string, name string, script string) string {
+	path := filepath.Join(folder, name)
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// lockedBuffer collects the log of a plugin loader
+type lockedBuffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestFailingPluginIsUnloaded(t *testing.T) {
+	folder := t.TempDir()
+	loader := NewPluginLoader(folder)
+	output := new(lockedBuffer)
+	loader.Logger.SetOutput(output)
+
+	loader.LoadPlugin(writePluginScript(t, folder, "broken.js", `throw new Error("broken")`), "Broken", folder, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), "Unloaded: Broken") {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the plugin to be unloaded, log:", output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(output.String(), "broken.js: Error: broken") {
+		t.Error("the error was not reported, log:", output.String())
+	}
+	if loadedContainer(loader, folder) != nil {
+		t.Fatal("the failing plugin is still loaded")
+	}
+}
+
+func TestFailingPluginKeepsItsReplacement(t *testing.T) {
+	folder := t.TempDir()
+	loader := NewPluginLoader(folder)
+
+	// The first script is still running when it is replaced, interrupting it fails the script
+	loader.LoadPlugin(writePluginScript(t, folder, "slow.js", `var start = Date.now(); while (Date.now() - start < 2000) {}`), "Plugin", folder, nil)
+	waitForPlugin(t, loader, folder, "the first plugin to load", func(c *Container) bool { return c != nil })
+	first := loadedContainer(loader, folder)
+
+	loader.LoadPlugin(writePluginScript(t, folder, "fixed.js", `var loaded = true`), "Plugin", folder, nil)
+	waitForPlugin(t, loader, folder, "the replacement to load", func(c *Container) bool { return c != nil && c != first })
+	replacement := loadedContainer(loader, folder)
+
+	// Give the failure of the first script time to unload it
+	time.Sleep(200 * time.Millisecond)
+	if loadedContainer(loader, folder) != replacement {
+		t.Fatal("the failing plugin unloaded its replacement")
+	}
+
+	loader.UnloadPlugin(folder)
+	if loadedContainer(loader, folder) != nil {
+		t.Fatal("the plugin is still loaded")
+	}
+}
+
+// writePluginDirectory creates a plugin folder with a backend script
+func writePluginDirectory(t *testing.T, path string, name string, script string) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writePluginScript(t, path, "metadata.json", `{"name":"`+name+`","BackendMainScript":"index.js"}`)
+	writePluginScript(t, path, "index.js", script)
+}
+
+func TestReloadKeepsSameNamedPlugin(t *testing.T) {
+	folder := t.TempDir()
+	loader := NewPluginLoader(folder)
+	first, second := filepath.Join(folder, "first"), filepath.Join(folder, "second")
+	writePluginDirectory(t, first, "Plugin", `var loaded = true`)
+	writePluginDirectory(t, second, "Plugin", `var loaded = true`)
+
+	loader.LoadPlugins()
+	waitForPlugin(t, loader, first, "the first plugin to load", func(c *Container) bool { return c != nil })
+	waitForPlugin(t, loader, second, "the second plugin to load", func(c *Container) bool { return c != nil })
+	loadedFirst, loadedSecond := loadedContainer(loader, first), loadedContainer(loader, second)
+	if loadedFirst == loadedSecond {
+		t.Fatal("plugins with the same name share a container")
+	}
+
+	loader.ReloadPluginDirectory(first)
+	waitForPlugin(t, loader, first, "the first plugin to reload", func(c *Container) bool { return c != nil && c != loadedFirst })
+	if loadedContainer(loader, second) != loadedSecond {
+		t.Fatal("reloading a plugin unloaded the plugin with the same name in another folder")
+	}
+
+	os.RemoveAll(first)
+	loader.ReloadPluginDirectory(first)
+	if loadedContainer(loader, first) != nil {
+		t.Fatal("the removed plugin is still loaded")
+	}
+	if loadedContainer(loader, second) != loadedSecond {
+		t.Fatal("removing a plugin unloaded the plugin with the same name in another folder")
+	}
+	loader.UnloadPluginDirectory(second)
+	if loadedContainer(loader, second) != nil {
+		t.Fatal("the plugin is still loaded")
+	}
+}
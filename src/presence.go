@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ciderapp/rich-go/client"
+	wruntime "github.com/ciderapp/wails/v2/pkg/runtime"
+)
+
+const (
+	// Discord accepts 5 activity updates every 20 seconds
+	presenceRateLimit  = 5
+	presenceRateWindow = 20 * time.Second
+	// presenceDebounce coalesces bursts such as MusicKit firing now playing twice
+	presenceDebounce = 500 * time.Millisecond
+	// presenceTimestampTolerance ignores timestamp drift between otherwise identical activities
+	presenceTimestampTolerance = 2 * time.Second
+	// Reconnect attempts back off between these durations
+	presenceMinBackoff = time.Second
+	presenceMaxBackoff = time.Minute
+	// presenceHealthInterval is how often the IPC socket is checked while connected
+	presenceHealthInterval = 5 * time.Second
+)
+
+// PresenceConnectionState is the state of the connection to Discord
+type PresenceConnectionState string
+
+const (
+	PresenceDisabled     PresenceConnectionState = "disabled"
+	PresenceDisconnected PresenceConnectionState = "disconnected"
+	PresenceConnecting   PresenceConnectionState = "connecting"
+	PresenceConnected    PresenceConnectionState = "connected"
+)
+
+// PresenceStatus reports the connection to Discord, it is emitted to the frontend as `fujisan:discordState` on every change
+type PresenceStatus struct {
+	State     PresenceConnectionState `json:"state"`
+	Attempts  int                     `json:"attempts"`
+	LastError string                  `json:"lastError"`
+	Since     time.Time               `json:"since"`
+}
+
+// discordConn is the connection to the local Discord client
+type discordConn interface {
+	Login(clientId string) error
+	Logout()
+	SetActivity(activity client.Activity) error
+}
+
+// PresenceManager owns the Discord connection and sends the latest desired activity,
+// skipping activities identical to the last one sent and staying under the Discord rate limit.
+// The lock only guards the state, talking to Discord always happens without holding it so a slow client never blocks callers
+type PresenceManager struct {
+	conn      discordConn
+	clientId  string
+	enabled   bool
+	connected bool
+	// closing asks the supervisor to close the connection
+	closing bool
+	// session changes whenever the connection does, replies from an older connection are ignored
+	session   uint64
+	status    PresenceStatus
+	desired   *client.Activity
+	last      *client.Activity
+	sent      []time.Time
+	wake      chan struct{}
+	reconnect chan struct{}
+	mutex     sync.Mutex
+}
+
+// NewPresenceManager returns a `*PresenceManager` sending activities over conn
+func NewPresenceManager(conn discordConn) *PresenceManager {
+	return &PresenceManager{
+		conn:      conn,
+		enabled:   true,
+		status:    PresenceStatus{State: PresenceDisconnected, Since: time.Now()},
+		wake:      make(chan struct{}, 1),
+		reconnect: make(chan struct{}, 1),
+	}
+}
+
+// Start runs the loop sending activities and the connection supervisor, it is started once by `Cider.Run`
+func (p *PresenceManager) Start() {
+	go func() {
+		for range p.wake {
+			time.Sleep(presenceDebounce)
+			p.flush()
+		}
+	}()
+	go p.supervise()
+}
+
+// notify wakes up the send loop without blocking
+func (p *PresenceManager) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// notifySupervisor wakes up the supervisor without blocking
+func (p *PresenceManager) notifySupervisor() {
+	select {
+	case p.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// setState changes the connection state and reports it, the lock must be held
+func (p *PresenceManager) setState(state PresenceConnectionState, err error) {
+	if err != nil {
+		p.status.LastError = err.Error()
+	}
+	if p.status.State == state && err == nil {
+		return
+	}
+	p.status.State = state
+	p.status.Since = time.Now()
+	if state == PresenceConnected {
+		p.status.Attempts = 0
+		p.status.LastError = ""
+	}
+	if FujisanObject.ctx != nil {
+		wruntime.EventsEmit(FujisanObject.ctx, "fujisan:discordState", p.status)
+	}
+}
+
+// disconnect marks the connection as closed and has the supervisor close it, the lock must be held
+func (p *PresenceManager) disconnect(state PresenceConnectionState, err error) {
+	if p.connected {
+		p.connected = false
+		p.closing = true
+		p.session++
+		p.notifySupervisor()
+	}
+	p.last = nil
+	p.setState(state, err)
+}
+
+// wantsConnection returns if there is something to show in Discord, the lock must be held
+func (p *PresenceManager) wantsConnection() bool {
+	return p.enabled && p.desired != nil && len(p.clientId) != 0
+}
+
+// supervise keeps the connection to Discord open while there is an activity to show.
+// It reconnects with exponential backoff when Discord is not running or restarts, and re-sends the current activity after reconnecting
+func (p *PresenceManager) supervise() {
+	backoff := presenceMinBackoff
+	health := time.NewTicker(presenceHealthInterval)
+	defer health.Stop()
+
+	for {
+		p.mutex.Lock()
+		if p.closing {
+			p.closing = false
+			p.mutex.Unlock()
+			p.conn.Logout()
+			continue
+		}
+		if !p.wantsConnection() || p.connected {
+			connected := p.connected
+			p.mutex.Unlock()
+			if connected && !discordSocketAvailable() {
+				p.mutex.Lock()
+				p.disconnect(PresenceDisconnected, errors.New("discord ipc socket went away"))
+				p.mutex.Unlock()
+				continue
+			}
+			select {
+			case <-p.reconnect:
+			case <-health.C:
+			}
+			continue
+		}
+		clientId := p.clientId
+		p.mutex.Unlock()
+
+		var err error
+		if discordSocketAvailable() {
+			p.mutex.Lock()
+			p.status.Attempts++
+			p.setState(PresenceConnecting, nil)
+			p.mutex.Unlock()
+
+			err = p.conn.Login(clientId)
+
+			p.mutex.Lock()
+			if err == nil && (!p.wantsConnection() || p.clientId != clientId) {
+				// Presence was turned off or moved to another application while logging in
+				p.mutex.Unlock()
+				p.conn.Logout()
+				continue
+			}
+			if err == nil {
+				p.connected = true
+				p.session++
+				p.last = nil
+				p.setState(PresenceConnected, nil)
+				log.Println("Started rich presence")
+			}
+			p.mutex.Unlock()
+		} else {
+			err = errors.New("discord is not running")
+		}
+		if err != nil {
+			p.mutex.Lock()
+			p.setState(PresenceDisconnected, err)
+			p.mutex.Unlock()
+		}
+
+		if err == nil {
+			backoff = presenceMinBackoff
+			p.notify()
+			continue
+		}
+		select {
+		case <-p.reconnect:
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > presenceMaxBackoff {
+			backoff = presenceMaxBackoff
+		}
+	}
+}
+
+// Status returns the current state of the connection to Discord
+func (p *PresenceManager) Status() PresenceStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.status
+}
+
+// SetClientId changes the Discord application, reconnecting if it differs from the current one
+func (p *PresenceManager) SetClientId(clientId string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.clientId == clientId {
+		return
+	}
+	p.clientId = clientId
+	p.disconnect(PresenceDisconnected, nil)
+	p.notifySupervisor()
+}
+
+// SetEnabled turns presence on or off, disabling it disconnects from Discord
+func (p *PresenceManager) SetEnabled(enabled bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.enabled == enabled {
+		return
+	}
+	p.enabled = enabled
+	if enabled {
+		p.setState(PresenceDisconnected, nil)
+	} else {
+		p.disconnect(PresenceDisabled, nil)
+		log.Println("Stopped rich presence")
+	}
+	p.notifySupervisor()
+}
+
+// SetActivity queues an activity to be shown, only the latest queued activity is sent
+func (p *PresenceManager) SetActivity(activity client.Activity) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.desired = &activity
+	p.notify()
+	p.notifySupervisor()
+}
+
+// Clear removes the activity by disconnecting from Discord
+func (p *PresenceManager) Clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.desired = nil
+	p.notify()
+}
+
+// rateLimitWait returns how long to wait before another activity may be sent, the lock must be held
+func (p *PresenceManager) rateLimitWait(now time.Time) time.Duration {
+	recent := p.sent[:0]
+	for _, sent := range p.sent {
+		if now.Sub(sent) < presenceRateWindow {
+			recent = append(recent, sent)
+		}
+	}
+	p.sent = recent
+	if len(p.sent) < presenceRateLimit {
+		return 0
+	}
+	return presenceRateWindow - now.Sub(p.sent[0])
+}
+
+// flush sends the desired activity until it matches the last sent one, waiting out the rate limit when needed
+func (p *PresenceManager) flush() {
+	for {
+		p.mutex.Lock()
+		if !p.enabled || activitiesEqual(p.desired, p.last) {
+			p.mutex.Unlock()
+			return
+		}
+		if p.desired != nil && !p.connected {
+			// The supervisor sends the activity once it has connected
+			p.mutex.Unlock()
+			p.notifySupervisor()
+			return
+		}
+		if p.desired == nil {
+			// Clearing the activity is done by disconnecting
+			p.disconnect(PresenceDisconnected, nil)
+			p.mutex.Unlock()
+			return
+		}
+		if wait := p.rateLimitWait(time.Now()); wait > 0 {
+			p.mutex.Unlock()
+			// Whatever is desired after waiting is sent, so bursts always land on the latest state
+			time.Sleep(wait)
+			continue
+		}
+		p.sent = append(p.sent, time.Now())
+		activity, session := *p.desired, p.session
+		p.mutex.Unlock()
+
+		err := p.conn.SetActivity(activity)
+
+		p.mutex.Lock()
+		if session != p.session {
+			// The connection changed while sending, the supervisor sends the activity again after reconnecting
+			p.mutex.Unlock()
+			continue
+		}
+		var rejected *discordRejection
+		switch {
+		case err == nil:
+			p.last = &activity
+		case errors.As(err, &rejected):
+			// Discord refused this activity but the connection is fine, it isn't retried until the activity changes
+			p.last = &activity
+			p.status.LastError = err.Error()
+		default:
+			p.disconnect(PresenceDisconnected, err)
+		}
+		p.mutex.Unlock()
+		if err != nil {
+			log.Println("Failed to update rich presence:", err)
+			return
+		}
+	}
+}
+
+// timesClose compares two optional times within `presenceTimestampTolerance`
+func timesClose(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	difference := a.Sub(*b)
+	return difference < presenceTimestampTolerance && difference > -presenceTimestampTolerance
+}
+
+// activitiesEqual compares the parts of two activities Cider sets
+func activitiesEqual(a *client.Activity, b *client.Activity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Details != b.Details || a.State != b.State ||
+		a.LargeImage != b.LargeImage || a.LargeText != b.LargeText ||
+		a.SmallImage != b.SmallImage || a.SmallText != b.SmallText {
+		return false
+	}
+	if len(a.Buttons) != len(b.Buttons) {
+		return false
+	}
+	for i := range a.Buttons {
+		if *a.Buttons[i] != *b.Buttons[i] {
+			return false
+		}
+	}
+	if a.Timestamps == nil || b.Timestamps == nil {
+		return a.Timestamps == b.Timestamps
+	}
+	return timesClose(a.Timestamps.Start, b.Timestamps.Start) && timesClose(a.Timestamps.End, b.Timestamps.End)
+}
+
+// GetPresenceStatus returns the state of the connection to Discord
+func (c *Cider) GetPresenceStatus() PresenceStatus {
+	return FujisanPresenceObject.Status()
+}
+
+func (f *FujisanRpc) GetPresenceStatus(r *http.Request, args *interface{}, result *PresenceStatus) error {
+	*result = FujisanPresenceObject.Status()
+	return nil
+}
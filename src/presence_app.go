@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+
+	yomikaki "github.com/freehelpdesk/yomikaki"
+)
+
+// discordSnowflake matches a Discord application id
+var discordSnowflake = regexp.MustCompile(`^[0-9]{17,20}$`)
+
+// PresenceAssets are the images shown in Discord, read from `connectivity.discord.assets`.
+// Images are asset keys of the Discord application or image URLs
+type PresenceAssets struct {
+	// UseArtwork shows the album artwork as the large image, LargeImage is used when it is off or the song has no artwork
+	UseArtwork bool   `json:"useArtwork"`
+	LargeImage string `json:"largeImage"`
+	// CustomLargeImage replaces LargeImage while a custom `connectivity.discord.clientId` is used, as asset keys belong to one application
+	CustomLargeImage string `json:"customLargeImage"`
+	SmallImage       string `json:"smallImage"`
+	SmallText        string `json:"smallText"`
+}
+
+// presenceAssets reads the asset configuration with its defaults
+func (c *Cider) presenceAssets(config map[string]interface{}) PresenceAssets {
+	assets := PresenceAssets{UseArtwork: true}
+	if err := decodeConfig(config, "connectivity.discord.assets", &assets); err != nil {
+		log.Println("Unable to read presence assets:", err)
+	}
+	if id, _ := customClientId(config); len(id) != 0 && len(assets.CustomLargeImage) != 0 {
+		assets.LargeImage = assets.CustomLargeImage
+	}
+	return assets
+}
+
+// largeImage returns the artwork of the song or the fallback asset
+func (p PresenceAssets) largeImage(artwork string) string {
+	if p.UseArtwork && len(artwork) != 0 {
+		return artwork
+	}
+	return p.LargeImage
+}
+
+// presenceClientId returns the Discord application to use. A custom `connectivity.discord.clientId` takes precedence over
+// the built in applications selected by `connectivity.discord.client`, an invalid custom id falls back to them with an error
+func (c *Cider) presenceClientId(config map[string]interface{}) (string, error) {
+	id, err := customClientId(config)
+	if len(id) != 0 {
+		return id, nil
+	}
+
+	client, _ := yomikaki.DirectRead("connectivity.discord.client", config)
+	switch client {
+	case "AppleMusic":
+		return "886578863147192350", err
+	case "Cider-2":
+		return "1020414178047041627", err
+	default:
+		return "911790844204437504", err
+	}
+}
+
+// customClientId returns the valid custom `connectivity.discord.clientId`, or an empty string when it is not set or invalid.
+// The id must be a string, JSON numbers can't hold 17 to 20 digits without losing some of them
+func customClientId(config map[string]interface{}) (string, error) {
+	custom, _ := yomikaki.DirectRead("connectivity.discord.clientId", config)
+	switch custom := custom.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if len(custom) == 0 {
+			return "", nil
+		}
+		if !discordSnowflake.MatchString(custom) {
+			return "", fmt.Errorf("%q is not a valid Discord application id, it must be the 17 to 20 digit id found in the Discord developer portal", custom)
+		}
+		return custom, nil
+	default:
+		return "", errors.New("connectivity.discord.clientId must be a string in quotes, as a number it loses digits")
+	}
+}
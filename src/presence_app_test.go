@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func discordConfig(t *testing.T, discord string) map[string]interface{} {
+	config := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(`{"connectivity":{"discord":`+discord+`}}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestPresenceClientId(t *testing.T) {
+	c := new(Cider)
+	tests := []struct {
+		discord string
+		id      string
+		invalid bool
+	}{
+		{`{}`, "911790844204437504", false},
+		{`{"client":"AppleMusic"}`, "886578863147192350", false},
+		{`{"clientId":"1030900000000000123"}`, "1030900000000000123", false},
+		{`{"clientId":""}`, "911790844204437504", false},
+		{`{"clientId":"cider"}`, "911790844204437504", true},
+		// A number can't hold the id exactly, it must not be turned into 1.0309e+18 or a rounded id
+		{`{"clientId":1030900000000000123,"client":"Cider-2"}`, "1020414178047041627", true},
+	}
+	for _, test := range tests {
+		id, err := c.presenceClientId(discordConfig(t, test.discord))
+		if id != test.id || (err != nil) != test.invalid {
+			t.Errorf("%s: got %q, %v", test.discord, id, err)
+		}
+	}
+}
+
+func TestPresenceAssetsCustomLargeImage(t *testing.T) {
+	c := new(Cider)
+	assets := `"assets":{"largeImage":"cider","customLargeImage":"logo"}`
+
+	if image := c.presenceAssets(discordConfig(t, `{`+assets+`}`)).largeImage(""); image != "cider" {
+		t.Errorf("built in application used %q", image)
+	}
+	if image := c.presenceAssets(discordConfig(t, `{"clientId":"1030900000000000123",`+assets+`}`)).largeImage(""); image != "logo" {
+		t.Errorf("custom application used %q", image)
+	}
+	if image := c.presenceAssets(discordConfig(t, `{"clientId":"1030900000000000123",`+assets+`}`)).largeImage("https://example.com/art.jpg"); image != "https://example.com/art.jpg" {
+		t.Errorf("artwork replaced by %q", image)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"unicode/utf8"
+
+	"github.com/ciderapp/rich-go/client"
+)
+
+// Discord shows at most two buttons and rejects the whole activity when one of them is invalid
+const (
+	discordMaxButtons     = 2
+	discordButtonLabelMax = 32
+	discordButtonUrlMax   = 512
+)
+
+// PresenceButton is a button template read from `connectivity.discord.buttons`, both fields support the status template syntax
+type PresenceButton struct {
+	Label string `json:"label"`
+	Url   string `json:"url"`
+}
+
+// defaultPresenceButtons are used when no buttons are configured
+var defaultPresenceButtons = []PresenceButton{
+	{Label: "Listen on Apple Music", Url: "{appleMusicUrl}"},
+	{Label: "Listen on song.link", Url: "{songLinkUrl}"},
+}
+
+// validPresenceButton checks a button against the limits Discord enforces
+func validPresenceButton(label string, link string) bool {
+	if length := utf8.RuneCountInString(label); length == 0 || length > discordButtonLabelMax {
+		return false
+	}
+	if len(link) == 0 || len(link) > discordButtonUrlMax {
+		return false
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "https" || parsed.Scheme == "http") && len(parsed.Host) != 0
+}
+
+// filterPresenceButtons drops invalid buttons and keeps at most `discordMaxButtons`
+func filterPresenceButtons(buttons []PresenceButton) []*client.Button {
+	var valid []*client.Button
+	for _, button := range buttons {
+		if len(valid) == discordMaxButtons {
+			break
+		}
+		if !validPresenceButton(button.Label, button.Url) {
+			log.Printf("Skipping invalid presence button %q: %q", button.Label, button.Url)
+			continue
+		}
+		valid = append(valid, &client.Button{Label: button.Label, Url: button.Url})
+	}
+	return valid
+}
+
+// presenceButtons renders the configured buttons for a song, buttons whose URL renders empty are left out
+func (c *Cider) presenceButtons(config map[string]interface{}, attributes Attributes) []*client.Button {
+	// Decoding into the defaults would fill the fields left out of the configured buttons with theirs
+	var templates []PresenceButton
+	if err := decodeConfig(config, "connectivity.discord.buttons", &templates); err != nil {
+		log.Println("Unable to read presence buttons:", err)
+		templates = nil
+	}
+	if templates == nil {
+		templates = defaultPresenceButtons
+	}
+
+	var rendered []PresenceButton
+	for _, button := range templates {
+		link := renderTemplate(button.Url, attributes)
+		if len(link) == 0 {
+			continue
+		}
+		rendered = append(rendered, PresenceButton{Label: renderTemplate(button.Label, attributes), Url: link})
+	}
+	return filterPresenceButtons(rendered)
+}
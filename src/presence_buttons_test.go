@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func testButtonConfig(t *testing.T, buttons string) map[string]interface{} {
+	config := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(`{"connectivity":{"discord":{"buttons":`+buttons+`}}}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestPresenceButtons(t *testing.T) {
+	song := testSong
+	song.URL.AppleMusic = "https://music.apple.com/us/song/1"
+	song.URL.SongLink = "https://song.link/i/1"
+	c := new(Cider)
+
+	buttons := c.presenceButtons(map[string]interface{}{}, song)
+	if len(buttons) != 2 || buttons[0].Label != "Listen on Apple Music" || buttons[0].Url != song.URL.AppleMusic || buttons[1].Url != song.URL.SongLink {
+		t.Fatalf("expected the default buttons, got %+v", buttons)
+	}
+
+	// A button without a label is invalid rather than taking the label of a default button
+	buttons = c.presenceButtons(testButtonConfig(t, `[{"url":"https://example.com/{name}"},{"label":"{artist}","url":"{songLinkUrl}"}]`), song)
+	if len(buttons) != 1 || buttons[0].Label != "Daft Punk" || buttons[0].Url != song.URL.SongLink {
+		t.Fatalf("unexpected buttons %+v", buttons)
+	}
+	if defaultPresenceButtons[0].Url != "{appleMusicUrl}" || defaultPresenceButtons[1].Label != "Listen on song.link" {
+		t.Fatalf("the default buttons were changed to %+v", defaultPresenceButtons)
+	}
+
+	if buttons := c.presenceButtons(testButtonConfig(t, `[]`), song); len(buttons) != 0 {
+		t.Fatalf("an empty list should turn the buttons off, got %+v", buttons)
+	}
+}
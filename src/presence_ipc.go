@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ciderapp/rich-go/client"
+	yomikaki "github.com/freehelpdesk/yomikaki"
+)
+
+// Discord IPC opcodes
+const (
+	discordOpHandshake uint32 = 0
+	discordOpFrame     uint32 = 1
+	discordOpClose     uint32 = 2
+)
+
+const (
+	// discordIPCTimeout bounds every exchange with Discord so a hung client can't block the presence manager
+	discordIPCTimeout = 5 * time.Second
+	// discordIPCMaxFrame is the largest frame accepted from Discord
+	discordIPCMaxFrame = 1 << 20
+)
+
+// discordIPCOverride returns the socket paths of `connectivity.discord.ipcPath`, which is either a socket or a directory containing `discord-ipc-N`
+func discordIPCOverride() []string {
+	read, _ := yomikaki.DirectRead("connectivity.discord.ipcPath", loadConfig())
+	path, _ := read.(string)
+	if len(path) == 0 {
+		return nil
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		var paths []string
+		for i := 0; i < 10; i++ {
+			paths = append(paths, filepath.Join(path, fmt.Sprintf("discord-ipc-%d", i)))
+		}
+		return paths
+	}
+	return []string{path}
+}
+
+// discordSocketAvailable checks if any Discord IPC socket exists
+func discordSocketAvailable() bool {
+	return len(discordSocketPaths()) != 0
+}
+
+// discordRejection is returned when Discord answers a command with an ERROR event, the connection stays usable
+type discordRejection struct {
+	Code    int
+	Message string
+}
+
+func (d *discordRejection) Error() string {
+	return fmt.Sprintf("discord rejected the activity: %s (%d)", d.Message, d.Code)
+}
+
+// discordFrame is the JSON payload of an IPC frame
+type discordFrame struct {
+	Cmd   string          `json:"cmd,omitempty"`
+	Evt   string          `json:"evt,omitempty"`
+	Nonce string          `json:"nonce,omitempty"`
+	Args  interface{}     `json:"args,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	// Code and Message are set on close frames
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// discordIPC speaks the Discord IPC protocol: every frame is a little endian opcode and length followed by a JSON payload
+type discordIPC struct {
+	conn  io.ReadWriteCloser
+	mutex sync.Mutex
+}
+
+// NewDiscordIPC returns a `*discordIPC` which connects to the first Discord socket accepting the handshake
+func NewDiscordIPC() *discordIPC {
+	return new(discordIPC)
+}
+
+// deadline bounds the next exchange when the connection supports it
+func (d *discordIPC) deadline() {
+	if conn, ok := d.conn.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = conn.SetDeadline(time.Now().Add(discordIPCTimeout))
+	}
+}
+
+func (d *discordIPC) write(op uint32, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 8, 8+len(b))
+	binary.LittleEndian.PutUint32(frame[0:4], op)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(b)))
+	_, err = d.conn.Write(append(frame, b...))
+	return err
+}
+
+func (d *discordIPC) read() (uint32, *discordFrame, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(d.conn, header); err != nil {
+		return 0, nil, err
+	}
+	op := binary.LittleEndian.Uint32(header[0:4])
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if length > discordIPCMaxFrame {
+		return 0, nil, fmt.Errorf("discord sent a frame of %d bytes", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(d.conn, body); err != nil {
+		return 0, nil, err
+	}
+	frame := new(discordFrame)
+	if err := json.Unmarshal(body, frame); err != nil {
+		return 0, nil, err
+	}
+	if op == discordOpClose {
+		return op, frame, fmt.Errorf("discord closed the connection: %s (%d)", frame.Message, frame.Code)
+	}
+	return op, frame, nil
+}
+
+// handshake identifies as the application and waits for Discord to be ready, the lock must be held
+func (d *discordIPC) handshake(clientId string) error {
+	d.deadline()
+	if err := d.write(discordOpHandshake, map[string]interface{}{"v": 1, "client_id": clientId}); err != nil {
+		return err
+	}
+	_, frame, err := d.read()
+	if err != nil {
+		return err
+	}
+	if frame.Evt != "READY" {
+		return fmt.Errorf("unexpected handshake reply %q", frame.Evt)
+	}
+	return nil
+}
+
+// Login connects to the first socket which accepts the handshake
+func (d *discordIPC) Login(clientId string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.close()
+
+	err := errors.New("discord ipc socket not found")
+	for _, path := range discordSocketPaths() {
+		conn, dialErr := dialDiscord(path)
+		if dialErr != nil {
+			err = dialErr
+			continue
+		}
+		d.conn = conn
+		if err = d.handshake(clientId); err == nil {
+			return nil
+		}
+		d.close()
+	}
+	return err
+}
+
+// close closes the connection, the lock must be held
+func (d *discordIPC) close() {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+func (d *discordIPC) Logout() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.close()
+}
+
+// discordNonce returns a random nonce to match replies with commands
+func discordNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// discordActivityPayload converts an activity into the shape Discord expects, leaving out empty fields Discord would reject
+func discordActivityPayload(activity client.Activity) map[string]interface{} {
+	payload := make(map[string]interface{})
+	set := func(m map[string]interface{}, key string, value string) {
+		if len(value) != 0 {
+			m[key] = value
+		}
+	}
+	set(payload, "details", activity.Details)
+	set(payload, "state", activity.State)
+
+	assets := make(map[string]interface{})
+	set(assets, "large_image", activity.LargeImage)
+	set(assets, "large_text", activity.LargeText)
+	set(assets, "small_image", activity.SmallImage)
+	set(assets, "small_text", activity.SmallText)
+	if len(assets) != 0 {
+		payload["assets"] = assets
+	}
+
+	if activity.Timestamps != nil {
+		timestamps := make(map[string]interface{})
+		if activity.Timestamps.Start != nil {
+			timestamps["start"] = activity.Timestamps.Start.UnixMilli()
+		}
+		if activity.Timestamps.End != nil {
+			timestamps["end"] = activity.Timestamps.End.UnixMilli()
+		}
+		payload["timestamps"] = timestamps
+	}
+
+	var buttons []map[string]string
+	for _, button := range activity.Buttons {
+		buttons = append(buttons, map[string]string{"label": button.Label, "url": button.Url})
+	}
+	if len(buttons) != 0 {
+		payload["buttons"] = buttons
+	}
+	return payload
+}
+
+// SetActivity sends a SET_ACTIVITY command and waits for Discord to accept it
+func (d *discordIPC) SetActivity(activity client.Activity) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.conn == nil {
+		return errors.New("not connected to discord")
+	}
+
+	nonce := discordNonce()
+	d.deadline()
+	if err := d.write(discordOpFrame, discordFrame{
+		Cmd:   "SET_ACTIVITY",
+		Nonce: nonce,
+		Args: map[string]interface{}{
+			"pid":      os.Getpid(),
+			"activity": discordActivityPayload(activity),
+		},
+	}); err != nil {
+		d.close()
+		return err
+	}
+
+	for {
+		_, frame, err := d.read()
+		if err != nil {
+			d.close()
+			return err
+		}
+		if frame.Nonce != nonce {
+			continue
+		}
+		if frame.Evt == "ERROR" {
+			rejection := new(discordRejection)
+			_ = json.Unmarshal(frame.Data, rejection)
+			return rejection
+		}
+		return nil
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ciderapp/rich-go/client"
+)
+
+// fakeDiscordServer is the Discord side of an IPC connection
+type fakeDiscordServer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// fakeDiscord returns a `*discordIPC` connected to a fake Discord client
+func fakeDiscord(t *testing.T) (*discordIPC, *fakeDiscordServer) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	return &discordIPC{conn: client}, &fakeDiscordServer{t, server}
+}
+
+func (f *fakeDiscordServer) read() (uint32, map[string]interface{}) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f.conn, header); err != nil {
+		f.t.Error(err)
+		return 0, nil
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(header[4:8]))
+	if _, err := io.ReadFull(f.conn, body); err != nil {
+		f.t.Error(err)
+		return 0, nil
+	}
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(body, &payload); err != nil {
+		f.t.Error(err)
+	}
+	return binary.LittleEndian.Uint32(header[0:4]), payload
+}
+
+func (f *fakeDiscordServer) write(op uint32, payload interface{}) {
+	b, _ := json.Marshal(payload)
+	frame := make([]byte, 8)
+	binary.LittleEndian.PutUint32(frame[0:4], op)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(b)))
+	if _, err := f.conn.Write(append(frame, b...)); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func TestDiscordIPCHandshake(t *testing.T) {
+	ipc, server := fakeDiscord(t)
+	done := make(chan error)
+	go func() { done <- ipc.handshake("911790844204437504") }()
+
+	op, payload := server.read()
+	if op != discordOpHandshake || payload["v"] != 1.0 || payload["client_id"] != "911790844204437504" {
+		t.Fatalf("unexpected handshake %d %v", op, payload)
+	}
+	server.write(discordOpFrame, map[string]interface{}{"cmd": "DISPATCH", "evt": "READY"})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscordIPCHandshakeClosed(t *testing.T) {
+	ipc, server := fakeDiscord(t)
+	done := make(chan error)
+	go func() { done <- ipc.handshake("911790844204437504") }()
+
+	server.read()
+	server.write(discordOpClose, map[string]interface{}{"code": 4000, "message": "Invalid Client ID"})
+	if err := <-done; err == nil {
+		t.Fatal("a closed handshake should fail")
+	}
+}
+
+func TestDiscordIPCSetActivity(t *testing.T) {
+	ipc, server := fakeDiscord(t)
+	start := time.UnixMilli(1700000000000)
+	done := make(chan error)
+	go func() {
+		done <- ipc.SetActivity(client.Activity{
+			Details:    "One More Time",
+			State:      "Daft Punk",
+			LargeImage: "https://example.com/art.jpg",
+			Timestamps: &client.Timestamps{Start: &start},
+		})
+	}()
+
+	op, payload := server.read()
+	if op != discordOpFrame || payload["cmd"] != "SET_ACTIVITY" {
+		t.Fatalf("unexpected frame %d %v", op, payload)
+	}
+	args, _ := payload["args"].(map[string]interface{})
+	activity, _ := args["activity"].(map[string]interface{})
+	assets, _ := activity["assets"].(map[string]interface{})
+	timestamps, _ := activity["timestamps"].(map[string]interface{})
+	if activity["details"] != "One More Time" || activity["state"] != "Daft Punk" || assets["large_image"] != "https://example.com/art.jpg" || timestamps["start"] != 1700000000000.0 {
+		t.Errorf("unexpected activity %v", activity)
+	}
+	if _, ok := assets["small_image"]; ok {
+		t.Error("empty fields must be left out")
+	}
+	if _, ok := args["pid"].(float64); !ok {
+		t.Error("missing pid")
+	}
+
+	// Replies to other commands are skipped until the one matching the nonce
+	server.write(discordOpFrame, map[string]interface{}{"cmd": "DISPATCH", "evt": "ACTIVITY_JOIN", "nonce": "other"})
+	server.write(discordOpFrame, map[string]interface{}{"cmd": "SET_ACTIVITY", "nonce": payload["nonce"], "data": activity})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscordIPCRejectedActivityKeepsConnection(t *testing.T) {
+	ipc, server := fakeDiscord(t)
+	done := make(chan error)
+	go func() { done <- ipc.SetActivity(client.Activity{Details: "One More Time"}) }()
+
+	_, payload := server.read()
+	server.write(discordOpFrame, map[string]interface{}{
+		"cmd":   "SET_ACTIVITY",
+		"evt":   "ERROR",
+		"nonce": payload["nonce"],
+		"data":  map[string]interface{}{"code": 4000, "message": "child \"activity\" fails"},
+	})
+	err := <-done
+	var rejected *discordRejection
+	if !errors.As(err, &rejected) || rejected.Code != 4000 || rejected.Message != "child \"activity\" fails" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ipc.conn == nil {
+		t.Fatal("a rejected activity must keep the connection")
+	}
+
+	go func() { done <- ipc.SetActivity(client.Activity{Details: "Aerodynamic"}) }()
+	_, payload = server.read()
+	server.write(discordOpFrame, map[string]interface{}{"cmd": "SET_ACTIVITY", "nonce": payload["nonce"]})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscordIPCClosedConnection(t *testing.T) {
+	ipc, server := fakeDiscord(t)
+	done := make(chan error)
+	go func() { done <- ipc.SetActivity(client.Activity{Details: "One More Time"}) }()
+
+	server.read()
+	server.write(discordOpClose, map[string]interface{}{"code": 1000, "message": "bye"})
+	var rejected *discordRejection
+	if err := <-done; err == nil || errors.As(err, &rejected) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ipc.conn != nil {
+		t.Fatal("a closed connection should be dropped")
+	}
+}
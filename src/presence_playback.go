@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ciderapp/rich-go/client"
+)
+
+// PresencePlaybackConfig is read from `connectivity.discord`
+type PresencePlaybackConfig struct {
+	HideTimestamp bool `json:"hideTimestamp"`
+	// PausedImage is an asset key of the Discord application, or an image URL, shown while paused. Empty keeps the small image
+	PausedImage string `json:"pausedImage"`
+	PausedText  string `json:"pausedText"`
+	// IdleTimeout is how many seconds presence stays paused before going idle, 0 keeps it forever
+	IdleTimeout int `json:"idleTimeout"`
+	// IdleAction is `clear` to remove the presence or `idle` to switch to `IdlePresence`
+	IdleAction string `json:"idleAction"`
+}
+
+// presencePlaybackConfig returns the playback options with their defaults
+func (c *Cider) presencePlaybackConfig(config map[string]interface{}) PresencePlaybackConfig {
+	options := PresencePlaybackConfig{
+		PausedText: "Paused",
+		IdleAction: "clear",
+	}
+	if err := decodeConfig(config, "connectivity.discord", &options); err != nil {
+		log.Println("Unable to read presence playback options:", err)
+	}
+	return options
+}
+
+// presencePlayback tracks the position in the current song so the Discord progress bar follows seeking and pausing
+type presencePlayback struct {
+	start       time.Time
+	duration    time.Duration
+	elapsed     time.Duration
+	paused      bool
+	pausedSince time.Time
+	// smallImage and smallText are shown while playing, the paused indicator replaces them
+	smallImage string
+	smallText  string
+	idle       *time.Timer
+	mutex      sync.Mutex
+}
+
+// secondsToDuration converts the seconds MusicKit reports into a duration
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// stopIdle cancels a pending idle timeout, the lock must be held
+func (p *presencePlayback) stopIdle() {
+	if p.idle != nil {
+		p.idle.Stop()
+		p.idle = nil
+	}
+}
+
+// reset starts tracking a new song playing from position, the lock must be held
+func (p *presencePlayback) reset(position time.Duration, duration time.Duration) {
+	p.stopIdle()
+	p.start = time.Now().Add(-position)
+	p.duration = duration
+	p.paused = false
+}
+
+// seek moves the position, a paused song stays paused. The lock must be held
+func (p *presencePlayback) seek(position time.Duration) {
+	if p.paused {
+		p.elapsed = position
+		return
+	}
+	p.start = time.Now().Add(-position)
+}
+
+// timestamps returns the start and end of the song as if it keeps playing from now, nil while paused. The lock must be held
+func (p *presencePlayback) timestamps() *client.Timestamps {
+	if p.paused || p.start.IsZero() {
+		return nil
+	}
+	start := p.start
+	timestamps := &client.Timestamps{Start: &start}
+	if p.duration > 0 {
+		end := start.Add(p.duration)
+		if !time.Now().Before(end) {
+			return timestamps
+		}
+		timestamps.End = &end
+	}
+	return timestamps
+}
+
+// applyPlayback sets the timestamps and paused indicator of the activity from the playback state, the lock must be held
+func (c *Cider) applyPlayback(options PresencePlaybackConfig) {
+	c.Activity.Timestamps = nil
+	if !options.HideTimestamp {
+		c.Activity.Timestamps = c.playback.timestamps()
+	}
+	c.Activity.SmallImage, c.Activity.SmallText = c.playback.smallImage, c.playback.smallText
+	if c.playback.paused {
+		if len(options.PausedImage) != 0 {
+			c.Activity.SmallImage = options.PausedImage
+		}
+		c.Activity.SmallText = truncateDiscordText(options.PausedText)
+	}
+}
+
+// setPresencePaused pauses or resumes the progress bar and schedules going idle while paused, the lock must be held
+func (c *Cider) setPresencePaused(paused bool, options PresencePlaybackConfig) {
+	p := &c.playback
+	if p.paused == paused {
+		return
+	}
+	p.stopIdle()
+	p.paused = paused
+	if !paused {
+		p.start = time.Now().Add(-p.elapsed)
+		return
+	}
+
+	p.elapsed = time.Since(p.start)
+	p.pausedSince = time.Now()
+	if options.IdleTimeout > 0 {
+		timeout := time.Duration(options.IdleTimeout) * time.Second
+		p.idle = time.AfterFunc(timeout, func() {
+			c.presenceIdle(timeout, options.IdleAction)
+		})
+	}
+}
+
+// presenceIdle clears the presence or switches to `IdlePresence` when the song is still paused after timeout
+func (c *Cider) presenceIdle(timeout time.Duration, action string) {
+	c.playback.mutex.Lock()
+	idle := c.playback.paused && time.Since(c.playback.pausedSince) >= timeout
+	c.playback.mutex.Unlock()
+	if !idle {
+		return
+	}
+
+	if action == "idle" {
+		c.IdlePresence()
+	} else {
+		log.Println("Clearing rich presence after being paused for", timeout)
+		FujisanPresenceObject.Clear()
+	}
+}
+
+// SyncPresenceTime re-syncs the Discord progress bar to the playback position in seconds, it is called by the frontend after seeking
+func (c *Cider) SyncPresenceTime(currentPlaybackTime float64) {
+	FujisanPlaybackObject.Seek(currentPlaybackTime)
+	options := c.presencePlaybackConfig(loadConfig())
+
+	c.playback.mutex.Lock()
+	defer c.playback.mutex.Unlock()
+	if c.playback.start.IsZero() {
+		return
+	}
+	c.playback.seek(secondsToDuration(currentPlaybackTime))
+	c.applyPlayback(options)
+	c.sendPresence()
+}
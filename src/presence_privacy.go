@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// PresencePrivacy is a set of rules which keep songs out of Discord, it is read from `connectivity.discord.privacy`
+type PresencePrivacy struct {
+	Artists      []string `json:"artists"`
+	Albums       []string `json:"albums"`
+	Playlists    []string `json:"playlists"`
+	Genres       []string `json:"genres"`
+	HideExplicit bool     `json:"hideExplicit"`
+	// ArtistOnly shows the artist without the song, album, artwork or buttons
+	ArtistOnly bool `json:"artistOnly"`
+	// PrivateListening is the private listening toggle Cider starts with
+	PrivateListening bool `json:"privateListening"`
+}
+
+// Match returns true and a description of the rule when the song should not be shown.
+// Playlists match the name or the id of the playlist the song is playing from
+func (p *PresencePrivacy) Match(attributes Attributes) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	if artist, ok := containsFold(p.Artists, attributes.ArtistName); ok {
+		return fmt.Sprintf("artist is %q", artist), true
+	}
+	if album, ok := containsFold(p.Albums, attributes.AlbumName); ok {
+		return fmt.Sprintf("album is %q", album), true
+	}
+	if strings.Contains(attributes.Container.Type, "playlist") {
+		for _, value := range []string{attributes.Container.Name, attributes.Container.ID} {
+			if len(value) == 0 {
+				continue
+			}
+			if playlist, ok := containsFold(p.Playlists, value); ok {
+				return fmt.Sprintf("playlist is %q", playlist), true
+			}
+		}
+	}
+	for _, genre := range attributes.GenreNames {
+		if match, ok := containsFold(p.Genres, genre); ok {
+			return fmt.Sprintf("genre is %q", match), true
+		}
+	}
+	if p.HideExplicit && strings.EqualFold(attributes.ContentRating, "explicit") {
+		return "song is explicit", true
+	}
+	return "", false
+}
+
+// presencePrivacy reads the current privacy rules from the config
+func (c *Cider) presencePrivacy(config map[string]interface{}) *PresencePrivacy {
+	privacy := new(PresencePrivacy)
+	if err := decodeConfig(config, "connectivity.discord.privacy", privacy); err != nil {
+		log.Println("Unable to read presence privacy rules:", err)
+	}
+	return privacy
+}
+
+// artistOnlyTemplates replace the configured templates in artist only mode
+var artistOnlyTemplates = PresenceTemplates{
+	Details:   "{artist}",
+	LargeText: "{artist}",
+}
+
+// sendPresence shows the current activity unless private listening is on or the song is hidden, the playback lock must be held
+func (c *Cider) sendPresence() {
+	if c.privateListening.Load() || c.presenceHidden {
+		FujisanPresenceObject.Clear()
+		return
+	}
+	FujisanPresenceObject.SetActivity(c.Activity)
+}
+
+// SetPrivateListening turns private listening on or off, presence is cleared right away while it is on
+func (c *Cider) SetPrivateListening(private bool) {
+	if c.privateListening.Swap(private) == private {
+		return
+	}
+	log.Println("Private listening:", private)
+
+	c.playback.mutex.Lock()
+	defer c.playback.mutex.Unlock()
+	if private || c.playback.start.IsZero() {
+		FujisanPresenceObject.Clear()
+		return
+	}
+	c.applyPlayback(c.presencePlaybackConfig(loadConfig()))
+	c.sendPresence()
+}
+
+// TogglePrivateListening flips private listening and returns the new state
+func (c *Cider) TogglePrivateListening() bool {
+	private := !c.privateListening.Load()
+	c.SetPrivateListening(private)
+	return private
+}
+
+// GetPrivateListening returns if private listening is on
+func (c *Cider) GetPrivateListening() bool {
+	return c.privateListening.Load()
+}
+
+type PrivateListeningArgs struct {
+	Private *bool `json:"private"`
+}
+
+type PrivateListeningType struct {
+	Private bool `json:"private"`
+}
+
+// SetPrivateListening sets private listening, it is toggled when private is left out
+func (f *FujisanRpc) SetPrivateListening(r *http.Request, args *PrivateListeningArgs, result *PrivateListeningType) error {
+	if args == nil {
+		return errors.New("must pass in arguments")
+	}
+	if args.Private == nil {
+		*result = PrivateListeningType{FujisanObject.TogglePrivateListening()}
+		return nil
+	}
+	FujisanObject.SetPrivateListening(*args.Private)
+	*result = PrivateListeningType{*args.Private}
+	return nil
+}
+
+func (f *FujisanRpc) GetPrivateListening(r *http.Request, args *interface{}, result *PrivateListeningType) error {
+	*result = PrivateListeningType{FujisanObject.GetPrivateListening()}
+	return nil
+}
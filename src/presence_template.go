@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Discord rejects activity text outside of these lengths, counted in UTF-16 code units
+const (
+	discordTextMin = 2
+	discordTextMax = 128
+)
+
+// PresenceTemplates is a set of templates for one kind of item, read from `connectivity.discord.templates.<kind>`
+type PresenceTemplates struct {
+	Details   string `json:"details"`
+	State     string `json:"state"`
+	LargeText string `json:"largeText"`
+}
+
+// templateValues returns the placeholders available to status templates
+func templateValues(attributes Attributes) map[string]string {
+	values := map[string]string{
+		"artist":   attributes.ArtistName,
+		"name":     attributes.Name,
+		"album":    attributes.AlbumName,
+		"composer": attributes.ComposerName,
+		"kind":     attributes.Kind,
+		"id":       attributes.PlayParams.ID,
+
+		"appleMusicUrl": attributes.URL.AppleMusic,
+		"songLinkUrl":   attributes.URL.SongLink,
+		"ciderUrl":      attributes.URL.Cider,
+	}
+	if len(attributes.GenreNames) != 0 {
+		values["genre"] = attributes.GenreNames[0]
+	}
+	if !attributes.ReleaseDate.IsZero() {
+		values["year"] = strconv.Itoa(attributes.ReleaseDate.Year())
+	}
+	if attributes.TrackNumber > 0 {
+		values["track"] = strconv.Itoa(attributes.TrackNumber)
+	}
+	if attributes.DiscNumber > 0 {
+		values["disc"] = strconv.Itoa(attributes.DiscNumber)
+	}
+	if attributes.DurationInMillis > 0 {
+		seconds := attributes.DurationInMillis / 1000
+		if seconds >= 3600 {
+			values["duration"] = fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+		} else {
+			values["duration"] = fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+		}
+	}
+	return values
+}
+
+// templateRenderer renders status templates:
+//
+//	{name}               a placeholder
+//	{composer|artist}    the first non-empty placeholder
+//	{album|"Single"}     a quoted fallback
+//	[ on {album}]        a section only shown when every placeholder inside it is non-empty
+//	\{ \[ \] \\          literal characters
+type templateRenderer struct {
+	source []rune
+	pos    int
+	values map[string]string
+}
+
+// evaluate returns the first non-empty alternative of a placeholder expression
+func (t *templateRenderer) evaluate(expression string) string {
+	for _, alternative := range strings.Split(expression, "|") {
+		alternative = strings.TrimSpace(alternative)
+		if len(alternative) >= 2 && strings.HasPrefix(alternative, `"`) && strings.HasSuffix(alternative, `"`) {
+			if value := alternative[1 : len(alternative)-1]; len(value) != 0 {
+				return value
+			}
+			continue
+		}
+		if value := t.values[alternative]; len(value) != 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+// render renders until the end of the template, or the end of the section when inSection is set.
+// It returns false when a placeholder rendered empty
+func (t *templateRenderer) render(inSection bool) (string, bool) {
+	var out strings.Builder
+	complete := true
+	for t.pos < len(t.source) {
+		char := t.source[t.pos]
+		t.pos++
+		switch char {
+		case '\\':
+			if t.pos < len(t.source) {
+				out.WriteRune(t.source[t.pos])
+				t.pos++
+			}
+		case '{':
+			end := t.pos
+			for end < len(t.source) && t.source[end] != '}' {
+				end++
+			}
+			value := t.evaluate(string(t.source[t.pos:end]))
+			t.pos = end + 1
+			if len(value) == 0 {
+				complete = false
+			}
+			out.WriteString(value)
+		case '[':
+			if section, ok := t.render(true); ok {
+				out.WriteString(section)
+			}
+		case ']':
+			if inSection {
+				return out.String(), complete
+			}
+			out.WriteRune(char)
+		default:
+			out.WriteRune(char)
+		}
+	}
+	return out.String(), complete
+}
+
+// renderTemplate renders a status template against the song
+func renderTemplate(template string, attributes Attributes) string {
+	return renderTemplateValues(template, templateValues(attributes))
+}
+
+// renderTemplateValues renders a status template against any set of placeholders
+func renderTemplateValues(template string, values map[string]string) string {
+	renderer := &templateRenderer{source: []rune(template), values: values}
+	out, _ := renderer.render(false)
+	return strings.TrimSpace(out)
+}
+
+// utf16Len returns the number of UTF-16 code units needed for a rune
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// truncateDiscordText fits text into Discord's length limits without splitting characters,
+// long text is cut with an ellipsis, text below the minimum is padded with a zero width space and empty text stays empty
+func truncateDiscordText(text string) string {
+	if len(text) == 0 {
+		return ""
+	}
+	length := len(utf16.Encode([]rune(text)))
+	if length < discordTextMin {
+		return text + "\u200b"
+	}
+	if length <= discordTextMax {
+		return text
+	}
+
+	runes := []rune(text)
+	units := 0
+	cut := 0
+	// Leave one unit for the ellipsis
+	for cut < len(runes) && units+utf16Len(runes[cut]) <= discordTextMax-1 {
+		units += utf16Len(runes[cut])
+		cut++
+	}
+	// Don't leave half of a combined character or emoji sequence at the end
+	for cut > 0 && (unicode.Is(unicode.Mn, runes[cut]) || runes[cut-1] == '\u200d' || unicode.Is(unicode.Variation_Selector, runes[cut])) {
+		cut--
+	}
+	return strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace) + "…"
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ciderapp/rich-go/client"
+)
+
+// fakeDiscordConn answers SetActivity with err, and reads the manager status while doing so to prove the lock isn't held
+type fakeDiscordConn struct {
+	manager    *PresenceManager
+	err        error
+	activities []client.Activity
+	logouts    int
+	mutex      sync.Mutex
+}
+
+func (f *fakeDiscordConn) Login(clientId string) error {
+	return nil
+}
+
+func (f *fakeDiscordConn) Logout() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.logouts++
+}
+
+func (f *fakeDiscordConn) SetActivity(activity client.Activity) error {
+	f.manager.Status()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.activities = append(f.activities, activity)
+	return f.err
+}
+
+func connectedPresenceManager(err error) (*PresenceManager, *fakeDiscordConn) {
+	conn := &fakeDiscordConn{err: err}
+	manager := NewPresenceManager(conn)
+	conn.manager = manager
+	manager.clientId = "1000000000000000000"
+	manager.connected = true
+	manager.status.State = PresenceConnected
+	return manager, conn
+}
+
+func TestPresenceManagerSendsActivity(t *testing.T) {
+	manager, conn := connectedPresenceManager(nil)
+
+	manager.SetActivity(client.Activity{Details: "One More Time", State: "Daft Punk"})
+	manager.flush()
+	manager.flush()
+
+	if len(conn.activities) != 1 || conn.activities[0].Details != "One More Time" {
+		t.Fatalf("expected the activity to be sent once, got %+v", conn.activities)
+	}
+}
+
+func TestPresenceManagerKeepsConnectionWhenRejected(t *testing.T) {
+	manager, conn := connectedPresenceManager(&discordRejection{Code: 4000, Message: "child \"activity\" fails"})
+
+	manager.SetActivity(client.Activity{Details: "One More Time", State: "Daft Punk"})
+	manager.flush()
+	// The rejected activity isn't retried until it changes
+	manager.flush()
+
+	if len(conn.activities) != 1 {
+		t.Fatalf("expected one attempt, got %d", len(conn.activities))
+	}
+	status := manager.Status()
+	if !manager.connected || manager.closing || status.State != PresenceConnected {
+		t.Fatalf("a rejected activity must not disconnect, status %+v", status)
+	}
+	if len(status.LastError) == 0 {
+		t.Fatal("the rejection should be reported")
+	}
+
+	manager.SetActivity(client.Activity{Details: "Aerodynamic", State: "Daft Punk"})
+	manager.flush()
+	if len(conn.activities) != 2 {
+		t.Fatalf("a changed activity should be sent, got %d attempts", len(conn.activities))
+	}
+}
+
+func TestPresenceManagerDisconnectsOnConnectionError(t *testing.T) {
+	manager, conn := connectedPresenceManager(errors.New("broken pipe"))
+
+	manager.SetActivity(client.Activity{Details: "One More Time", State: "Daft Punk"})
+	manager.flush()
+
+	if manager.connected || !manager.closing {
+		t.Fatal("a connection error should disconnect")
+	}
+	if status := manager.Status(); status.State != PresenceDisconnected || status.LastError != "broken pipe" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if len(conn.activities) != 1 {
+		t.Fatalf("expected one attempt, got %d", len(conn.activities))
+	}
+}
+
+func TestPresenceManagerClearDisconnects(t *testing.T) {
+	manager, _ := connectedPresenceManager(nil)
+
+	manager.SetActivity(client.Activity{Details: "One More Time", State: "Daft Punk"})
+	manager.flush()
+	manager.Clear()
+	manager.flush()
+
+	if manager.connected || !manager.closing {
+		t.Fatal("clearing the activity should disconnect")
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// discordSandboxes are the directories Flatpak and Snap builds of Discord create their socket in, relative to the runtime directory
+var discordSandboxes = []string{
+	"",
+	"app/com.discordapp.Discord",
+	"app/com.discordapp.DiscordCanary",
+	"app/com.discordapp.DiscordPTB",
+	"snap.discord",
+	"snap.discord-canary",
+}
+
+// discordSocketPaths returns the `discord-ipc-N` sockets that exist, the configured override comes first
+func discordSocketPaths() []string {
+	var directories []string
+	for _, variable := range []string{"XDG_RUNTIME_DIR", "TMPDIR", "TMP", "TEMP"} {
+		if directory := os.Getenv(variable); len(directory) != 0 {
+			directories = append(directories, directory)
+		}
+	}
+	directories = append(directories, fmt.Sprintf("/run/user/%d", os.Getuid()), "/tmp")
+
+	candidates := discordIPCOverride()
+	for _, directory := range directories {
+		for _, sandbox := range discordSandboxes {
+			for i := 0; i < 10; i++ {
+				candidates = append(candidates, filepath.Join(directory, sandbox, fmt.Sprintf("discord-ipc-%d", i)))
+			}
+		}
+	}
+
+	var paths []string
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		if seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+		if info, err := os.Stat(candidate); err == nil && info.Mode()&os.ModeSocket != 0 {
+			paths = append(paths, candidate)
+		}
+	}
+	return paths
+}
+
+// dialDiscord connects to a Discord unix socket
+func dialDiscord(path string) (io.ReadWriteCloser, error) {
+	return net.DialTimeout("unix", path, discordIPCTimeout)
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// discordSocketPaths returns the `discord-ipc-N` named pipes that exist, the configured override comes first
+func discordSocketPaths() []string {
+	var paths []string
+	for _, path := range discordIPCOverride() {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		path := fmt.Sprintf(`\\.\pipe\discord-ipc-%d`, i)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// dialDiscord connects to a Discord named pipe, unlike a file opened on the pipe the connection supports deadlines
+func dialDiscord(path string) (io.ReadWriteCloser, error) {
+	timeout := discordIPCTimeout
+	return winio.DialPipe(path, &timeout)
+}
@@ -218,6 +218,22 @@ func (f *FujisanRpc) SeekTo(r *http.Request, args *SeekToArgs, result *interface
 	return nil
 }
 
+type VolumeArgs struct {
+	Volume float64 `json:"volume"`
+}
+
+// SetVolume sets the MusicKit volume between 0 and 1
+func (f *FujisanRpc) SetVolume(r *http.Request, args *VolumeArgs, result *interface{}) error {
+	if args == nil {
+		return errors.New("must pass in volume")
+	}
+	if args.Volume < 0 || args.Volume > 1 {
+		return errors.New("volume must be between 0 and 1")
+	}
+	wruntime.WindowExecJS(FujisanObject.ctx, fmt.Sprintf("MusicKit.getInstance().volume = %v", args.Volume))
+	return nil
+}
+
 func (f *FujisanRpc) Hide(r *http.Request, args *interface{}, result *interface{}) error {
 	wruntime.Hide(FujisanObject.ctx)
 	return nil
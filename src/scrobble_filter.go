@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ScrobbleFilter is a set of rules which keep matching songs from being scrobbled, it is read from `connectivity.scrobbling.filters`
+type ScrobbleFilter struct {
+	Artists       []string `json:"artists"`
+	Albums        []string `json:"albums"`
+	Genres        []string `json:"genres"`
+	Kinds         []string `json:"kinds"`
+	MinDuration   int      `json:"minDuration"`
+	TitlePatterns []string `json:"titlePatterns"`
+
+	patterns []*regexp.Regexp
+}
+
+// containsFold returns the first value which equals s ignoring case
+func containsFold(values []string, s string) (string, bool) {
+	for _, value := range values {
+		if strings.EqualFold(strings.TrimSpace(value), strings.TrimSpace(s)) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// compilePatterns compiles the title patterns, invalid patterns are logged and skipped
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	expressions := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expression, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Println("Invalid scrobble filter title pattern", pattern+":", err)
+			continue
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions
+}
+
+// Compile prepares the title patterns once so `Match` doesn't compile them for every song
+func (s *ScrobbleFilter) Compile() *ScrobbleFilter {
+	s.patterns = compilePatterns(s.TitlePatterns)
+	return s
+}
+
+// Match returns true and a description of the rule when the song should not be scrobbled.
+// MinDuration is in seconds, TitlePatterns are regular expressions matched against the song name
+func (s *ScrobbleFilter) Match(attributes Attributes) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	if artist, ok := containsFold(s.Artists, attributes.ArtistName); ok {
+		return fmt.Sprintf("artist is %q", artist), true
+	}
+	if album, ok := containsFold(s.Albums, attributes.AlbumName); ok {
+		return fmt.Sprintf("album is %q", album), true
+	}
+	for _, genre := range attributes.GenreNames {
+		if match, ok := containsFold(s.Genres, genre); ok {
+			return fmt.Sprintf("genre is %q", match), true
+		}
+	}
+	if kind, ok := containsFold(s.Kinds, attributes.Kind); ok {
+		return fmt.Sprintf("kind is %q", kind), true
+	}
+	if s.MinDuration > 0 && attributes.DurationInMillis > 0 && attributes.DurationInMillis < s.MinDuration*1000 {
+		return fmt.Sprintf("duration of %ds is shorter than %ds", attributes.DurationInMillis/1000, s.MinDuration), true
+	}
+	patterns := s.patterns
+	if patterns == nil && len(s.TitlePatterns) != 0 {
+		patterns = compilePatterns(s.TitlePatterns)
+	}
+	for _, expression := range patterns {
+		if expression.MatchString(attributes.Name) {
+			return fmt.Sprintf("title matches %q", expression.String()), true
+		}
+	}
+	return "", false
+}
+
+// scrobbleFilter returns the scrobble filter rules of the config, they are decoded and compiled once per config change
+func (c *Cider) scrobbleFilter() *ScrobbleFilter {
+	return configDerived("connectivity.scrobbling.filters", func(config map[string]interface{}) interface{} {
+		filter := new(ScrobbleFilter)
+		if err := decodeConfig(config, "connectivity.scrobbling.filters", filter); err != nil {
+			log.Println("Unable to read scrobble filters:", err)
+		}
+		return filter.Compile()
+	}).(*ScrobbleFilter)
+}
+
+// scrobbleExcluded returns the filter rule keeping a song reaching `ScrobbleSong` from being scrobbled, and true if there is one
+func (c *Cider) scrobbleExcluded(attributes Attributes) (string, bool) {
+	return c.scrobbleFilter().Match(attributes)
+}
+
+type ScrobbleDryRunType struct {
+	Scrobble bool   `json:"scrobble"`
+	Rule     string `json:"rule"`
+}
+
+// ScrobbleDryRun evaluates the scrobble filters against the given song without scrobbling it
+func (f *FujisanRpc) ScrobbleDryRun(r *http.Request, args *Attributes, result *ScrobbleDryRunType) error {
+	if args == nil {
+		return errors.New("must pass in song attributes")
+	}
+	rule, excluded := FujisanObject.scrobbleExcluded(*args)
+	*result = ScrobbleDryRunType{Scrobble: !excluded, Rule: rule}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ciderapp/lastfm-go/lastfm"
+)
+
+// errLoveNotSupported is returned by the `Scrobbler.Love` of scrobblers which have no concept of loved songs
+var errLoveNotSupported = errors.New("loving songs is not supported")
+
+// Scrobbler is implemented by every service Cider is able to submit listens to
+type Scrobbler interface {
+	// Name returns a unique, human-readable name for the scrobbler
+	Name() string
+	// NowPlaying marks the given song as currently playing
+	NowPlaying(attributes Attributes) error
+	// Scrobble submits a finished listen that started at timestamp
+	Scrobble(attributes Attributes, timestamp time.Time) error
+	// Love loves or unloves the given song
+	Love(attributes Attributes, love bool) error
+}
+
+// filteredScrobbler is implemented by scrobblers with their own filter rules on top of `connectivity.scrobbling.filters`
+type filteredScrobbler interface {
+	Filter() *ScrobbleFilter
+}
+
+// LastFmScrobbler submits listens to Last.fm through the `*lastfm.Api` of an account.
+// Servers which only implement the Last.fm API aren't supported, Maloja and other self-hosted servers are reached through their ListenBrainz API
+type LastFmScrobbler struct {
+	Api     *lastfm.Api
+	User    string
+	Filters *ScrobbleFilter
+}
+
+// NewLastFmScrobbler returns a `*LastFmScrobbler` for an already logged in `*lastfm.Api`
+func NewLastFmScrobbler(api *lastfm.Api, user string) *LastFmScrobbler {
+	return &LastFmScrobbler{Api: api, User: user}
+}
+
+func (l *LastFmScrobbler) Name() string {
+	return "Last.fm (" + l.User + ")"
+}
+
+func (l *LastFmScrobbler) Filter() *ScrobbleFilter {
+	return l.Filters
+}
+
+// checkToken checks that the scrobbler is logged in with an `*lastfm.Api` for reading from Last.fm
+func (l *LastFmScrobbler) checkToken() error {
+	if l.Api == nil {
+		return errors.New("last.fm is not initialized")
+	}
+	if _, err := l.Api.GetToken(); err != nil {
+		return errors.New("failed to get user token, failed to login")
+	}
+	return nil
+}
+
+// checkSession checks that the scrobbler has a session key to submit with
+func (l *LastFmScrobbler) checkSession() error {
+	if l.Api == nil || len(l.Api.GetSessionKey()) == 0 {
+		return errors.New("last.fm is not initialized")
+	}
+	return nil
+}
+
+func (l *LastFmScrobbler) trackParams(attributes Attributes) lastfm.P {
+	p := lastfm.P{
+		"artist": attributes.ArtistName,
+		"track":  attributes.Name,
+	}
+	if len(attributes.AlbumName) != 0 {
+		p["album"] = attributes.AlbumName
+	}
+	if attributes.DurationInMillis > 0 {
+		p["duration"] = attributes.DurationInMillis / 1000
+	}
+	return p
+}
+
+func (l *LastFmScrobbler) NowPlaying(attributes Attributes) error {
+	if err := l.checkSession(); err != nil {
+		return err
+	}
+	_, err := l.Api.Track.UpdateNowPlaying(l.trackParams(attributes))
+	return err
+}
+
+func (l *LastFmScrobbler) Scrobble(attributes Attributes, timestamp time.Time) error {
+	if err := l.checkSession(); err != nil {
+		return err
+	}
+	p := l.trackParams(attributes)
+	p["timestamp"] = timestamp.Unix()
+	_, err := l.Api.Track.Scrobble(p)
+	return err
+}
+
+func (l *LastFmScrobbler) Love(attributes Attributes, love bool) error {
+	if err := l.checkSession(); err != nil {
+		return err
+	}
+	p := lastfm.P{"artist": attributes.ArtistName, "track": attributes.Name}
+	if love {
+		return l.Api.Track.Love(p)
+	}
+	return l.Api.Track.UnLove(p)
+}
+
+// addScrobbler registers a scrobbler, replacing any scrobbler already registered under the same name
+func (c *Cider) addScrobbler(scrobbler Scrobbler) {
+	c.scrobblerMutex.Lock()
+	defer c.scrobblerMutex.Unlock()
+	for i, existing := range c.Scrobblers {
+		if existing.Name() == scrobbler.Name() {
+			c.Scrobblers[i] = scrobbler
+			return
+		}
+	}
+	c.Scrobblers = append(c.Scrobblers, scrobbler)
+}
+
+// scrobblers returns a copy of the registered scrobblers so they can be used without holding the lock
+func (c *Cider) scrobblers() []Scrobbler {
+	c.scrobblerMutex.RLock()
+	defer c.scrobblerMutex.RUnlock()
+	return append([]Scrobbler(nil), c.Scrobblers...)
+}
+
+// lastFmScrobbler returns the scrobbler of the primary Last.fm account, or nil if Last.fm is not logged in or the account is disabled
+func (c *Cider) lastFmScrobbler() *LastFmScrobbler {
+	FujisanLastFmAccounts.mutex.Lock()
+	primary := FujisanLastFmAccounts.primary
+	FujisanLastFmAccounts.mutex.Unlock()
+	if len(primary) == 0 {
+		return nil
+	}
+	for _, scrobbler := range c.scrobblers() {
+		if lastFm, ok := scrobbler.(*LastFmScrobbler); ok && lastFm.User == primary && lastFm.Api != nil {
+			return lastFm
+		}
+	}
+	return nil
+}
+
+// ListScrobblers returns the names of every enabled scrobbler
+func (c *Cider) ListScrobblers() []string {
+	var names []string
+	for _, scrobbler := range c.scrobblers() {
+		names = append(names, scrobbler.Name())
+	}
+	return names
+}
+
+// RemoveScrobbler disables the scrobbler with the given name, returns false if it was not enabled
+func (c *Cider) RemoveScrobbler(name string) bool {
+	c.scrobblerMutex.Lock()
+	defer c.scrobblerMutex.Unlock()
+	for i, scrobbler := range c.Scrobblers {
+		if scrobbler.Name() == name {
+			c.Scrobblers = append(c.Scrobblers[:i], c.Scrobblers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
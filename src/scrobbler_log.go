@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RockboxLogScrobbler appends listens to a `.scrobbler.log` in the Audioscrobbler/Rockbox format so they can be uploaded later.
+// The log is rotated to `.scrobbler-YYYY-MM.log` when a listen arrives in a new month
+type RockboxLogScrobbler struct {
+	Directory string
+	mutex     sync.Mutex
+}
+
+// NewRockboxLogScrobbler returns a `*RockboxLogScrobbler` writing into directory
+func NewRockboxLogScrobbler(directory string) *RockboxLogScrobbler {
+	return &RockboxLogScrobbler{Directory: directory}
+}
+
+func (r *RockboxLogScrobbler) Name() string {
+	return "Local scrobble log"
+}
+
+func (r *RockboxLogScrobbler) path() string {
+	return filepath.Join(r.Directory, ".scrobbler.log")
+}
+
+// rotate moves the log aside when it was last written in a different month than now
+func (r *RockboxLogScrobbler) rotate(now time.Time) error {
+	info, err := os.Stat(r.path())
+	if err != nil {
+		return nil
+	}
+	modified := info.ModTime().UTC()
+	if modified.Year() == now.Year() && modified.Month() == now.Month() {
+		return nil
+	}
+	return os.Rename(r.path(), filepath.Join(r.Directory, fmt.Sprintf(".scrobbler-%s.log", modified.Format("2006-01"))))
+}
+
+// field strips the characters which would break the tab separated format
+func (r *RockboxLogScrobbler) field(value string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
+func (r *RockboxLogScrobbler) NowPlaying(attributes Attributes) error {
+	return nil
+}
+
+// Scrobble appends the listen with an `L` rating, songs that were skipped never qualify for `ScrobbleSong` and are not logged
+func (r *RockboxLogScrobbler) Scrobble(attributes Attributes, timestamp time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now().UTC()
+	if err := r.rotate(now); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(r.path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		if _, err := fmt.Fprintf(file, "#AUDIOSCROBBLER/1.1\n#TZ/UTC\n#CLIENT/Cider %s\n", Version); err != nil {
+			return err
+		}
+	}
+
+	trackNumber := ""
+	if attributes.TrackNumber > 0 {
+		trackNumber = strconv.Itoa(attributes.TrackNumber)
+	}
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\t%s\t%d\tL\t%d\t\n",
+		r.field(attributes.ArtistName),
+		r.field(attributes.AlbumName),
+		r.field(attributes.Name),
+		trackNumber,
+		attributes.DurationInMillis/1000,
+		timestamp.Unix(),
+	)
+	return err
+}
+
+func (r *RockboxLogScrobbler) Love(attributes Attributes, love bool) error {
+	return errLoveNotSupported
+}
+
+// SetLocalScrobbleLog turns the `.scrobbler.log` in the config path on or off
+func (c *Cider) SetLocalScrobbleLog(enabled bool) {
+	scrobbler := NewRockboxLogScrobbler(FujisanIOObject.GetConfigPath())
+	if enabled {
+		c.addScrobbler(scrobbler)
+	} else {
+		c.RemoveScrobbler(scrobbler.Name())
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciderapp/lastfm-go/lastfm"
+)
+
+var testSong = Attributes{
+	ArtistName:       "Daft Punk",
+	Name:             "One More Time",
+	AlbumName:        "Discovery",
+	DurationInMillis: 320000,
+}
+
+// lastFmStandInTransport sends the requests lastfm-go makes to Last.fm to a stand-in server instead
+type lastFmStandInTransport struct {
+	server    *httptest.Server
+	transport http.RoundTripper
+}
+
+func (l lastFmStandInTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(l.server.URL)
+	request = request.Clone(request.Context())
+	request.URL.Scheme, request.URL.Host = target.Scheme, target.Host
+	return l.transport.RoundTrip(request)
+}
+
+// lastFmStandIn records the forms posted to Last.fm and answers with response, every request must be signed with "secret".
+// lastfm-go has no setting for its API root, so `http.DefaultTransport` is pointed at the stand-in for the length of the test
+func lastFmStandIn(t *testing.T, response string) *[]map[string]string {
+	var mutex sync.Mutex
+	var calls []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		var keys []string
+		call := make(map[string]string)
+		for key := range r.PostForm {
+			if key != "api_sig" {
+				keys = append(keys, key)
+			}
+			// Scrobbles are sent as batches of one, "artist[0]" and so on
+			call[strings.TrimSuffix(key, "[0]")] = r.PostForm.Get(key)
+		}
+		sort.Strings(keys)
+		signature := md5.New()
+		for _, key := range keys {
+			io.WriteString(signature, key+r.PostForm.Get(key))
+		}
+		io.WriteString(signature, "secret")
+		if r.PostForm.Get("api_sig") != hex.EncodeToString(signature.Sum(nil)) {
+			t.Errorf("%s is not signed", r.PostForm.Get("method"))
+		}
+		mutex.Lock()
+		calls = append(calls, call)
+		mutex.Unlock()
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+
+	transport := http.DefaultTransport
+	http.DefaultTransport = lastFmStandInTransport{server, transport}
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	return &calls
+}
+
+func testLastFmScrobbler() *LastFmScrobbler {
+	api := lastfm.New("key", "secret")
+	api.SetSession("session")
+	return NewLastFmScrobbler(api, "tester")
+}
+
+func TestLastFmScrobblerSignsScrobbles(t *testing.T) {
+	calls := lastFmStandIn(t, `<lfm status="ok"><scrobbles accepted="1" ignored="0"></scrobbles></lfm>`)
+	scrobbler := testLastFmScrobbler()
+
+	timestamp := time.Unix(1700000000, 0)
+	if err := scrobbler.Scrobble(testSong, timestamp); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 1 {
+		t.Fatalf("expected 1 call, got %d", len(*calls))
+	}
+	call := (*calls)[0]
+	expected := map[string]string{
+		"method":    "track.scrobble",
+		"api_key":   "key",
+		"sk":        "session",
+		"artist":    "Daft Punk",
+		"track":     "One More Time",
+		"album":     "Discovery",
+		"duration":  "320",
+		"timestamp": "1700000000",
+	}
+	for key, value := range expected {
+		if call[key] != value {
+			t.Errorf("%s = %q, want %q", key, call[key], value)
+		}
+	}
+}
+
+func TestLastFmScrobblerLove(t *testing.T) {
+	calls := lastFmStandIn(t, `<lfm status="ok"></lfm>`)
+	scrobbler := testLastFmScrobbler()
+
+	if err := scrobbler.Love(testSong, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := scrobbler.Love(testSong, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 2 || (*calls)[0]["method"] != "track.love" || (*calls)[1]["method"] != "track.unlove" {
+		t.Fatalf("unexpected calls %v", *calls)
+	}
+}
+
+func TestLastFmScrobblerReportsApiErrors(t *testing.T) {
+	lastFmStandIn(t, `<lfm status="failed"><error code="9">Invalid session key - Please re-authenticate</error></lfm>`)
+	scrobbler := testLastFmScrobbler()
+
+	err := scrobbler.NowPlaying(testSong)
+	var apiError *lastfm.LastfmError
+	if !errors.As(err, &apiError) || apiError.Code != 9 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestLastFmScrobblerRequiresSession(t *testing.T) {
+	calls := lastFmStandIn(t, `<lfm status="ok"></lfm>`)
+	if err := NewLastFmScrobbler(nil, "tester").Scrobble(testSong, time.Now()); err == nil {
+		t.Fatal("expected an error without a session")
+	}
+	if err := NewLastFmScrobbler(lastfm.New("key", "secret"), "tester").Scrobble(testSong, time.Now()); err == nil {
+		t.Fatal("expected an error without a session")
+	}
+	if len(*calls) != 0 {
+		t.Fatalf("nothing should be sent without a session, got %v", *calls)
+	}
+}
+
+// listenBrainzStandIn records the submissions made to a fake ListenBrainz API root, playing_now submissions fail when failNowPlaying is set
+func listenBrainzStandIn(t *testing.T, failNowPlaying bool) (*httptest.Server, *[]listenBrainzSubmission) {
+	var mutex sync.Mutex
+	var submissions []listenBrainzSubmission
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1/validate-token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"valid": r.Header.Get("Authorization") == "Token token", "message": "Invalid token", "user_name": "tester"})
+	})
+	mux.HandleFunc("/1/submit-listens", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var submission listenBrainzSubmission
+		if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		submissions = append(submissions, submission)
+		mutex.Unlock()
+		if failNowPlaying && submission.ListenType == "playing_now" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"code":503,"error":"Service unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	mux.HandleFunc("/1/metadata/lookup/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"recording_mbid":"d9d8a5e1-0000-0000-0000-000000000000"}`))
+	})
+	mux.HandleFunc("/1/feedback/recording-feedback", func(w http.ResponseWriter, r *http.Request) {
+		var feedback map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&feedback)
+		if feedback["recording_mbid"] != "d9d8a5e1-0000-0000-0000-000000000000" || feedback["score"] != 1.0 {
+			t.Errorf("unexpected feedback %v", feedback)
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &submissions
+}
+
+func TestListenBrainzScrobbler(t *testing.T) {
+	server, submissions := listenBrainzStandIn(t, false)
+	scrobbler := NewListenBrainzScrobbler(server.URL+"/", "token")
+
+	user, err := scrobbler.ValidateToken()
+	if err != nil || user != "tester" {
+		t.Fatalf("ValidateToken() = %q, %v", user, err)
+	}
+	if err := scrobbler.NowPlaying(testSong); err != nil {
+		t.Fatal(err)
+	}
+	if err := scrobbler.Scrobble(testSong, time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := scrobbler.Love(testSong, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*submissions) != 2 {
+		t.Fatalf("expected 2 submissions, got %d", len(*submissions))
+	}
+	nowPlaying, single := (*submissions)[0], (*submissions)[1]
+	if nowPlaying.ListenType != "playing_now" || nowPlaying.Payload[0].ListenedAt != 0 {
+		t.Errorf("unexpected now playing submission %+v", nowPlaying)
+	}
+	if single.ListenType != "single" || single.Payload[0].ListenedAt != 1700000000 {
+		t.Errorf("unexpected listen submission %+v", single)
+	}
+	metadata := single.Payload[0].TrackMetadata
+	if metadata.ArtistName != "Daft Punk" || metadata.TrackName != "One More Time" || metadata.ReleaseName != "Discovery" {
+		t.Errorf("unexpected track metadata %+v", metadata)
+	}
+}
+
+func TestListenBrainzScrobblerRejectsBadToken(t *testing.T) {
+	server, _ := listenBrainzStandIn(t, false)
+	scrobbler := NewListenBrainzScrobbler(server.URL, "wrong")
+
+	if _, err := scrobbler.ValidateToken(); err == nil {
+		t.Fatal("expected an invalid token")
+	}
+	if err := scrobbler.Scrobble(testSong, time.Now()); err == nil {
+		t.Fatal("expected the submission to be rejected")
+	}
+}
+
+func TestSubmitScrobbleAfterNowPlayingFails(t *testing.T) {
+	server, submissions := listenBrainzStandIn(t, true)
+	scrobbler := NewListenBrainzScrobbler(server.URL, "token")
+
+	c := new(Cider)
+	if err := c.submitScrobble(scrobbler, testSong, time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(*submissions) != 2 || (*submissions)[1].ListenType != "single" {
+		t.Fatalf("the listen was not submitted after Now Playing failed: %+v", *submissions)
+	}
+}
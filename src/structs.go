@@ -23,12 +23,18 @@ type Attributes struct {
 	Previews []struct {
 		URL string `json:"url"`
 	} `json:"previews"`
-	ReleaseDate time.Time `json:"releaseDate"`
-	TrackNumber int       `json:"trackNumber"`
-	SongID      string    `json:"songId"`
-	Kind        string    `json:"kind"`
-	Status      bool      `json:"status"`
-	URL         struct {
+	ReleaseDate   time.Time `json:"releaseDate"`
+	TrackNumber   int       `json:"trackNumber"`
+	SongID        string    `json:"songId"`
+	Kind          string    `json:"kind"`
+	Status        bool      `json:"status"`
+	ContentRating string    `json:"contentRating"`
+	Container     struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"container"`
+	URL struct {
 		Cider      string `json:"cider"`
 		AppleMusic string `json:"appleMusic"`
 		SongLink   string `json:"songLink"`
@@ -57,4 +63,5 @@ type PluginMetadata struct {
 	Authors            []string `json:"authors"`
 	FrontendMainScript string   `json:"FrontendMainScript" json:"-"`
 	BackendMainScript  string   `json:"BackendMainScript" json:"-"`
+	Permissions        []string `json:"permissions"`
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookLogSize is how many deliveries are kept for `GetWebhookDeliveries`
+	webhookLogSize = 100
+	// webhookQueueSize is how many events can wait for a webhook URL, the oldest are dropped past it
+	webhookQueueSize   = 100
+	webhookTimeout     = 10 * time.Second
+	webhookMinBackoff  = time.Second
+	webhookMaxBackoff  = 30 * time.Second
+	webhookRetries     = 3
+	webhookTestEvent   = "test"
+	webhookSignature   = "X-Cider-Signature"
+	webhookEventHeader = "X-Cider-Event"
+)
+
+// webhookDefaultEvents are sent when a webhook doesn't list its events, seeking and lyrics are too chatty to be on by default
+var webhookDefaultEvents = []PlaybackEventKind{PlaybackTrackChange, PlaybackPlay, PlaybackPause, PlaybackScrobble, PlaybackLove, PlaybackUnlove}
+
+// Webhook is an HTTP endpoint notified on playback events, read from `connectivity.webhooks`.
+// String values in Body are status templates with `{event}` and `{time}` in addition to the song placeholders,
+// the body defaults to the event with the full song attributes
+type Webhook struct {
+	Name    string              `json:"name"`
+	Url     string              `json:"url"`
+	Enabled *bool               `json:"enabled"`
+	Events  []PlaybackEventKind `json:"events"`
+	Body    interface{}         `json:"body"`
+	Headers map[string]string   `json:"headers"`
+	// Secret signs the body with HMAC-SHA256 in the `X-Cider-Signature` header
+	Secret  string `json:"secret"`
+	Retries *int   `json:"retries"`
+}
+
+// WebhookDelivery is a delivery attempt kept in the delivery log
+type WebhookDelivery struct {
+	ID       string            `json:"id"`
+	Webhook  string            `json:"webhook"`
+	Event    PlaybackEventKind `json:"event"`
+	Url      string            `json:"url"`
+	Status   int               `json:"status"`
+	Attempts int               `json:"attempts"`
+	Success  bool              `json:"success"`
+	Error    string            `json:"error"`
+	Time     time.Time         `json:"time"`
+	Duration int64             `json:"durationMs"`
+}
+
+// wants returns if the webhook is sent for an event, test events are sent to every webhook
+func (w Webhook) wants(kind PlaybackEventKind) bool {
+	if kind == webhookTestEvent {
+		return true
+	}
+	if w.Enabled != nil && !*w.Enabled {
+		return false
+	}
+	events := w.Events
+	if len(events) == 0 {
+		events = webhookDefaultEvents
+	}
+	for _, event := range events {
+		if event == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// renderWebhookBody renders every string in a body template
+func renderWebhookBody(body interface{}, values map[string]string) interface{} {
+	switch value := body.(type) {
+	case string:
+		return renderTemplateValues(value, values)
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			rendered[key] = renderWebhookBody(item, values)
+		}
+		return rendered
+	case []interface{}:
+		rendered := make([]interface{}, len(value))
+		for i, item := range value {
+			rendered[i] = renderWebhookBody(item, values)
+		}
+		return rendered
+	default:
+		return value
+	}
+}
+
+// webhookPayload builds the JSON body of a webhook for an event
+func (w Webhook) payload(event PlaybackEvent) ([]byte, error) {
+	if w.Body == nil {
+		return json.Marshal(struct {
+			Event      PlaybackEventKind `json:"event"`
+			Time       time.Time         `json:"time"`
+			Playing    bool              `json:"playing"`
+			Attributes Attributes        `json:"attributes"`
+		}{event.Kind, event.Time, event.State.Playing, event.Attributes})
+	}
+	values := templateValues(event.Attributes)
+	values["event"] = string(event.Kind)
+	values["time"] = event.Time.UTC().Format(time.RFC3339)
+	return json.Marshal(renderWebhookBody(w.Body, values))
+}
+
+// signWebhook returns the signature of a body
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookJob is an event waiting to be delivered to a webhook
+type webhookJob struct {
+	webhook Webhook
+	event   PlaybackEvent
+}
+
+// WebhookDispatcher sends playback events to the configured webhooks and keeps a log of the deliveries
+type WebhookDispatcher struct {
+	client *http.Client
+	// backoff is the wait before the first retry, it doubles up to `webhookMaxBackoff`
+	backoff    time.Duration
+	deliveries []WebhookDelivery
+	// queues holds the events waiting for each webhook URL, a URL has a worker for as long as it has a queue
+	queues map[string][]webhookJob
+	mutex  sync.Mutex
+}
+
+// NewWebhookDispatcher returns a `*WebhookDispatcher` with an empty delivery log
+func NewWebhookDispatcher() *WebhookDispatcher {
+	return &WebhookDispatcher{client: &http.Client{Timeout: webhookTimeout}, backoff: webhookMinBackoff}
+}
+
+// webhooks reads the configured webhooks
+func (d *WebhookDispatcher) webhooks() []Webhook {
+	var webhooks []Webhook
+	if err := decodeConfig(loadConfig(), "connectivity.webhooks", &webhooks); err != nil {
+		log.Println("Unable to read webhooks:", err)
+	}
+	return webhooks
+}
+
+// record adds a delivery to the log, dropping the oldest once it is full
+func (d *WebhookDispatcher) record(delivery WebhookDelivery) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > webhookLogSize {
+		d.deliveries = d.deliveries[len(d.deliveries)-webhookLogSize:]
+	}
+}
+
+// Deliveries returns up to limit of the latest deliveries, newest first
+func (d *WebhookDispatcher) Deliveries(limit int) []WebhookDelivery {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if limit <= 0 || limit > len(d.deliveries) {
+		limit = len(d.deliveries)
+	}
+	list := make([]WebhookDelivery, 0, limit)
+	for i := len(d.deliveries) - 1; i >= len(d.deliveries)-limit; i-- {
+		list = append(list, d.deliveries[i])
+	}
+	return list
+}
+
+// HandleEvent sends an event to every webhook that wants it, each delivery retries in the background
+func (d *WebhookDispatcher) HandleEvent(event PlaybackEvent) {
+	for _, webhook := range d.webhooks() {
+		if len(webhook.Url) != 0 && webhook.wants(event.Kind) {
+			d.enqueue(webhook, event)
+		}
+	}
+}
+
+// enqueue queues an event for a webhook, events sent to the same URL are delivered one at a time in order
+// so a retried delivery can't arrive after the events that followed it
+func (d *WebhookDispatcher) enqueue(webhook Webhook, event PlaybackEvent) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.queues == nil {
+		d.queues = make(map[string][]webhookJob)
+	}
+	queue, working := d.queues[webhook.Url]
+	if len(queue) == webhookQueueSize {
+		log.Println("Webhook", webhook.Name, "is falling behind, dropping the", queue[0].event.Kind, "event")
+		queue = queue[1:]
+	}
+	d.queues[webhook.Url] = append(queue, webhookJob{webhook, event})
+	if !working {
+		go d.work(webhook.Url)
+	}
+}
+
+// work delivers the queue of a webhook URL until it is empty
+func (d *WebhookDispatcher) work(url string) {
+	for {
+		d.mutex.Lock()
+		queue := d.queues[url]
+		if len(queue) == 0 {
+			delete(d.queues, url)
+			d.mutex.Unlock()
+			return
+		}
+		d.queues[url] = queue[1:]
+		d.mutex.Unlock()
+		d.deliver(queue[0].webhook, queue[0].event)
+	}
+}
+
+// post sends the body once, the returned bool is true when a failure is worth retrying
+func (d *WebhookDispatcher) post(webhook Webhook, event PlaybackEvent, id string, body []byte) (int, bool, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Cider/"+Version)
+	for key, value := range webhook.Headers {
+		request.Header.Set(key, value)
+	}
+	request.Header.Set(webhookEventHeader, string(event.Kind))
+	request.Header.Set("X-Cider-Delivery", id)
+	if len(webhook.Secret) != 0 {
+		request.Header.Set(webhookSignature, signWebhook(webhook.Secret, body))
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, true, err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response.StatusCode, false, nil
+	}
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	return response.StatusCode, retry, fmt.Errorf("webhook returned %s", response.Status)
+}
+
+// deliver sends an event to a webhook, retrying with exponential backoff, and records the outcome
+func (d *WebhookDispatcher) deliver(webhook Webhook, event PlaybackEvent) WebhookDelivery {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	delivery := WebhookDelivery{
+		ID:      hex.EncodeToString(id),
+		Webhook: webhook.Name,
+		Event:   event.Kind,
+		Url:     webhook.Url,
+		Time:    time.Now(),
+	}
+
+	retries := webhookRetries
+	if webhook.Retries != nil && *webhook.Retries >= 0 {
+		retries = *webhook.Retries
+	}
+
+	body, err := webhook.payload(event)
+	if err == nil {
+		backoff := d.backoff
+		for {
+			var retry bool
+			delivery.Attempts++
+			delivery.Status, retry, err = d.post(webhook, event, delivery.ID, body)
+			if err == nil || !retry || delivery.Attempts > retries {
+				break
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+	}
+
+	delivery.Duration = time.Since(delivery.Time).Milliseconds()
+	delivery.Success = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+		log.Println("Failed to deliver webhook", webhook.Name+":", err)
+	}
+	d.record(delivery)
+	return delivery
+}
+
+// TestWebhook sends a test event with the current song to the webhook with the given name and waits for the delivery
+func (d *WebhookDispatcher) TestWebhook(name string) (WebhookDelivery, error) {
+	for _, webhook := range d.webhooks() {
+		if webhook.Name == name {
+			state := FujisanPlaybackObject.State()
+			return d.deliver(webhook, PlaybackEvent{
+				Kind:       webhookTestEvent,
+				Attributes: state.Attributes,
+				State:      state,
+				Time:       time.Now(),
+			}), nil
+		}
+	}
+	return WebhookDelivery{}, fmt.Errorf("no webhook named %q", name)
+}
+
+type WebhookArgs struct {
+	Name  string `json:"name"`
+	Limit int    `json:"limit"`
+}
+
+type WebhookDeliveriesType struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// GetWebhookDeliveries returns the latest webhook deliveries, newest first
+func (f *FujisanRpc) GetWebhookDeliveries(r *http.Request, args *WebhookArgs, result *WebhookDeliveriesType) error {
+	limit := 0
+	if args != nil {
+		limit = args.Limit
+	}
+	*result = WebhookDeliveriesType{FujisanWebhookObject.Deliveries(limit)}
+	return nil
+}
+
+// TestWebhook sends a test event to a webhook and returns the delivery
+func (f *FujisanRpc) TestWebhook(r *http.Request, args *WebhookArgs, result *WebhookDelivery) error {
+	if args == nil || len(args.Name) == 0 {
+		return errors.New("must pass in name")
+	}
+	delivery, err := FujisanWebhookObject.TestWebhook(args.Name)
+	if err != nil {
+		return err
+	}
+	*result = delivery
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request received by the webhook sink
+type webhookRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+// webhookSink records the requests it receives and answers with the next status of statuses, the last one repeats
+func webhookSink(t *testing.T, statuses ...int) (*httptest.Server, func() []webhookRequest) {
+	var mutex sync.Mutex
+	var requests []webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		requests = append(requests, webhookRequest{r.Header, body})
+		status := statuses[len(statuses)-1]
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []webhookRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+func testWebhookDispatcher() *WebhookDispatcher {
+	dispatcher := NewWebhookDispatcher()
+	dispatcher.backoff = time.Millisecond
+	return dispatcher
+}
+
+var testPlaybackEvent = PlaybackEvent{Kind: PlaybackTrackChange, Attributes: testSong, State: PlaybackState{Playing: true}, Time: time.Unix(1700000000, 0)}
+
+func TestWebhookSignature(t *testing.T) {
+	server, requests := webhookSink(t, http.StatusNoContent)
+	dispatcher := testWebhookDispatcher()
+
+	webhook := Webhook{Name: "sink", Url: server.URL, Secret: "secret", Headers: map[string]string{"Authorization": "Bearer token"}}
+	delivery := dispatcher.deliver(webhook, testPlaybackEvent)
+	if !delivery.Success || delivery.Status != http.StatusNoContent || delivery.Attempts != 1 {
+		t.Fatalf("unexpected delivery %+v", delivery)
+	}
+
+	received := requests()
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	request := received[0]
+	if signature := request.Header.Get(webhookSignature); signature != signWebhook("secret", request.Body) {
+		t.Errorf("signature %q doesn't match the body", signature)
+	}
+	if request.Header.Get(webhookEventHeader) != "trackChange" || request.Header.Get("X-Cider-Delivery") != delivery.ID || request.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("unexpected headers %v", request.Header)
+	}
+
+	var payload struct {
+		Event      string     `json:"event"`
+		Playing    bool       `json:"playing"`
+		Attributes Attributes `json:"attributes"`
+	}
+	if err := json.Unmarshal(request.Body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != "trackChange" || !payload.Playing || payload.Attributes.Name != "One More Time" {
+		t.Errorf("unexpected payload %s", request.Body)
+	}
+}
+
+func TestWebhookUnsignedWithoutSecret(t *testing.T) {
+	server, requests := webhookSink(t, http.StatusOK)
+	dispatcher := testWebhookDispatcher()
+
+	dispatcher.deliver(Webhook{Name: "sink", Url: server.URL, Body: map[string]interface{}{"content": "{event}: {artist} - {name}"}}, testPlaybackEvent)
+	request := requests()[0]
+	if _, ok := request.Header[webhookSignature]; ok {
+		t.Error("a webhook without a secret must not be signed")
+	}
+	if string(request.Body) != `{"content":"trackChange: Daft Punk - One More Time"}` {
+		t.Errorf("unexpected body %s", request.Body)
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	server, requests := webhookSink(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	dispatcher := testWebhookDispatcher()
+
+	delivery := dispatcher.deliver(Webhook{Name: "sink", Url: server.URL}, testPlaybackEvent)
+	if !delivery.Success || delivery.Attempts != 3 || delivery.Status != http.StatusOK {
+		t.Fatalf("unexpected delivery %+v", delivery)
+	}
+	received := requests()
+	if len(received) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(received))
+	}
+	// Every attempt is the same delivery
+	for _, request := range received {
+		if request.Header.Get("X-Cider-Delivery") != delivery.ID {
+			t.Errorf("attempt sent as delivery %q", request.Header.Get("X-Cider-Delivery"))
+		}
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	server, requests := webhookSink(t, http.StatusBadGateway)
+	dispatcher := testWebhookDispatcher()
+
+	retries := 1
+	delivery := dispatcher.deliver(Webhook{Name: "sink", Url: server.URL, Retries: &retries}, testPlaybackEvent)
+	if delivery.Success || delivery.Attempts != 2 || delivery.Status != http.StatusBadGateway || len(delivery.Error) == 0 {
+		t.Fatalf("unexpected delivery %+v", delivery)
+	}
+	if len(requests()) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests()))
+	}
+}
+
+func TestWebhookClientErrorsAreNotRetried(t *testing.T) {
+	server, requests := webhookSink(t, http.StatusBadRequest)
+	dispatcher := testWebhookDispatcher()
+
+	delivery := dispatcher.deliver(Webhook{Name: "sink", Url: server.URL}, testPlaybackEvent)
+	if delivery.Success || delivery.Attempts != 1 || len(requests()) != 1 {
+		t.Fatalf("a client error was retried: %+v", delivery)
+	}
+}
+
+func TestWebhookDeliveryLog(t *testing.T) {
+	server, _ := webhookSink(t, http.StatusOK)
+	dispatcher := testWebhookDispatcher()
+
+	for i := 0; i < webhookLogSize+5; i++ {
+		event := testPlaybackEvent
+		if i%2 == 1 {
+			event.Kind = PlaybackPause
+		}
+		dispatcher.deliver(Webhook{Name: "sink", Url: server.URL}, event)
+	}
+
+	all := dispatcher.Deliveries(0)
+	if len(all) != webhookLogSize {
+		t.Fatalf("expected the log to keep %d deliveries, got %d", webhookLogSize, len(all))
+	}
+	latest := dispatcher.Deliveries(2)
+	if len(latest) != 2 || latest[0].ID != all[0].ID || latest[0].Event != PlaybackTrackChange || latest[1].Event != PlaybackPause {
+		t.Fatalf("expected the newest deliveries first, got %+v", latest)
+	}
+	if latest[0].Time.Before(latest[1].Time) {
+		t.Error("deliveries are not newest first")
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		webhook Webhook
+		kind    PlaybackEventKind
+		wants   bool
+	}{
+		{Webhook{}, PlaybackTrackChange, true},
+		{Webhook{}, PlaybackSeek, false},
+		{Webhook{Events: []PlaybackEventKind{PlaybackSeek}}, PlaybackSeek, true},
+		{Webhook{Events: []PlaybackEventKind{PlaybackSeek}}, PlaybackTrackChange, false},
+		{Webhook{Enabled: &disabled}, PlaybackTrackChange, false},
+		{Webhook{Enabled: &disabled}, webhookTestEvent, true},
+	}
+	for _, test := range tests {
+		if test.webhook.wants(test.kind) != test.wants {
+			t.Errorf("%+v wants %s: expected %v", test.webhook, test.kind, test.wants)
+		}
+	}
+}
+
+func TestWebhookDeliveriesStayInOrder(t *testing.T) {
+	// The first delivery fails once, the events queued behind it must wait for its retry
+	server, requests := webhookSink(t, http.StatusServiceUnavailable, http.StatusOK)
+	dispatcher := testWebhookDispatcher()
+
+	webhook := Webhook{Name: "sink", Url: server.URL, Body: map[string]interface{}{"time": "{time}"}}
+	var expected []string
+	for i := 0; i < 10; i++ {
+		event := testPlaybackEvent
+		event.Time = event.Time.Add(time.Duration(i) * time.Second)
+		expected = append(expected, `{"time":"`+event.Time.UTC().Format(time.RFC3339)+`"}`)
+		dispatcher.enqueue(webhook, event)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dispatcher.Deliveries(0)) != len(expected) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the deliveries")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	received := requests()
+	if len(received) != len(expected)+1 || string(received[0].Body) != expected[0] {
+		t.Fatalf("expected the first event to be sent twice, got %d requests", len(received))
+	}
+	for i, request := range received[1:] {
+		if string(request.Body) != expected[i] {
+			t.Fatalf("request %d was %s, expected %s", i+1, request.Body, expected[i])
+		}
+	}
+}